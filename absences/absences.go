@@ -1,11 +1,17 @@
 package absences
 
+import (
+	"github.com/R3PTR/go-auth-api/audit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
 type AbsencesService struct {
 	absencesDbService *AbsencesDbService
+	auditService      *audit.AuditService
 }
 
-func NewAbsencesService(absencesDbService *AbsencesDbService) *AbsencesService {
-	return &AbsencesService{absencesDbService: absencesDbService}
+func NewAbsencesService(absencesDbService *AbsencesDbService, auditService *audit.AuditService) *AbsencesService {
+	return &AbsencesService{absencesDbService: absencesDbService, auditService: auditService}
 }
 
 // GetAbsences returns all absences.
@@ -24,21 +30,56 @@ func (a *AbsencesService) GetAbsenceById(id string) (Absence, error) {
 }
 
 // CreateAbsence creates a new absence.
-func (a *AbsencesService) CreateAbsence(newAbsence newAbsence, userId string) error {
-	return a.absencesDbService.CreateAbsence(newAbsence, userId)
+func (a *AbsencesService) CreateAbsence(newAbsence newAbsence, userId string, actor audit.Actor) error {
+	absenceId, err := a.absencesDbService.CreateAbsence(newAbsence, userId)
+	if err != nil {
+		return err
+	}
+	a.auditService.Record(actor, audit.AbsenceCreated, "absence", absenceId, nil, newAbsence)
+	return nil
 }
 
 // UpdateOwnAbsence updates an absence.
-func (a *AbsencesService) UpdateOwnAbsence(updateOwnAbsence UpdateOwnAbsence) error {
-	return a.absencesDbService.UpdateOwnAbsence(updateOwnAbsence)
+func (a *AbsencesService) UpdateOwnAbsence(updateOwnAbsence UpdateOwnAbsence, actor audit.Actor) error {
+	before, _ := a.absencesDbService.GetAbsenceById(updateOwnAbsence.Id)
+	err := a.absencesDbService.UpdateOwnAbsence(updateOwnAbsence)
+	if err != nil {
+		return err
+	}
+	after, _ := a.absencesDbService.GetAbsenceById(updateOwnAbsence.Id)
+	a.auditService.Record(actor, audit.AbsenceUpdated, "absence", updateOwnAbsence.Id, before, after)
+	return nil
 }
 
 // UpdateAbsenceAsAdmin updates an absence as an admin.
-func (a *AbsencesService) UpdateAbsenceAsAdmin(updateAbsenceAsAdmin UpdateAbsenceAsAdmin) error {
-	return a.absencesDbService.UpdateAbsenceAsAdmin(updateAbsenceAsAdmin)
+func (a *AbsencesService) UpdateAbsenceAsAdmin(updateAbsenceAsAdmin UpdateAbsenceAsAdmin, actor audit.Actor) error {
+	before, _ := a.absencesDbService.GetAbsenceById(updateAbsenceAsAdmin.Id)
+	err := a.absencesDbService.UpdateAbsenceAsAdmin(updateAbsenceAsAdmin)
+	if err != nil {
+		return err
+	}
+	after, _ := a.absencesDbService.GetAbsenceById(updateAbsenceAsAdmin.Id)
+	a.auditService.Record(actor, audit.AbsenceReviewed, "absence", updateAbsenceAsAdmin.Id, before, after)
+	return nil
+}
+
+// AnonymizeUserAbsences detaches the absences of a purged user from the user.
+func (a *AbsencesService) AnonymizeUserAbsences(userId string, actor audit.Actor) error {
+	count, err := a.absencesDbService.AnonymizeAbsencesByUserId(userId)
+	if err != nil {
+		return err
+	}
+	a.auditService.Record(actor, audit.AbsencesAnonymized, "user", userId, nil, bson.M{"count": count})
+	return nil
 }
 
 // DeleteAbsence deletes an absence.
-func (a *AbsencesService) DeleteAbsence(id string) error {
-	return a.absencesDbService.DeleteAbsence(id)
+func (a *AbsencesService) DeleteAbsence(id string, actor audit.Actor) error {
+	before, _ := a.absencesDbService.GetAbsenceById(id)
+	err := a.absencesDbService.DeleteAbsence(id)
+	if err != nil {
+		return err
+	}
+	a.auditService.Record(actor, audit.AbsenceDeleted, "absence", id, before, nil)
+	return nil
 }
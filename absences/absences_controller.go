@@ -3,6 +3,7 @@ package absences
 import (
 	"net/http"
 
+	"github.com/R3PTR/go-auth-api/audit"
 	"github.com/R3PTR/go-auth-api/auth"
 	"github.com/gin-gonic/gin"
 )
@@ -17,6 +18,26 @@ func NewAbsencesController(absencesService *AbsencesService) *AbsencesController
 	return &AbsencesController{absencesService: absencesService}
 }
 
+// absenceUser returns the user of the request and answers the request if there is none.
+// Service accounts are no people and never absent, so they can't use absence routes.
+func absenceUser(c *gin.Context) (*auth.User, bool) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	user, ok := user_unasserted.(*auth.User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if user.Type == auth.ServiceAccountType {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Service accounts can't have absences"})
+		return nil, false
+	}
+	return user, true
+}
+
 // GetAbsences
 func (a *AbsencesController) GetAllAbsences(c *gin.Context) {
 	absences, err := a.absencesService.GetAbsences()
@@ -29,13 +50,9 @@ func (a *AbsencesController) GetAllAbsences(c *gin.Context) {
 
 // GetAbsencesByUserId
 func (a *AbsencesController) GetAbsences(c *gin.Context) {
-	user_unasserted, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
-	}
-	user, ok := user_unasserted.(*auth.User)
+	user, ok := absenceUser(c)
 	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
 	}
 	absences, err := a.absencesService.GetAbsencesByUserId(user.Id)
 	if err != nil {
@@ -47,49 +64,47 @@ func (a *AbsencesController) GetAbsences(c *gin.Context) {
 
 // CreateAbsence
 func (a *AbsencesController) CreateAbsence(c *gin.Context) {
-	user_unasserted, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
-	}
-	user, ok := user_unasserted.(*auth.User)
+	user, ok := absenceUser(c)
 	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
 	}
 	var newAbsence newAbsence
 	if err := c.ShouldBindJSON(&newAbsence); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	err := a.absencesService.CreateAbsence(newAbsence, user.Id)
+	err := a.absencesService.CreateAbsence(newAbsence, user.Id, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusCreated, gin.H{"message": "Absence created"})
 }
 
 // UpdateOwnAbsence
 func (a *AbsencesController) UpdateOwnAbsence(c *gin.Context) {
-	user_unasserted, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
-	}
-	user, ok := user_unasserted.(*auth.User)
+	user, ok := absenceUser(c)
 	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
 	}
 	var updateOwnAbsence UpdateOwnAbsence
 	if err := c.ShouldBindJSON(&updateOwnAbsence); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 	absence, err := a.absencesService.GetAbsenceById(updateOwnAbsence.Id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	if absence.UserId != user.Id {
 		c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to update this absence"})
+		return
 	}
-	err = a.absencesService.UpdateOwnAbsence(updateOwnAbsence)
+	err = a.absencesService.UpdateOwnAbsence(updateOwnAbsence, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Absence updated"})
 }
@@ -99,20 +114,26 @@ func (a *AbsencesController) UpdateAbsenceAsAdmin(c *gin.Context) {
 	var updateAbsenceAsAdmin UpdateAbsenceAsAdmin
 	if err := c.ShouldBindJSON(&updateAbsenceAsAdmin); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	err := a.absencesService.UpdateAbsenceAsAdmin(updateAbsenceAsAdmin)
+	err := a.absencesService.UpdateAbsenceAsAdmin(updateAbsenceAsAdmin, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Absence updated"})
 }
 
 // DeleteAbsence
 func (a *AbsencesController) DeleteAbsence(c *gin.Context) {
+	if _, ok := absenceUser(c); !ok {
+		return
+	}
 	id := c.Param("id")
-	err := a.absencesService.DeleteAbsence(id)
+	err := a.absencesService.DeleteAbsence(id, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Absence deleted"})
 }
@@ -48,7 +48,8 @@ func (a *AbsencesDbService) GetAbsences() ([]Absence, error) {
 func (a *AbsencesDbService) GetAbsencesByUserId(userId string) ([]Absence, error) {
 	var absences []Absence
 
-	cursor, err := a.getAbsenceCollection().Find(context.Background(), bson.M{"userId": userId})
+	// Absences have no bson tags, so their keys are the lowercased field names
+	cursor, err := a.getAbsenceCollection().Find(context.Background(), bson.M{"userid": userId})
 	if err != nil {
 		return nil, err
 	}
@@ -77,8 +78,8 @@ func (a *AbsencesDbService) GetAbsenceById(id string) (Absence, error) {
 	return absence, err
 }
 
-// CreateAbsence creates a new absence.
-func (a *AbsencesDbService) CreateAbsence(newAbsence newAbsence, userId string) error {
+// CreateAbsence creates a new absence and returns its id.
+func (a *AbsencesDbService) CreateAbsence(newAbsence newAbsence, userId string) (string, error) {
 	absence := Absence{
 		TypeOfAbsence: newAbsence.TypeOfAbsence,
 		UserId:        userId,
@@ -87,11 +88,14 @@ func (a *AbsencesDbService) CreateAbsence(newAbsence newAbsence, userId string)
 		Reason:        newAbsence.Reason,
 		Status:        "pending",
 	}
-	_, err := a.getAbsenceCollection().InsertOne(context.Background(), absence)
+	result, err := a.getAbsenceCollection().InsertOne(context.Background(), absence)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	if objectId, ok := result.InsertedID.(primitive.ObjectID); ok {
+		return objectId.Hex(), nil
+	}
+	return "", nil
 }
 
 // UpdateOwnAbsence updates an absence.
@@ -121,6 +125,17 @@ func (a *AbsencesDbService) UpdateAbsenceAsAdmin(updateAbsenceAsAdmin UpdateAbse
 	return nil
 }
 
+// AnonymizeAbsencesByUserId removes the user and the reason the user gave from the absences of a user.
+// Type, dates, days and status stay for the statistics, and so does the reviewer's reason for a rejection.
+func (a *AbsencesDbService) AnonymizeAbsencesByUserId(userId string) (int64, error) {
+	update := bson.M{"$set": bson.M{"userid": "", "reason": ""}}
+	result, err := a.getAbsenceCollection().UpdateMany(context.Background(), bson.M{"userid": userId}, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
 // DeleteAbsence deletes an absence.
 func (a *AbsencesDbService) DeleteAbsence(id string) error {
 	objectId, err := primitive.ObjectIDFromHex(id)
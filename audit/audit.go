@@ -0,0 +1,241 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Actions recorded in the audit log
+const (
+	UserLogin                = "user.login"
+	UserLoginFailed          = "user.login_failed"
+	UserReauthenticated      = "user.reauthenticated"
+	UserLocked               = "user.locked"
+	UserLogout               = "user.logout"
+	UserCreated              = "user.created"
+	UserUpdated              = "user.updated"
+	UserDeleted              = "user.deleted"
+	UserActivated            = "user.activated"
+	UserSuspended            = "user.suspended"
+	UserDisabled             = "user.disabled"
+	UserRestored             = "user.restored"
+	UserPurged               = "user.purged"
+	DataExported             = "user.data_exported"
+	EmailChangeRequested     = "user.email_change_requested"
+	EmailChangeCancelled     = "user.email_change_cancelled"
+	EmailChanged             = "user.email_changed"
+	ImpersonationStarted     = "user.impersonation_started"
+	ImpersonatedRequest      = "user.impersonated_request"
+	ImpersonationEnded       = "user.impersonation_ended"
+	PasswordChanged          = "user.password_changed"
+	PasswordResetRequested   = "user.password_reset_requested"
+	MagicLinkRequested       = "user.magic_link_requested"
+	InvitationSent           = "user.invitation_sent"
+	InvitationRevoked        = "user.invitation_revoked"
+	PasswordReset            = "user.password_reset"
+	TOTPActivated            = "user.totp_activated"
+	TOTPDeactivated          = "user.totp_deactivated"
+	BackupCodesRegenerated   = "user.backup_codes_regenerated"
+	SessionRevoked           = "session.revoked"
+	RefreshTokenReused       = "session.refresh_token_reused"
+	SiteCreated              = "site.created"
+	SiteUpdated              = "site.updated"
+	SiteDeleted              = "site.deleted"
+	WorkspaceCreated         = "workspace.created"
+	WorkspaceUpdated         = "workspace.updated"
+	WorkspaceDeleted         = "workspace.deleted"
+	AbsenceCreated           = "absence.created"
+	AbsenceUpdated           = "absence.updated"
+	AbsenceReviewed          = "absence.reviewed"
+	AbsencesAnonymized       = "absence.anonymized"
+	AuditAnonymized          = "audit.anonymized"
+	AbsenceDeleted           = "absence.deleted"
+	RoleCreated              = "role.created"
+	RoleUpdated              = "role.updated"
+	RoleDeleted              = "role.deleted"
+	PasskeyRegistered        = "user.passkey_registered"
+	PasskeyRemoved           = "user.passkey_removed"
+	ExternalIdentityLinked   = "user.external_identity_linked"
+	ExternalIdentityUnlinked = "user.external_identity_unlinked"
+	ClientSecretRotated      = "user.client_secret_rotated"
+	APIKeyCreated            = "apikey.created"
+	APIKeyRevoked            = "apikey.revoked"
+	OIDCClientCreated        = "oidc.client_created"
+	OIDCClientDeleted        = "oidc.client_deleted"
+	OIDCAuthorized           = "oidc.authorized"
+	OIDCTokenIssued          = "oidc.token_issued"
+)
+
+// redactedFields never show up with their values in a diff
+var redactedFields = map[string]bool{
+	"password":         true,
+	"passwordHistory":  true,
+	"oneTimePassword":  true,
+	"totpSecret":       true,
+	"backupCodes":      true,
+	"tokenHash":        true,
+	"keyHash":          true,
+	"clientSecretHash": true,
+}
+
+type AuditService struct {
+	auditDbService *AuditDbService
+}
+
+func NewAuditService(auditDbService *AuditDbService) *AuditService {
+	return &AuditService{auditDbService: auditDbService}
+}
+
+// ActorFromContext returns the actor set by the AuthMiddleware together with the client of the request
+func ActorFromContext(c *gin.Context) Actor {
+	actor := Actor{}
+	actor_unasserted, exists := c.Get("actor")
+	if exists {
+		if a, ok := actor_unasserted.(Actor); ok {
+			actor = a
+		}
+	}
+	actor.IP = c.ClientIP()
+	actor.UserAgent = c.Request.UserAgent()
+	return actor
+}
+
+// Record appends an entry to the audit log. Before and after are the target
+// before and after the action, either may be nil. Errors are only logged, so a
+// failing audit log never breaks the audited action.
+func (a *AuditService) Record(actor Actor, action, targetType, targetId string, before, after interface{}) {
+	entry := Entry{
+		Action:        action,
+		ActorId:       actor.UserId,
+		ActorUsername: actor.Username,
+		TargetType:    targetType,
+		TargetId:      targetId,
+		IP:            actor.IP,
+		UserAgent:     actor.UserAgent,
+		Diff:          diff(before, after),
+		Timestamp:     time.Now(),
+	}
+	err := a.auditDbService.InsertEntry(entry)
+	if err != nil {
+		fmt.Println("Error writing audit entry:", err)
+	}
+}
+
+// AnonymizeUserEntries removes the personal data of a purged user from the audit log.
+// The entries stay, so the log still tells what happened, but not to or by whom.
+func (a *AuditService) AnonymizeUserEntries(userId string, actor Actor) error {
+	count, err := a.auditDbService.AnonymizeEntriesByUserId(userId)
+	if err != nil {
+		return err
+	}
+	a.Record(actor, AuditAnonymized, "user", userId, nil, bson.M{"count": count})
+	return nil
+}
+
+// GetEntries returns a page of the entries matching the filter and the cursor of the next page
+func (a *AuditService) GetEntries(filter Filter) ([]Entry, string, error) {
+	return a.auditDbService.GetEntries(filter)
+}
+
+// GetAllEntries returns every entry matching the filter, page by page. It is meant for
+// filters on one actor or target like data exports, not for browsing the whole log.
+func (a *AuditService) GetAllEntries(filter Filter) ([]Entry, error) {
+	entries := []Entry{}
+	filter.Limit = MaxPageSize
+	for {
+		page, next, err := a.auditDbService.GetEntries(filter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if next == "" {
+			return entries, nil
+		}
+		filter.After = next
+	}
+}
+
+// WriteCSV writes entries as CSV for auditors
+func (a *AuditService) WriteCSV(w io.Writer, entries []Entry) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"timestamp", "action", "actorId", "actorUsername", "targetType", "targetId", "ip", "userAgent", "diff"})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		diffJson := ""
+		if len(entry.Diff) > 0 {
+			b, err := json.Marshal(entry.Diff)
+			if err != nil {
+				return err
+			}
+			diffJson = string(b)
+		}
+		err := writer.Write([]string{entry.Timestamp.Format(time.RFC3339), entry.Action, entry.ActorId, entry.ActorUsername, entry.TargetType, entry.TargetId, entry.IP, entry.UserAgent, diffJson})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// diff compares the bson representation of before and after field by field
+func diff(before, after interface{}) map[string]Change {
+	beforeMap := toMap(before)
+	afterMap := toMap(after)
+	changes := map[string]Change{}
+	for key, value := range afterMap {
+		old, exists := beforeMap[key]
+		if exists && reflect.DeepEqual(old, value) {
+			continue
+		}
+		changes[key] = redact(key, Change{From: old, To: value})
+	}
+	for key, old := range beforeMap {
+		if _, exists := afterMap[key]; !exists {
+			changes[key] = redact(key, Change{From: old, To: nil})
+		}
+	}
+	delete(changes, "_id")
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func redact(key string, change Change) Change {
+	if !redactedFields[key] {
+		return change
+	}
+	if change.From != nil {
+		change.From = "[redacted]"
+	}
+	if change.To != nil {
+		change.To = "[redacted]"
+	}
+	return change
+}
+
+func toMap(value interface{}) bson.M {
+	if value == nil || (reflect.ValueOf(value).Kind() == reflect.Ptr && reflect.ValueOf(value).IsNil()) {
+		return bson.M{}
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return bson.M{}
+	}
+	m := bson.M{}
+	err = bson.Unmarshal(data, &m)
+	if err != nil {
+		return bson.M{}
+	}
+	return m
+}
@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditController struct {
+	auditService *AuditService
+}
+
+func NewAuditController(auditService *AuditService) *AuditController {
+	return &AuditController{auditService: auditService}
+}
+
+// GetEntries returns the audit entries filtered by actor, target, action and time range.
+// With format=csv the entries are returned as a CSV download. Entries are returned in pages
+// of limit entries, the next page is requested with the cursor in next or X-Next-Cursor as after.
+func (ac *AuditController) GetEntries(c *gin.Context) {
+	filter := Filter{
+		ActorId:  c.Query("actor"),
+		TargetId: c.Query("target"),
+		Action:   c.Query("action"),
+	}
+	var err error
+	if from := c.Query("from"); from != "" {
+		filter.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from has to be an RFC3339 timestamp"})
+			return
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		filter.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to has to be an RFC3339 timestamp"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit has to be a positive number"})
+			return
+		}
+	}
+	filter.After = c.Query("after")
+	entries, next, err := ac.auditService.GetEntries(filter)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if next != "" {
+		c.Header("X-Next-Cursor", next)
+	}
+	if c.Query("format") == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", "attachment; filename=audit_log.csv")
+		err = ac.auditService.WriteCSV(c.Writer, entries)
+		if err != nil {
+			c.Error(err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "next": next})
+}
@@ -0,0 +1,161 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AuditDbService struct {
+	mongoClient *database.MongoDBClient
+}
+
+func NewAuditDbService(mongoClient *database.MongoDBClient) *AuditDbService {
+	return &AuditDbService{mongoClient: mongoClient}
+}
+
+// getAuditCollection returns the audit collection.
+func (a *AuditDbService) getAuditCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.AuditCollection)
+}
+
+// InsertEntry appends an entry to the audit log.
+func (a *AuditDbService) InsertEntry(entry Entry) error {
+	_, err := a.getAuditCollection().InsertOne(context.Background(), entry)
+	return err
+}
+
+// AnonymizeEntriesByUserId removes the diffs of the entries targeting the user and the
+// name and client of the entries the user performed. It returns the number of changed entries.
+func (a *AuditDbService) AnonymizeEntriesByUserId(userId string) (int64, error) {
+	targeted, err := a.getAuditCollection().UpdateMany(context.Background(),
+		bson.M{"targetId": userId, "diff": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"diff": ""}})
+	if err != nil {
+		return 0, err
+	}
+	// Failed logins and lockouts have no actor id but name the user as actor and come from the user's client
+	unknownActor, err := a.getAuditCollection().UpdateMany(context.Background(),
+		bson.M{"targetId": userId, "actorId": bson.M{"$in": bson.A{nil, ""}}},
+		bson.M{"$unset": bson.M{"actorUsername": "", "ip": "", "userAgent": ""}})
+	if err != nil {
+		return 0, err
+	}
+	performed, err := a.getAuditCollection().UpdateMany(context.Background(),
+		bson.M{"actorId": userId},
+		bson.M{"$unset": bson.M{"actorUsername": "", "ip": "", "userAgent": "", "diff": ""}})
+	if err != nil {
+		return 0, err
+	}
+	return targeted.ModifiedCount + unknownActor.ModifiedCount + performed.ModifiedCount, nil
+}
+
+// Page sizes of GetEntries
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// EnsureIndexes creates the indexes of the filters of GetEntries
+func (a *AuditDbService) EnsureIndexes() error {
+	_, err := a.getAuditCollection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "targetId", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	return err
+}
+
+// GetEntries returns a page of the entries matching the filter, newest first, and the
+// cursor of the next page. The cursor is empty on the last page.
+func (a *AuditDbService) GetEntries(filter Filter) ([]Entry, string, error) {
+	entries := []Entry{}
+	query := bson.M{}
+	if filter.ActorId != "" {
+		query["actorId"] = filter.ActorId
+	}
+	if filter.TargetId != "" {
+		query["targetId"] = filter.TargetId
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	timestamp := bson.M{}
+	if !filter.From.IsZero() {
+		timestamp["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		timestamp["$lte"] = filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	if filter.After != "" {
+		after, err := afterCursor(filter.After)
+		if err != nil {
+			return nil, "", err
+		}
+		query["$and"] = bson.A{after}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	// One more entry than the page tells whether there is a next page
+	findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit + 1))
+	cursor, err := a.getAuditCollection().Find(context.Background(), query, findOptions)
+	if err != nil {
+		return nil, "", err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var entry Entry
+		err := cursor.Decode(&entry)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, entry)
+	}
+	if cursor.Err() != nil {
+		return nil, "", cursor.Err()
+	}
+	if len(entries) <= limit {
+		return entries, "", nil
+	}
+	entries = entries[:limit]
+	last := entries[limit-1]
+	return entries, strconv.FormatInt(last.Timestamp.UnixMilli(), 10) + "_" + last.Id, nil
+}
+
+// afterCursor returns the query for the entries after the entry a cursor points to
+func afterCursor(cursor string) (bson.M, error) {
+	millis, id, found := strings.Cut(cursor, "_")
+	if !found {
+		return nil, errors.New("invalid cursor")
+	}
+	timestampMillis, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	timestamp := time.UnixMilli(timestampMillis)
+	return bson.M{"$or": bson.A{
+		bson.M{"timestamp": bson.M{"$lt": timestamp}},
+		bson.M{"timestamp": timestamp, "_id": bson.M{"$lt": objectId}},
+	}}, nil
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"time"
+)
+
+// Actor is the principal that performed an action and the client it came from
+type Actor struct {
+	UserId    string `bson:"userId,omitempty" json:"userId,omitempty"`
+	Username  string `bson:"username,omitempty" json:"username,omitempty"`
+	IP        string `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	// Role is the role of the user at the time of the request. It is never recorded.
+	Role string `bson:"-" json:"-"`
+}
+
+// Change is the value of a field before and after an action
+type Change struct {
+	From interface{} `bson:"from" json:"from"`
+	To   interface{} `bson:"to" json:"to"`
+}
+
+// Entry is a single record of the audit log. Entries are never deleted and only
+// changed to anonymize a purged user.
+type Entry struct {
+	Id            string            `bson:"_id,omitempty" json:"id"`
+	Action        string            `bson:"action" json:"action"`
+	ActorId       string            `bson:"actorId,omitempty" json:"actorId,omitempty"`
+	ActorUsername string            `bson:"actorUsername,omitempty" json:"actorUsername,omitempty"`
+	TargetType    string            `bson:"targetType,omitempty" json:"targetType,omitempty"`
+	TargetId      string            `bson:"targetId,omitempty" json:"targetId,omitempty"`
+	IP            string            `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent     string            `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	Diff          map[string]Change `bson:"diff,omitempty" json:"diff,omitempty"`
+	Timestamp     time.Time         `bson:"timestamp" json:"timestamp"`
+}
+
+// Filter selects audit entries, empty fields match everything
+type Filter struct {
+	ActorId  string
+	TargetId string
+	Action   string
+	From     time.Time
+	To       time.Time
+	// Limit is the page size, capped at MaxPageSize. After is the cursor of the previous page.
+	Limit int
+	After string
+}
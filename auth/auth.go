@@ -2,74 +2,160 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"image/png"
 	"log"
 	"math/big"
 	"strings"
 	"time"
 
+	"github.com/R3PTR/go-auth-api/audit"
 	"github.com/R3PTR/go-auth-api/config"
 	"github.com/R3PTR/go-auth-api/database"
 	"github.com/R3PTR/go-auth-api/emails"
+	"github.com/R3PTR/go-auth-api/roles"
+	"github.com/R3PTR/go-auth-api/throttling"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"go.mongodb.org/mongo-driver/bson"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthService struct {
-	mongoClient   *database.MongoDBClient
-	config        *config.Config
-	AuthDbService *AuthDbService
-	EmailSender   *emails.EmailSender
+	mongoClient       *database.MongoDBClient
+	config            *config.Config
+	AuthDbService     *AuthDbService
+	EmailSender       *emails.EmailSender
+	revocationList    *RevocationList
+	keyManager        *KeyManager
+	sessionTracker    *sessionTracker
+	throttlingService *throttling.ThrottlingService
+	passwordPolicy    *PasswordPolicy
+	hasher            *PasswordHasher
+	auditService      *audit.AuditService
+	roleService       *roles.RoleService
+	webAuthn          *webauthn.WebAuthn
+	externalProviders map[string]*externalProvider
+	// credentialBackends are tried in order by Login, local passwords stay the fallback
+	credentialBackends []CredentialBackend
+	// purgeHooks remove the personal data other packages keep about a purged user
+	purgeHooks []PurgeHook
 }
 
+// errDirectoryPassword is returned when a password managed by a credential backend should be changed
+var errDirectoryPassword = errors.New("the password of this user is managed by the directory")
+
 const (
 	NEW    = "NEW"
 	ACTIVE = "ACTIVE"
+	// SUSPENDED users are locked out for now, for example during an investigation
+	SUSPENDED = "SUSPENDED"
+	// DISABLED users left the company, disabled service accounts are switched off
+	DISABLED = "DISABLED"
+	// DELETED users can be restored until they are purged after the retention period
+	DELETED = "DELETED"
+)
+
+// Invitation states
+const (
+	InvitationSent     = "SENT"
+	InvitationOpened   = "OPENED"
+	InvitationAccepted = "ACCEPTED"
+	InvitationExpired  = "EXPIRED"
+	InvitationRevoked  = "REVOKED"
 )
 
+// ServiceAccountType is the User.Type of service accounts
+const ServiceAccountType = "SERVICE"
+
 const (
-	ADMIN  = "ADMIN"
-	USER   = "USER"
-	DRIVER = "DRIVER"
+	LoginToken     = "LoginToken"
+	TwoFactorToken = "TwoFactorToken"
+	RefreshToken   = "RefreshToken"
+	// OIDCAccessToken is issued to relying parties of the OIDC provider
+	OIDCAccessToken = "OIDCAccessToken"
+	// APIKeyToken is the token type of API keys, which are opaque and not JWTs
+	APIKeyToken = "APIKey"
+	// ServiceToken is issued to service accounts for their client credentials
+	ServiceToken = "ServiceToken"
+	// InvitationToken is sent by email to new users to set their first password
+	InvitationToken = "InvitationToken"
+	// ImpersonationToken lets an admin act as another user, the admin stays the actor
+	ImpersonationToken = "ImpersonationToken"
+	// MagicLinkToken is sent by email and exchanged once for a LoginToken
+	MagicLinkToken = "MagicLinkToken"
 )
 
 // NewAuthService creates a new AuthService with the provided MongoDB client.
-func NewAuthService(mongoClient *database.MongoDBClient, config *config.Config, authDbService *AuthDbService, emailSender *emails.EmailSender) *AuthService {
-	return &AuthService{mongoClient: mongoClient, config: config, AuthDbService: authDbService, EmailSender: emailSender}
+func NewAuthService(mongoClient *database.MongoDBClient, config *config.Config, authDbService *AuthDbService, emailSender *emails.EmailSender, revocationList *RevocationList, keyManager *KeyManager, throttlingService *throttling.ThrottlingService, auditService *audit.AuditService, roleService *roles.RoleService, webAuthn *webauthn.WebAuthn, credentialBackends []CredentialBackend) *AuthService {
+	return &AuthService{mongoClient: mongoClient, config: config, AuthDbService: authDbService, EmailSender: emailSender, revocationList: revocationList, keyManager: keyManager, sessionTracker: newSessionTracker(), throttlingService: throttlingService, passwordPolicy: NewPasswordPolicy(config.PasswordPolicy), hasher: NewPasswordHasher(config.PasswordHashing), auditService: auditService, roleService: roleService, webAuthn: webAuthn, externalProviders: newExternalProviders(config.Federation), credentialBackends: credentialBackends}
 }
 
-func (a *AuthService) CreateUser(createUserRequest CreateUserRequest) error {
-	//Check if user exists
-	existingUser, _ := a.AuthDbService.GetUserbyUsername(createUserRequest.Username)
-	if existingUser != nil {
-		return errors.New("User already exists")
+// actorFromClient returns the audit actor for requests where the user authenticates itself
+func actorFromClient(user *User, client ClientInfo) audit.Actor {
+	actor := audit.Actor{IP: client.IP, UserAgent: client.UserAgent}
+	if user != nil {
+		actor.UserId = user.Id
+		actor.Username = user.Username
 	}
-	// Generate random password
-	password, err := generateRandomPassword(8)
-	if err != nil {
-		log.Fatal(err)
-		return err
+	return actor
+}
+
+// record writes an audit entry for an action on a user
+func (a *AuthService) record(actor audit.Actor, action, userId string, before, after interface{}) {
+	a.auditService.Record(actor, action, "user", userId, before, after)
+}
+
+// checkRoleCovered rejects roles that grant permissions the actor doesn't have, so nobody
+// can hand out more than they hold. Actors without a user, like background jobs and the
+// import command, run with the permissions of the server.
+func (a *AuthService) checkRoleCovered(role string, actor audit.Actor) error {
+	if actor.UserId == "" {
+		return nil
 	}
-	fmt.Println(password)
-	hashedPassword, err := HashPassword(password)
+	actorUser, err := a.AuthDbService.GetCachedUserbyId(actor.UserId)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return errors.New("Unauthorized")
+	}
+	if !a.roleService.Covers(actorUser.Role, role) {
+		return errors.New("role " + role + " grants permissions you don't have")
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	return nil
+}
+
+// checkPermissionsHeld rejects permissions the actor doesn't have, like scopes of API keys for other users
+func (a *AuthService) checkPermissionsHeld(permissions []string, actor audit.Actor) error {
+	if actor.UserId == "" {
+		return nil
+	}
+	actorUser, err := a.AuthDbService.GetCachedUserbyId(actor.UserId)
 	if err != nil {
-		fmt.Println(err)
-		return errors.New("something went wrong hashing the password")
+		return errors.New("Unauthorized")
 	}
+	if !a.roleService.GrantsAll(actorUser.Role, permissions) {
+		return errors.New("you can't grant permissions you don't have")
+	}
+	return nil
+}
+
+func (a *AuthService) CreateUser(createUserRequest CreateUserRequest, actor audit.Actor) error {
+	//Check if user exists
+	existingUser, _ := a.AuthDbService.GetUserbyUsername(createUserRequest.Username)
+	if existingUser != nil {
+		return errors.New("User already exists")
+	}
+	if !a.roleService.RoleExists(createUserRequest.Role) {
+		return errors.New("Role does not exist")
+	}
+	err := a.checkRoleCovered(createUserRequest.Role, actor)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 	timestamp := time.Now()
@@ -77,8 +163,6 @@ func (a *AuthService) CreateUser(createUserRequest CreateUserRequest) error {
 		Username:            createUserRequest.Username,
 		FirstName:           createUserRequest.FirstName,
 		LastName:            createUserRequest.LastName,
-		Password:            "",
-		OneTimePassword:     hashedPassword,
 		Role:                createUserRequest.Role,
 		Personnelnumber:     createUserRequest.Personnelnumber,
 		VacationDaysPerYear: createUserRequest.VacationDaysPerYear,
@@ -89,59 +173,59 @@ func (a *AuthService) CreateUser(createUserRequest CreateUserRequest) error {
 		UpdatedAt:           timestamp,
 	}
 	err = a.AuthDbService.CreateUser(user)
+	if errors.Is(err, ErrUsernameTaken) {
+		return err
+	}
 	if err != nil {
 		return errors.New("something went wrong creating the user")
 	}
-	a.EmailSender.SendEmail(user.Username, "New User", "Your new password is: "+password)
-	return nil
-}
-
-func (a *AuthService) DeleteOwnUser(userId string) error {
-	err := a.AuthDbService.DeleteUserById(userId)
+	createdUser, err := a.AuthDbService.GetUserbyUsername(user.Username)
 	if err != nil {
 		return err
 	}
-	return nil
+	a.record(actor, audit.UserCreated, createdUser.Id, nil, *createdUser)
+	return a.inviteUser(createdUser, actor)
 }
 
-func (a *AuthService) DeleteOtherUser(userId string) error {
-	err := a.AuthDbService.DeleteUserById(userId)
+// removeUser deletes the user and everything that belongs to it for good
+func (a *AuthService) removeUser(userId string, actor audit.Actor) error {
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	err = a.AuthDbService.DeleteUserById(userId)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (a *AuthService) ActivateUser(user *User, newPassword string) error {
-	if user.State != NEW {
-		return errors.New("User is already activated")
+	err = a.AuthDbService.DeleteWebAuthnCredentialsByUserId(userId)
+	if err != nil {
+		return err
 	}
-	// Hash newPassword
-	hashedPassword, err := HashPassword(newPassword)
+	err = a.AuthDbService.DeleteExternalIdentitiesByUserId(userId)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	// Double check if passwordhash is correct
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(newPassword))
+	err = a.AuthDbService.DeleteAPIKeysByUserId(userId)
 	if err != nil {
-		fmt.Println(err)
-		return errors.New("something went wrong hashing the password")
+		return err
 	}
-	// Update user
-	filter := bson.M{"username": user.Username}
-	update := bson.M{"$set": bson.M{"state": ACTIVE, "password": hashedPassword, "oneTimePassword": nil, "resetValidUntil": nil, "updatedAt": time.Now()}}
-	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, update)
+	err = a.AuthDbService.DeletePasswordResetsByUserId(userId)
 	if err != nil {
 		return err
 	}
+	err = a.AuthDbService.DeleteInvitationsByUserId(userId)
 	if err != nil {
 		return err
 	}
-	return nil
+	err = a.AuthDbService.DeleteEmailChangesByUserId(userId)
+	if err != nil {
+		return err
+	}
+	a.record(actor, audit.UserDeleted, userId, *user, nil)
+	return a.revokeUserTokens(userId)
 }
 
-func (a *AuthService) ChangePassword(username, newPassword string) error {
+func (a *AuthService) ChangePassword(username, newPassword string, actor audit.Actor) error {
 	// Check if user exists
 	user, error := a.AuthDbService.GetUserbyUsername(username)
 	if error != nil {
@@ -150,139 +234,138 @@ func (a *AuthService) ChangePassword(username, newPassword string) error {
 	if user.State != ACTIVE {
 		return errors.New("User is not active")
 	}
-	// Generate new password
-	hashedPassword, err := HashPassword(newPassword)
-	if err != nil {
-		log.Fatal(err)
-		return err
+	if user.AuthSource != "" {
+		return errDirectoryPassword
 	}
-	// Update user
-	filter := bson.M{"username": username}
-	update := bson.M{"$set": bson.M{"password": hashedPassword, "updatedAt": time.Now()}}
-	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, update)
+	err := a.validateNewPassword(user, newPassword)
 	if err != nil {
 		return err
 	}
-	a.AuthDbService.DeleteTokensByUserId(user.Id)
-	return nil
-}
-
-func (a *AuthService) ResetPassword(user *User, newPassword string) error {
-	if user.State != ACTIVE {
-		return errors.New("User is not active")
-	}
-	// Check if resetValidUntil is still valid
-	if user.ResetValidUntil.Before(time.Now()) {
-		return errors.New("reset password is not valid anymore")
-	}
 	// Generate new password
-	hashedPassword, err := HashPassword(newPassword)
+	hashedPassword, err := a.hasher.Hash(newPassword)
 	if err != nil {
 		log.Fatal(err)
 		return err
 	}
 	// Update user
 	filter := bson.M{"username": user.Username}
-	update := bson.M{"$set": bson.M{"password": hashedPassword, "oneTimePassword": nil, "resetValidUntil": nil, "updatedAt": time.Now()}}
+	update := bson.M{"$set": bson.M{"password": hashedPassword, "passwordHistory": a.passwordHistory(user), "updatedAt": time.Now()}}
 	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, update)
 	if err != nil {
 		return err
 	}
-	a.AuthDbService.DeleteTokensByUserId(user.Username)
-	return nil
+	a.record(actor, audit.PasswordChanged, user.Id, nil, nil)
+	return a.revokeUserTokens(user.Id)
 }
 
-func (a *AuthService) ForgotPassword(username string) error {
+func (a *AuthService) Login(username, password string, client ClientInfo) (*tokenModel, error) {
+	err := a.throttlingService.Check(throttling.Login, username, client.IP)
+	if err != nil {
+		return nil, err
+	}
 	// Check if user exists
-	_, error := a.AuthDbService.GetUserbyUsername(username)
-	if error != nil {
-		return errors.New("username or Password incorrect")
+	user, error := a.AuthDbService.GetUserbyUsername(username)
+	if error == nil && user.Type == ServiceAccountType {
+		// Service accounts only authenticate with client credentials or API keys
+		a.registerFailedAttempt(throttling.Login, username, client)
+		return nil, errors.New("username or Password incorrect")
+	}
+	if error != nil || user.AuthSource != "" {
+		// Unknown and directory users are authenticated by the credential backends
+		backendUser, err := a.authenticateWithBackends(username, password, user, client)
+		if err != nil {
+			a.registerFailedAttempt(throttling.Login, username, client)
+			return nil, errors.New("username or Password incorrect")
+		}
+		return a.loginWithBackendUser(backendUser, username, client)
 	}
-	// Generate random password
-	password, err := generateRandomPassword(8)
-	if err != nil {
-		log.Fatal(err)
-		return err
+	// Local users only log in with their local password, invited users set it with the link of the invitation
+	if user.State != ACTIVE {
+		a.registerFailedAttempt(throttling.Login, username, client)
+		return nil, errors.New("username or Password incorrect")
 	}
-	// Hash password
-	hashedPassword, err := HashPassword(password)
+	// Check if password is correct
+	err = a.hasher.Compare(user.Password, password)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		a.registerFailedAttempt(throttling.Login, username, client)
+		return nil, errors.New("username or Password incorrect")
 	}
-	fmt.Println(password)
-	// Set resetValidUntil
-	resetValidUntil := time.Now().Add(time.Minute * 15)
-	// Update user
-	filter := bson.M{"username": username}
-	update := bson.M{"$set": bson.M{"oneTimePassword": hashedPassword, "resetValidUntil": resetValidUntil}}
-	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, update)
+	a.rehashPassword(user, password)
+	a.throttlingService.RegisterSuccess(throttling.Login, username)
+	// Users with TOTP or a passkey only get a short-lived token for the second step
+	if user.TotpActive || a.hasPasskeys(user) {
+		return a.issueToken(user, TwoFactorToken, "", time.Now().Add(time.Minute*5), true, false)
+	}
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueLoginTokens(user, "", false, client)
+}
+
+// registerFailedAttempt counts a failed attempt and notifies the user if the account got locked
+func (a *AuthService) registerFailedAttempt(scope, username string, client ClientInfo) {
+	// Unknown usernames are recorded without a target
+	user, _ := a.AuthDbService.GetUserbyUsername(username)
+	targetId := ""
+	if user != nil {
+		targetId = user.Id
+	}
+	actor := actorFromClient(nil, client)
+	actor.Username = username
+	a.record(actor, audit.UserLoginFailed, targetId, nil, nil)
+	locked, err := a.throttlingService.RegisterFailure(scope, username, client.IP)
 	if err != nil {
-		return err
+		fmt.Println("Error registering failed attempt:", err)
+		return
+	}
+	if !locked {
+		return
 	}
-	err = a.EmailSender.SendEmail(username, "Forgot Password", "Your new password is: "+password)
+	a.record(actor, audit.UserLocked, targetId, nil, nil)
+	// Only existing users get an email
+	if user == nil {
+		return
+	}
+	body := "Your account was temporarily locked after too many failed login attempts from " + client.IP + ". If this was not you, please contact an administrator."
+	err = a.EmailSender.SendEmail(user.Username, "Account locked", body)
 	if err != nil {
-		return err
+		fmt.Println("Error sending lockout email:", err)
 	}
-	return nil
 }
 
-func (a *AuthService) Login(username, password, totp string) (*tokenModel, bool, error) {
-	// Check if user exists
-	user, error := a.AuthDbService.GetUserbyUsername(username)
-	if error != nil {
-		return nil, false, errors.New("username or Password incorrect")
+// CompleteTwoFactorLogin exchanges a pending TwoFactorToken and a TOTP or backup code for a LoginToken
+func (a *AuthService) CompleteTwoFactorLogin(user *User, pending *tokenModel, code string, client ClientInfo) (*tokenModel, error) {
+	if pending.TokenType != TwoFactorToken || !pending.Requires2FA {
+		return nil, errors.New("token is not a pending 2FA token")
 	}
-	token_type := "LoginToken"
-	expires := time.Now().Add(time.Hour * 720)
-	if user.State != ACTIVE {
-		token_type = "ActivationToken"
-		expires = time.Now().Add(time.Minute * 15)
-		err := bcrypt.CompareHashAndPassword([]byte(user.OneTimePassword), []byte(password))
-		if err != nil {
-			return nil, false, errors.New("username or Password incorrect")
-		}
-	} else {
-		// Check if password is correct
-		err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-		if err != nil {
-			err = bcrypt.CompareHashAndPassword([]byte(user.OneTimePassword), []byte(password))
-			if err == nil {
-				token_type = "ResetToken"
-				expires = time.Now().Add(time.Minute * 15)
-			} else {
-				return nil, false, errors.New("username or Password incorrect")
-			}
-		}
-		//Check if TOTP is active
-		if user.TotpActive {
-			if totp == "" {
-				return nil, true, errors.New("no TOTP provided")
-			}
-			// Check if TOTP is correct
-			valid, err := a.VerifyTOTP(user, totp)
-			if err != nil {
-				return nil, true, err
-			}
-			if !valid {
-				return nil, true, errors.New("TOTP is not valid")
-			}
-		}
+	// Users with only a passkey finish the login with the passkey, never with a code
+	if !user.TotpActive {
+		return nil, errors.New("passkey required")
+	}
+	if code == "" {
+		return nil, errors.New("no TOTP provided")
 	}
-	// Generate JWT
-	token_string, err := a.generateJWTToken(username, user.Role, expires.Unix())
+	err := a.throttlingService.Check(throttling.TwoFactor, user.Username, client.IP)
 	if err != nil {
-		return nil, false, err
+		return nil, err
+	}
+	valid, err := a.VerifyTOTP(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		a.registerFailedAttempt(throttling.TwoFactor, user.Username, client)
+		return nil, errors.New("TOTP is not valid")
 	}
-	// Write token to database
-	token, err := a.AuthDbService.WriteTokenToDatabase(user.Id, token_string, token_type, expires)
+	a.throttlingService.RegisterSuccess(throttling.TwoFactor, user.Username)
+	// The pending token can only be used once
+	err = a.revokeToken(pending)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
-	return token, false, nil
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueLoginTokens(user, "", true, client)
 }
 
-func (a *AuthService) Logout(username, token string) error {
+func (a *AuthService) Logout(username string, token *tokenModel, actor audit.Actor) error {
 	// Check if user exists
 	user, error := a.AuthDbService.GetUserbyUsername(username)
 	if error != nil {
@@ -292,37 +375,38 @@ func (a *AuthService) Logout(username, token string) error {
 		// User is not active
 		return errors.New("User is not active")
 	}
-	// Delete token from database
-	err := a.AuthDbService.DeleteTokenByUserId(user.Id, token)
-	if err != nil {
-		return err
+	a.record(actor, audit.UserLogout, user.Id, nil, nil)
+	// Revoke the whole token family so the refresh token dies with the session
+	if token.FamilyId != "" {
+		return a.revokeTokenFamily(token.FamilyId)
 	}
-	return nil
+	return a.revokeToken(token)
 }
 
-func (a *AuthService) generateJWTToken(username, role string, expires int64) (string, error) {
-	// Create a new token object, specifying signing method and the claims
-	// you would like it to contain.
-	token := jwt.New(jwt.SigningMethodHS512)
-
-	// Set claims
-	claims := token.Claims.(jwt.MapClaims)
-	claims["username"] = username
-	claims["exp"] = expires
-	claims["role"] = role
-
-	// Sign and get the complete encoded token as a string using the secret
-	return token.SignedString([]byte(a.config.JWTSecret))
+func (a *AuthService) generateJWTToken(claims TokenClaims) (string, error) {
+	// Sign with the current key of the key manager, the kid header names the key
+	return a.keyManager.Sign(claims)
 }
 
-func HashPassword(password string) (string, error) {
-	// Generate a hashed representation of the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// ParseToken verifies the signature and the registered claims of a JWT
+func (a *AuthService) ParseToken(tokenString string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, a.keyManager.Keyfunc,
+		jwt.WithValidMethods(a.keyManager.Algorithms()),
+		jwt.WithIssuer(a.config.JWTIssuer),
+		jwt.WithAudience(a.config.JWTAudience),
+		jwt.WithExpirationRequired(),
+	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return string(hashedPassword), nil
+	if claims.ID == "" || claims.Subject == "" {
+		return nil, errors.New("token is missing required claims")
+	}
+	if a.revocationList.IsRevoked(claims) {
+		return nil, errors.New("token has been revoked")
+	}
+	return claims, nil
 }
 
 func generateRandomPassword(length int) (string, error) {
@@ -349,85 +433,116 @@ func (a *AuthService) GetTOTP(user *User) (*otp.Key, []string, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	backupCodes, err := a.GenerateBackupCodes(user)
+	backupCodes, hashedCodes, err := a.generateBackupCodes()
 	if err != nil {
 		return nil, nil, err
 	}
 	user.TotpSecret = key.Secret()
 	user.TotpActive = false
-	err = a.AuthDbService.UpdateUser(user)
+	user.BackupCodes = hashedCodes
+	err = a.AuthDbService.UpdateUserFields(user.Id, bson.M{"totpSecret": user.TotpSecret, "totpActive": false, "backupCodes": hashedCodes})
 	if err != nil {
 		return nil, nil, err
 	}
 	return key, backupCodes, nil
 }
 
-func (a *AuthService) GenerateBackupCodes(user *User) ([]string, error) {
+// GenerateTOTPQRCode renders the otpauth URL of the key as a base64 encoded PNG data URI
+func GenerateTOTPQRCode(key *otp.Key) (string, error) {
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (a *AuthService) GenerateBackupCodes(user *User, actor audit.Actor) ([]string, error) {
+	if !user.TotpActive {
+		return nil, errors.New("TOTP not activated")
+	}
+	codes, hashed_codes, err := a.generateBackupCodes()
+	if err != nil {
+		return nil, err
+	}
+	user.BackupCodes = hashed_codes
+	err = a.AuthDbService.UpdateUserFields(user.Id, bson.M{"backupCodes": hashed_codes})
+	if err != nil {
+		return nil, err
+	}
+	a.record(actor, audit.BackupCodesRegenerated, user.Id, nil, nil)
+	return codes, nil
+}
+
+// generateBackupCodes returns new backup codes and their hashes
+func (a *AuthService) generateBackupCodes() ([]string, []string, error) {
 	var codes []string
 	var hashed_codes []string
 	for i := 0; i < 8; i++ {
 		code, err := generateRandomPassword(8)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		codes = append(codes, code)
-		hashed_code, err := HashPassword(code)
+		hashed_code, err := a.hasher.Hash(code)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		hashed_codes = append(hashed_codes, hashed_code)
 	}
-	user.BackupCodes = hashed_codes
-	a.AuthDbService.UpdateUser(user)
-	return codes, nil
+	return codes, hashed_codes, nil
 }
 
 func (a *AuthService) checkBackupCodes(user *User, code string) bool {
-	for _, c := range user.BackupCodes {
-		err := bcrypt.CompareHashAndPassword([]byte(c), []byte(code))
+	for i, c := range user.BackupCodes {
+		err := a.hasher.Compare(c, code)
 		if err == nil {
-			// delete code from backup codes
-			var newCodes []string
-			for _, c := range user.BackupCodes {
-				hashed_code, err := HashPassword(code)
-				if err != nil {
-					return false
-				}
-				if c != hashed_code {
-					newCodes = append(newCodes, c)
-				}
-			}
-			user.BackupCodes = newCodes
-			authDbService := a.AuthDbService
-			authDbService.UpdateUser(user)
-			return true
+			// Backup codes can only be used once
+			user.BackupCodes = append(user.BackupCodes[:i:i], user.BackupCodes[i+1:]...)
+			err = a.AuthDbService.UpdateUserFields(user.Id, bson.M{"backupCodes": user.BackupCodes})
+			return err == nil
 		}
 	}
 	return false
 }
 
-func (a *AuthService) ActivateTOTP(user *User, otp string) error {
+func (a *AuthService) ActivateTOTP(user *User, otp string, actor audit.Actor) error {
+	if user.TotpActive {
+		return errors.New("TOTP already activated")
+	}
+	if user.TotpSecret == "" {
+		return errors.New("TOTP has not been set up")
+	}
 	valid := totp.Validate(otp, user.TotpSecret)
 	if valid {
 		user.TotpActive = true
-		err := a.AuthDbService.UpdateUser(user)
+		err := a.AuthDbService.UpdateUserFields(user.Id, bson.M{"totpActive": true})
 		if err != nil {
 			return err
 		}
-		a.AuthDbService.DeleteTokensByUserId(user.Username)
-		return nil
+		a.record(actor, audit.TOTPActivated, user.Id, nil, nil)
+		// Existing sessions have to log in again with the second factor
+		return a.revokeUserTokens(user.Id)
 	}
 	return errors.New("OTP is not valid")
 }
 
-func (a *AuthService) DeactivateTOTP(user *User) error {
+func (a *AuthService) DeactivateTOTP(user *User, actor audit.Actor) error {
+	if !user.TotpActive {
+		return errors.New("TOTP not activated")
+	}
 	user.TotpActive = false
 	user.BackupCodes = nil
 	user.TotpSecret = ""
-	err := a.AuthDbService.UpdateUser(user)
+	err := a.AuthDbService.UpdateUserFields(user.Id, bson.M{"totpActive": false, "backupCodes": nil, "totpSecret": nil})
 	if err != nil {
 		return err
 	}
+	a.record(actor, audit.TOTPDeactivated, user.Id, nil, nil)
 	return nil
 }
 
@@ -447,6 +562,10 @@ func (a *AuthService) VerifyTOTP(user *User, otp string) (bool, error) {
 		// User is not active
 		return false, errors.New("User is not active")
 	}
+	// An empty secret generates valid codes too
+	if user.TotpSecret == "" {
+		return false, nil
+	}
 	valid := totp.Validate(otp, user.TotpSecret)
 	if valid {
 		return true, nil
@@ -455,6 +574,11 @@ func (a *AuthService) VerifyTOTP(user *User, otp string) (bool, error) {
 	return valid, nil
 }
 
+// JWKS returns the public keys used to verify the issued tokens
+func (a *AuthService) JWKS() JWKS {
+	return a.keyManager.JWKS()
+}
+
 // Get All Users
 func (a *AuthService) GetAllUsers() ([]UserOutputAll, error) {
 	users, err := a.AuthDbService.GetAllUsers()
@@ -474,51 +598,108 @@ func (a *AuthService) GetUserByUsername(username string) (*User, error) {
 }
 
 // Update User
-func (a *AuthService) UpdateUser(userId, username, firstName, lastName, role, personnelnumber string, vacationDaysPerYear int, targetHoursPerWeek, maximumHoursPerWeek float32) error {
+func (a *AuthService) UpdateUser(userId, username, firstName, lastName, role, personnelnumber string, vacationDaysPerYear int, targetHoursPerWeek, maximumHoursPerWeek float32, actor audit.Actor) error {
 	user, err := a.AuthDbService.GetUserbyId(userId)
 	if err != nil {
 		return err
 	}
-	if username != "" {
+	if user.Type == ServiceAccountType {
+		return errors.New("service accounts are managed with the service account endpoints")
+	}
+	// Users with permissions the actor doesn't have could otherwise be taken over by changing their email
+	err = a.checkRoleCovered(user.Role, actor)
+	if err != nil {
+		return err
+	}
+	before := *user
+	// Only the changed fields are written, the loaded user may be outdated by then
+	fields := bson.M{}
+	if username != "" && username != user.Username {
+		existing, _ := a.AuthDbService.GetUserbyUsername(username)
+		// Only the letter case of the user's own address may change
+		if existing != nil && existing.Id != user.Id {
+			return errors.New("email address is already in use")
+		}
 		user.Username = username
+		fields["username"] = username
 	}
 	if firstName != "" {
 		user.FirstName = firstName
+		fields["firstName"] = firstName
 	}
 	if lastName != "" {
 		user.LastName = lastName
+		fields["lastName"] = lastName
 	}
-	if role != "" {
+	if role != "" && role != user.Role {
+		if !a.roleService.RoleExists(role) {
+			return errors.New("Role does not exist")
+		}
+		err = a.checkRoleCovered(role, actor)
+		if err != nil {
+			return err
+		}
 		user.Role = role
+		fields["role"] = role
 	}
 	if personnelnumber != "" {
 		user.Personnelnumber = personnelnumber
+		fields["personnelnumber"] = personnelnumber
 	}
 	if vacationDaysPerYear != 0 {
 		user.VacationDaysPerYear = vacationDaysPerYear
+		fields["vacationDaysPerYear"] = vacationDaysPerYear
 	}
 	if targetHoursPerWeek != 0 {
 		user.TargetHoursPerWeek = targetHoursPerWeek
+		fields["targetHoursPerWeek"] = targetHoursPerWeek
 	}
 	if maximumHoursPerWeek != 0 {
 		user.MaximumHoursPerWeek = maximumHoursPerWeek
+		fields["MaximumHoursPerWeek"] = maximumHoursPerWeek
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	err = a.AuthDbService.UpdateUserFields(user.Id, fields)
+	if errors.Is(err, ErrUsernameTaken) {
+		return errors.New("email address is already in use")
 	}
-	err = a.AuthDbService.UpdateUser(user)
 	if err != nil {
 		return err
 	}
+	a.record(actor, audit.UserUpdated, user.Id, before, *user)
 	return nil
 }
 
 // VerifyPassword
 func (a *AuthService) VerifyPassword(user *User, password string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	err := a.hasher.Compare(user.Password, password)
 	if err != nil {
 		return errors.New("username or Password incorrect")
 	}
+	a.rehashPassword(user, password)
 	return nil
 }
 
+// rehashPassword upgrades the stored hash of a verified password to the current algorithm and parameters
+func (a *AuthService) rehashPassword(user *User, password string) {
+	if !a.hasher.NeedsRehash(user.Password) {
+		return
+	}
+	hashedPassword, err := a.hasher.Hash(password)
+	if err != nil {
+		fmt.Println("Error rehashing password:", err)
+		return
+	}
+	err = a.AuthDbService.UpdatePasswordHash(user.Id, user.Password, hashedPassword)
+	if err != nil {
+		fmt.Println("Error rehashing password:", err)
+		return
+	}
+	user.Password = hashedPassword
+}
+
 // GetOwnUser
 func (a *AuthService) GetOwnUser(userId string) (*UserOutput, error) {
 	user, err := a.AuthDbService.GetOwnUser(userId)
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/roles"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// apiKeyPrefix starts every API key, so keys are recognizable in configs and by secret scanners.
+// A key is apiKeyPrefix + id + "_" + secret, only the id is stored in plain text.
+const apiKeyPrefix = "gak_"
+
+// IsAPIKey reports whether a bearer token is an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// CreateAPIKey creates an API key for the owner and returns it together with the key, which is only shown once.
+// The scopes have to be permissions the roles of the owner and of the actor grant.
+func (a *AuthService) CreateAPIKey(owner *User, createAPIKeyRequest CreateAPIKeyRequest, actor audit.Actor) (*APIKey, string, error) {
+	if len(createAPIKeyRequest.Scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range createAPIKeyRequest.Scopes {
+		if !slices.Contains(roles.Permissions, scope) {
+			return nil, "", errors.New("unknown scope " + scope)
+		}
+		if !a.roleService.HasPermission(owner.Role, scope) {
+			return nil, "", errors.New("the role of the user does not grant " + scope)
+		}
+	}
+	// Whoever creates the key knows its secret and could otherwise act with permissions of the owner
+	err := a.checkPermissionsHeld(createAPIKeyRequest.Scopes, actor)
+	if err != nil {
+		return nil, "", err
+	}
+	if !createAPIKeyRequest.ExpiresAt.IsZero() && createAPIKeyRequest.ExpiresAt.Before(time.Now()) {
+		return nil, "", errors.New("expiry has to be in the future")
+	}
+	idBytes := make([]byte, 6)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	key := apiKeyPrefix + id + "_" + secret
+	apiKey := APIKey{
+		Id:         id,
+		UserId:     owner.Id,
+		Name:       createAPIKeyRequest.Name,
+		KeyHash:    hashToken(key),
+		Scopes:     createAPIKeyRequest.Scopes,
+		ExpiresAt:  createAPIKeyRequest.ExpiresAt,
+		CreatedBy:  actor.UserId,
+		InsertedAt: time.Now(),
+	}
+	err = a.AuthDbService.CreateAPIKey(apiKey)
+	if err != nil {
+		return nil, "", err
+	}
+	a.auditService.Record(actor, audit.APIKeyCreated, "api_key", apiKey.Id, nil, apiKey)
+	return &apiKey, key, nil
+}
+
+// GetAPIKeys returns the API keys of a user
+func (a *AuthService) GetAPIKeys(userId string) ([]APIKey, error) {
+	return a.AuthDbService.GetAPIKeysByUserId(userId)
+}
+
+// RevokeAPIKey deletes an API key of a user, it stops working immediately
+func (a *AuthService) RevokeAPIKey(userId, apiKeyId string, actor audit.Actor) error {
+	apiKey, err := a.AuthDbService.GetAPIKeyById(apiKeyId)
+	if err != nil || apiKey.UserId != userId {
+		return errors.New("API key not found")
+	}
+	err = a.AuthDbService.DeleteAPIKey(userId, apiKeyId)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("API key not found")
+	}
+	if err != nil {
+		return err
+	}
+	a.auditService.Record(actor, audit.APIKeyRevoked, "api_key", apiKeyId, *apiKey, nil)
+	return nil
+}
+
+// AuthenticateAPIKey verifies an API key and returns it together with its active user
+func (a *AuthService) AuthenticateAPIKey(key string) (*APIKey, *User, error) {
+	id, _, found := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !IsAPIKey(key) || !found {
+		return nil, nil, errors.New("invalid API key")
+	}
+	apiKey, err := a.AuthDbService.GetAPIKeyById(id)
+	if err != nil {
+		return nil, nil, errors.New("invalid API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(apiKey.KeyHash)) != 1 {
+		return nil, nil, errors.New("invalid API key")
+	}
+	if !apiKey.ExpiresAt.IsZero() && apiKey.ExpiresAt.Before(time.Now()) {
+		return nil, nil, errors.New("API key has expired")
+	}
+	user, err := a.AuthDbService.GetCachedUserbyId(apiKey.UserId)
+	if err != nil {
+		return nil, nil, errors.New("invalid API key")
+	}
+	if user.State != ACTIVE {
+		return nil, nil, errors.New("User is not active")
+	}
+	a.touchAPIKey(apiKey.Id)
+	return apiKey, user, nil
+}
+
+// HasScope reports whether the API key may be used for the permission
+func (k *APIKey) HasScope(permission string) bool {
+	return slices.Contains(k.Scopes, permission)
+}
+
+// touchAPIKey updates the last used time of an API key in the background, at most once per interval
+func (a *AuthService) touchAPIKey(apiKeyId string) {
+	// API keys share the tracker of the sessions, their ids can't collide
+	if !a.sessionTracker.due(apiKeyPrefix + apiKeyId) {
+		return
+	}
+	go func() {
+		err := a.AuthDbService.UpdateAPIKeyUsage(apiKeyId, time.Now())
+		if err != nil {
+			fmt.Println("Error updating API key:", err)
+		}
+	}()
+}
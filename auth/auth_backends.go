@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrInvalidCredentials is returned by a CredentialBackend that doesn't accept the password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// CredentialBackend verifies passwords against a directory outside of the user collection.
+// Login tries the backends for unknown users and for users a backend authenticated before.
+// Local users are never checked against a backend, so a same-named directory account can't
+// take them over and they keep working while the directory is down.
+type CredentialBackend interface {
+	// Name is stored in User.AuthSource of the users the backend authenticated
+	Name() string
+	// Authenticate checks the password and returns the account of the user in the backend
+	Authenticate(username, password string) (*BackendAccount, error)
+	// ProvisionUsers reports whether unknown users are created on their first login
+	ProvisionUsers() bool
+}
+
+// BackendAccount is a user as known by a CredentialBackend
+type BackendAccount struct {
+	Username  string
+	FirstName string
+	LastName  string
+	// Email is never used to find a user, the directory can't vouch for local accounts
+	Email string
+	// Role is the role the backend mapped the user to, empty if the user gets none
+	Role string
+}
+
+// authenticateWithBackends checks the password with the credential backends and returns
+// the user it belongs to. user is nil if no user with the username exists yet.
+func (a *AuthService) authenticateWithBackends(username, password string, user *User, client ClientInfo) (*User, error) {
+	if password == "" || (user != nil && user.AuthSource == "") {
+		return nil, ErrInvalidCredentials
+	}
+	for _, backend := range a.credentialBackends {
+		// Users of one backend are never authenticated by another
+		if user != nil && user.AuthSource != backend.Name() {
+			continue
+		}
+		account, err := backend.Authenticate(username, password)
+		if err == ErrInvalidCredentials {
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error authenticating with "+backend.Name()+":", err)
+			continue
+		}
+		return a.syncBackendUser(backend, account, user, client)
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// syncBackendUser creates the user of a backend account or updates a user of the backend
+// with its data. Users are only matched by their login name.
+func (a *AuthService) syncBackendUser(backend CredentialBackend, account *BackendAccount, user *User, client ClientInfo) (*User, error) {
+	if account.Role == "" || !a.roleService.RoleExists(account.Role) {
+		return nil, errors.New("no role is assigned to the user")
+	}
+	username := account.Username
+	if user != nil && user.AuthSource != backend.Name() {
+		return nil, ErrInvalidCredentials
+	}
+	// A valid directory password doesn't lift a suspension or deletion
+	if user != nil && user.State != ACTIVE {
+		return nil, ErrInvalidCredentials
+	}
+	if user == nil {
+		if !backend.ProvisionUsers() {
+			return nil, ErrInvalidCredentials
+		}
+		timestamp := time.Now()
+		err := a.AuthDbService.CreateUser(User{
+			Username:   username,
+			FirstName:  account.FirstName,
+			LastName:   account.LastName,
+			Role:       account.Role,
+			State:      ACTIVE,
+			AuthSource: backend.Name(),
+			InsertedAt: timestamp,
+			UpdatedAt:  timestamp,
+		})
+		if err != nil {
+			return nil, errors.New("something went wrong creating the user")
+		}
+		createdUser, err := a.AuthDbService.GetUserbyUsername(username)
+		if err != nil {
+			return nil, err
+		}
+		a.record(actorFromClient(createdUser, client), audit.UserCreated, createdUser.Id, nil, *createdUser)
+		return createdUser, nil
+	}
+	// The directory owns role and names of its users
+	updated := *user
+	updated.Role = account.Role
+	if account.FirstName != "" {
+		updated.FirstName = account.FirstName
+	}
+	if account.LastName != "" {
+		updated.LastName = account.LastName
+	}
+	if updated.Role == user.Role && updated.FirstName == user.FirstName && updated.LastName == user.LastName {
+		return user, nil
+	}
+	updated.UpdatedAt = time.Now()
+	err := a.AuthDbService.UpdateUserFields(user.Id, bson.M{"role": updated.Role, "firstName": updated.FirstName, "lastName": updated.LastName})
+	if err != nil {
+		return nil, err
+	}
+	a.record(actorFromClient(user, client), audit.UserUpdated, user.Id, *user, updated)
+	if updated.Role != user.Role {
+		// Tokens carry the role, so the old ones have to go
+		err = a.revokeUserTokens(user.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &updated, nil
+}
+
+// loginWithBackendUser finishes the login of a user a credential backend authenticated
+func (a *AuthService) loginWithBackendUser(user *User, username string, client ClientInfo) (*tokenModel, error) {
+	a.throttlingService.RegisterSuccess(throttling.Login, username)
+	if user.TotpActive || a.hasPasskeys(user) {
+		return a.issueToken(user, TwoFactorToken, "", time.Now().Add(time.Minute*5), true, false)
+	}
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueLoginTokens(user, "", false, client)
+}
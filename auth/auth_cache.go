@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedUser struct {
+	user      User
+	fetchedAt time.Time
+}
+
+// userCache caches users by id for the AuthMiddleware. A ttl of 0 disables it.
+type userCache struct {
+	mu    sync.RWMutex
+	ttl   time.Duration
+	users map[string]cachedUser
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{ttl: ttl, users: map[string]cachedUser{}}
+}
+
+// get returns a copy of the cached user, so callers can modify it freely
+func (u *userCache) get(id string) (*User, bool) {
+	if u.ttl <= 0 {
+		return nil, false
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	cached, exists := u.users[id]
+	if !exists || time.Since(cached.fetchedAt) > u.ttl {
+		return nil, false
+	}
+	user := cached.user
+	return &user, true
+}
+
+func (u *userCache) set(user *User) {
+	if u.ttl <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.users[user.Id] = cachedUser{user: *user, fetchedAt: time.Now()}
+}
+
+func (u *userCache) invalidate(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.users, id)
+}
@@ -1,8 +1,13 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
 	"github.com/gin-gonic/gin"
 )
 
@@ -15,6 +20,28 @@ func NewAuthController(authService *AuthService) *AuthController {
 	return &AuthController{authService: authService}
 }
 
+// abortIfPolicyViolated answers with the violated rules if the error is a PasswordPolicyError
+func abortIfPolicyViolated(c *gin.Context, err error) bool {
+	var policyError *PasswordPolicyError
+	if !errors.As(err, &policyError) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "violations": policyError.Violations})
+	return true
+}
+
+// abortIfThrottled answers with 429 and a Retry-After header if the error is a ThrottledError
+func abortIfThrottled(c *gin.Context, err error) bool {
+	var throttled *throttling.ThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	retryAfter := int(time.Until(throttled.RetryAfter).Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "locked": throttled.Locked, "retry_after": throttled.RetryAfter})
+	return true
+}
+
 // Login handles user login and issues a JWT
 func (ac *AuthController) Login(c *gin.Context) {
 	var loginRequest LoginRequest
@@ -22,38 +49,40 @@ func (ac *AuthController) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	header := c.GetHeader("TOTP")
-	login, requires2FA, error := ac.authService.Login(loginRequest.Username, loginRequest.Password, header)
-	if requires2FA {
-		c.JSON(http.StatusOK, gin.H{"message": "Credentials correct", "requires_2fa": true})
+	login, error := ac.authService.Login(loginRequest.Username, loginRequest.Password, ClientInfoFromContext(c))
+	if abortIfThrottled(c, error) {
 		return
 	}
 	if error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": error.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType})
+	if login.Requires2FA {
+		c.JSON(http.StatusOK, gin.H{"message": "Credentials correct", "requires_2fa": true, "token": login.Token, "token_type": login.TokenType})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
 }
 
-// CreateUser handles user creation
-func (ac *AuthController) CreateUser(c *gin.Context) {
-	var createUserRequest CreateUserRequest
-	if err := c.ShouldBindJSON(&createUserRequest); err != nil {
+// Refresh rotates a refresh token and issues a new access token
+func (ac *AuthController) Refresh(c *gin.Context) {
+	var refreshTokenRequest RefreshTokenRequest
+	if err := c.ShouldBindJSON(&refreshTokenRequest); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err := ac.authService.CreateUser(createUserRequest)
+	login, err := ac.authService.Refresh(refreshTokenRequest.RefreshToken, ClientInfoFromContext(c))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{"message": "User created successfully"})
+	c.JSON(http.StatusOK, gin.H{"token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
 }
 
-// Activates User
-func (ac *AuthController) ActivateUser(c *gin.Context) {
-	var activeUserRequest ActivateUserRequest
-	if err := c.ShouldBindJSON(&activeUserRequest); err != nil {
+// VerifyTwoFactor exchanges a pending 2FA token and a TOTP or backup code for a LoginToken
+func (ac *AuthController) VerifyTwoFactor(c *gin.Context) {
+	var verifyTwoFactorRequest VerifyTwoFactorRequest
+	if err := c.ShouldBindJSON(&verifyTwoFactorRequest); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -67,29 +96,190 @@ func (ac *AuthController) ActivateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	err := ac.authService.ActivateUser(user, activeUserRequest.NewPassword)
+	token_unasserted, exists := c.Get("token")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	token, ok := token_unasserted.(*tokenModel)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	login, err := ac.authService.CompleteTwoFactorLogin(user, token, verifyTwoFactorRequest.TOTP, ClientInfoFromContext(c))
+	if abortIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
+}
+
+// CreateUser handles user creation
+func (ac *AuthController) CreateUser(c *gin.Context) {
+	var createUserRequest CreateUserRequest
+	if err := c.ShouldBindJSON(&createUserRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.CreateUser(createUserRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "User created successfully"})
+}
+
+// ImportUsers creates the users of an uploaded CSV or XLSX file, with dryRun=true it only validates them
+func (ac *AuthController) ImportUsers(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file not provided"})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+	rows, err := ReadImportFile(fileHeader.Filename, file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := ac.authService.ImportUsers(rows, c.Query("dryRun") == "true", audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if report.Failed > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "some rows are invalid, no user was created", "report": report})
+		return
+	}
+	if report.DryRun {
+		c.JSON(http.StatusOK, gin.H{"message": "All rows are valid", "report": report})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Users imported successfully", "report": report})
+}
+
+// GetInvitations returns the invitations that weren't accepted yet
+func (ac *AuthController) GetInvitations(c *gin.Context) {
+	invitations, err := ac.authService.GetOpenInvitations()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// ResendInvitation emails a new invitation link
+func (ac *AuthController) ResendInvitation(c *gin.Context) {
+	err := ac.authService.ResendInvitation(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation sent"})
+}
+
+// InviteUserAgain sends a new invitation to a new user, also once the old one was removed
+func (ac *AuthController) InviteUserAgain(c *gin.Context) {
+	err := ac.authService.InviteUserAgain(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation sent"})
+}
+
+// RevokeInvitation makes the link of an invitation unusable
+func (ac *AuthController) RevokeInvitation(c *gin.Context) {
+	err := ac.authService.RevokeInvitation(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// OpenInvitation is called when the invitation link is opened and returns who was invited
+func (ac *AuthController) OpenInvitation(c *gin.Context) {
+	var openInvitationRequest OpenInvitationRequest
+	if err := c.ShouldBindJSON(&openInvitationRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	invitation, err := ac.authService.OpenInvitation(openInvitationRequest.Token)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": invitation.Username, "expires": invitation.Expires})
+}
 
+// AcceptInvitation sets the first password of an invited user
+func (ac *AuthController) AcceptInvitation(c *gin.Context) {
+	var acceptInvitationRequest AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&acceptInvitationRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.AcceptInvitation(acceptInvitationRequest.Token, acceptInvitationRequest.NewPassword, ClientInfoFromContext(c))
+	if abortIfPolicyViolated(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 	c.JSON(http.StatusCreated, gin.H{"message": "User activated successfully"})
 }
 
-// Reset Password
+// ConfirmEmailChange changes the email with the link sent to the new address
+func (ac *AuthController) ConfirmEmailChange(c *gin.Context) {
+	var emailChangeTokenRequest EmailChangeTokenRequest
+	if err := c.ShouldBindJSON(&emailChangeTokenRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.ConfirmEmailChange(emailChangeTokenRequest.Token, ClientInfoFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed successfully"})
+}
+
+// CancelEmailChange drops a pending email change with the link sent to the old address
+func (ac *AuthController) CancelEmailChange(c *gin.Context) {
+	var emailChangeTokenRequest EmailChangeTokenRequest
+	if err := c.ShouldBindJSON(&emailChangeTokenRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.CancelEmailChange(emailChangeTokenRequest.Token, ClientInfoFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email change cancelled"})
+}
+
+// Reset Password sets a new password with the token of an emailed reset link
 func (ac *AuthController) ResetPassword(c *gin.Context) {
 	var resetPasswordRequest ResetPasswordRequest
-	user_unasserted, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+	if err := c.ShouldBindJSON(&resetPasswordRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	user, err := user_unasserted.(User)
-	if !err {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+	error := ac.authService.ResetPassword(resetPasswordRequest.Token, resetPasswordRequest.NewPassword, ClientInfoFromContext(c))
+	if abortIfPolicyViolated(c, error) {
 		return
 	}
-	error := ac.authService.ResetPassword(&user, resetPasswordRequest.NewPassword)
 	if error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": error.Error()})
 		return
@@ -115,7 +305,10 @@ func (ac *AuthController) ChangePassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	error := ac.authService.ChangePassword(user.Username, changePasswordRequest.NewPassword)
+	error := ac.authService.ChangePassword(user.Username, changePasswordRequest.NewPassword, audit.ActorFromContext(c))
+	if abortIfPolicyViolated(c, error) {
+		return
+	}
 	if error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": error.Error()})
 		return
@@ -131,13 +324,53 @@ func (ac *AuthController) ForgotPassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	error := ac.authService.ForgotPassword(forgotPasswordRequest.Username)
+	error := ac.authService.ForgotPassword(forgotPasswordRequest.Username, ClientInfoFromContext(c))
+	if abortIfThrottled(c, error) {
+		return
+	}
 	if error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": error.Error()})
 		return
 
 	}
-	c.JSON(http.StatusCreated, gin.H{"message": "Reset password email sent successfully"})
+	c.JSON(http.StatusCreated, gin.H{"message": "If the account exists, a reset link was sent"})
+}
+
+// RequestMagicLink emails a login link, the response doesn't reveal whether the user exists
+func (ac *AuthController) RequestMagicLink(c *gin.Context) {
+	var magicLinkRequest MagicLinkRequest
+	if err := c.ShouldBindJSON(&magicLinkRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.RequestMagicLink(magicLinkRequest.Username, ClientInfoFromContext(c))
+	if abortIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "If the account can log in with a link, an email was sent"})
+}
+
+// VerifyMagicLink exchanges the token of a magic link for a login
+func (ac *AuthController) VerifyMagicLink(c *gin.Context) {
+	var verifyRequest VerifyMagicLinkRequest
+	if err := c.ShouldBindJSON(&verifyRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	login, err := ac.authService.VerifyMagicLink(verifyRequest.Token, ClientInfoFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if login.Requires2FA {
+		c.JSON(http.StatusOK, gin.H{"message": "Link correct", "requires_2fa": true, "token": login.Token, "token_type": login.TokenType})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
 }
 
 // Logout handles user logout
@@ -147,7 +380,7 @@ func (ac *AuthController) Logout(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	user, err := user_unasserted.(User)
+	user, err := user_unasserted.(*User)
 	if !err {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
@@ -162,7 +395,7 @@ func (ac *AuthController) Logout(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
 		return
 	}
-	error := ac.authService.Logout(user.Username, token.Token)
+	error := ac.authService.Logout(user.Username, token, audit.ActorFromContext(c))
 	if error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": error.Error()})
 		return
@@ -177,12 +410,12 @@ func (ac *AuthController) DeleteOwnUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	user, err := user_unasserted.(User)
+	user, err := user_unasserted.(*User)
 	if !err {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	error := ac.authService.DeleteOwnUser(user.Username)
+	error := ac.authService.DeleteOwnUser(user.Id, audit.ActorFromContext(c))
 	if error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": error.Error()})
 		return
@@ -197,7 +430,7 @@ func (ac *AuthController) DeleteOtherUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err := ac.authService.DeleteOtherUser(deleteUserRequest.UserId)
+	err := ac.authService.DeleteOtherUser(deleteUserRequest.UserId, deleteUserRequest.Reason, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -205,6 +438,111 @@ func (ac *AuthController) DeleteOtherUser(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
 
+// Impersonate issues a token to act as another user for support
+func (ac *AuthController) Impersonate(c *gin.Context) {
+	var impersonateRequest ImpersonateRequest
+	if err := c.ShouldBindJSON(&impersonateRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	token, err := ac.authService.Impersonate(user, impersonateRequest.UserId, impersonateRequest.Reason, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Impersonation started", "token": token.Token, "token_type": token.TokenType, "expires": token.Expires})
+}
+
+// EndImpersonation revokes the impersonation token of the request
+func (ac *AuthController) EndImpersonation(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	token_unasserted, exists := c.Get("token")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	token, ok := token_unasserted.(*tokenModel)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	err := ac.authService.EndImpersonation(token, user, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Impersonation ended"})
+}
+
+// SuspendUser locks a user out until the user is restored
+func (ac *AuthController) SuspendUser(c *gin.Context) {
+	var userStateRequest UserStateRequest
+	if err := c.ShouldBindJSON(&userStateRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.SuspendUser(c.Param("id"), userStateRequest.Reason, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User suspended"})
+}
+
+// DisableUser deactivates a user
+func (ac *AuthController) DisableUser(c *gin.Context) {
+	var userStateRequest UserStateRequest
+	if err := c.ShouldBindJSON(&userStateRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := ac.authService.DisableUser(c.Param("id"), userStateRequest.Reason, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled"})
+}
+
+// RestoreUser reactivates a suspended, disabled or deleted user
+func (ac *AuthController) RestoreUser(c *gin.Context) {
+	err := ac.authService.RestoreUser(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User restored"})
+}
+
+// GetDeletedUsers returns the deleted users that can still be restored
+func (ac *AuthController) GetDeletedUsers(c *gin.Context) {
+	users, err := ac.authService.GetDeletedUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
 // GetTOTP
 func (ac *AuthController) GetTOTP(c *gin.Context) {
 	user_unasserted, exists := c.Get("user")
@@ -226,7 +564,12 @@ func (ac *AuthController) GetTOTP(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"otp_secret": otp.Secret(), "otp_url": otp.URL(), "backup_codes": backupCodes})
+	qrCode, err := GenerateTOTPQRCode(otp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"otp_secret": otp.Secret(), "otp_url": otp.URL(), "otp_qr_code": qrCode, "backup_codes": backupCodes})
 }
 
 // ActivateTOTP
@@ -246,7 +589,7 @@ func (ac *AuthController) ActivateTOTP(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	err := ac.authService.ActivateTOTP(user, activateTOTPRequest.TOTP)
+	err := ac.authService.ActivateTOTP(user, activateTOTPRequest.TOTP, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -266,7 +609,7 @@ func (ac *AuthController) DeactivateTOTP(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	err := ac.authService.DeactivateTOTP(user)
+	err := ac.authService.DeactivateTOTP(user, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -286,7 +629,7 @@ func (ac *AuthController) RegenerateBackupCodes(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	backupCodes, err := ac.authService.GenerateBackupCodes(user)
+	backupCodes, err := ac.authService.GenerateBackupCodes(user, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -341,11 +684,34 @@ func (ac *AuthController) UpdateOwnUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
 		return
 	}
-	err := ac.authService.UpdateUser(user.Id, updateOwnUserRequest.Username, updateOwnUserRequest.FirstName, updateOwnUserRequest.LastName, "", "", 0, 0, 0)
+	changesEmail := updateOwnUserRequest.Username != "" && updateOwnUserRequest.Username != user.Username
+	// Whoever controls the address controls the account, a stolen session alone mustn't be enough
+	if changesEmail {
+		claims_unasserted, exists := c.Get("claims")
+		claims, ok := claims_unasserted.(*TokenClaims)
+		if !exists || !ok || !ac.authService.RecentlyAuthenticated(claims.FamilyId) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication required", "reauthentication_required": true})
+			return
+		}
+	}
+	// The email only changes once the new address is confirmed
+	err := ac.authService.UpdateUser(user.Id, "", updateOwnUserRequest.FirstName, updateOwnUserRequest.LastName, "", "", 0, 0, 0, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if changesEmail {
+		err = ac.authService.RequestEmailChange(user, updateOwnUserRequest.Username, audit.ActorFromContext(c))
+		if err != nil {
+			if abortIfThrottled(c, err) {
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "User updated successfully, a confirmation link was sent to the new email address"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
 }
 
@@ -356,10 +722,622 @@ func (ac *AuthController) UpdateOtherUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err := ac.authService.UpdateUser(updateOtherUserRequest.Id, updateOtherUserRequest.Username, updateOtherUserRequest.FirstName, updateOtherUserRequest.LastName, updateOtherUserRequest.Role, updateOtherUserRequest.Personnelnumber, updateOtherUserRequest.VacationDaysPerYear, updateOtherUserRequest.TargetHoursPerWeek, updateOtherUserRequest.MaximumHoursPerWeek)
+	err := ac.authService.UpdateUser(updateOtherUserRequest.Id, updateOtherUserRequest.Username, updateOtherUserRequest.FirstName, updateOtherUserRequest.LastName, updateOtherUserRequest.Role, updateOtherUserRequest.Personnelnumber, updateOtherUserRequest.VacationDaysPerYear, updateOtherUserRequest.TargetHoursPerWeek, updateOtherUserRequest.MaximumHoursPerWeek, audit.ActorFromContext(c))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
 }
+
+// JWKS publishes the public signing keys
+func (ac *AuthController) JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, ac.authService.JWKS())
+}
+
+// GetSessions lists the sessions of the logged in user
+func (ac *AuthController) GetSessions(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	token_unasserted, exists := c.Get("token")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	token, ok := token_unasserted.(*tokenModel)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	sessions, err := ac.authService.GetSessions(user.Id, token.FamilyId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession revokes a session of the logged in user
+func (ac *AuthController) RevokeSession(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	err := ac.authService.RevokeSession(user.Id, c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// GetUserSessions lists the sessions of another user
+func (ac *AuthController) GetUserSessions(c *gin.Context) {
+	sessions, err := ac.authService.GetSessions(c.Param("id"), "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeUserSession revokes a session of another user
+func (ac *AuthController) RevokeUserSession(c *gin.Context) {
+	err := ac.authService.RevokeSession(c.Param("id"), c.Param("sessionId"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeAllUserSessions revokes all sessions of another user
+func (ac *AuthController) RevokeAllUserSessions(c *gin.Context) {
+	err := ac.authService.RevokeAllSessions(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Sessions revoked"})
+}
+
+// GetPasswordPolicy returns the rules new passwords have to satisfy
+func (ac *AuthController) GetPasswordPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"policy": ac.authService.passwordPolicy.Rules()})
+}
+
+// BeginWebAuthnRegistration returns the options to create a new passkey
+func (ac *AuthController) BeginWebAuthnRegistration(c *gin.Context) {
+	var beginRequest BeginWebAuthnRegistrationRequest
+	if err := c.ShouldBindJSON(&beginRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	challengeId, options, err := ac.authService.BeginWebAuthnRegistration(user, beginRequest.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"challenge": challengeId, "options": options})
+}
+
+// FinishWebAuthnRegistration stores the passkey created by the authenticator.
+// The body is the credential returned by navigator.credentials.create.
+func (ac *AuthController) FinishWebAuthnRegistration(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	credential, err := ac.authService.FinishWebAuthnRegistration(user, c.Query("challenge"), c.Request.Body, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Passkey registered successfully", "passkey": credential})
+}
+
+// BeginWebAuthnLogin returns the options for a passwordless login with a passkey
+func (ac *AuthController) BeginWebAuthnLogin(c *gin.Context) {
+	var beginRequest BeginWebAuthnLoginRequest
+	if err := c.ShouldBindJSON(&beginRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	challengeId, options, err := ac.authService.BeginWebAuthnLogin(beginRequest.Username)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"challenge": challengeId, "options": options})
+}
+
+// FinishWebAuthnLogin verifies the assertion of a passkey and issues a LoginToken.
+// The body is the credential returned by navigator.credentials.get.
+func (ac *AuthController) FinishWebAuthnLogin(c *gin.Context) {
+	login, err := ac.authService.FinishWebAuthnLogin(c.Query("challenge"), c.Request.Body, ClientInfoFromContext(c))
+	if abortIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
+}
+
+// Reauthenticate confirms the credentials of the logged in user for sensitive routes
+func (ac *AuthController) Reauthenticate(c *gin.Context) {
+	var reauthenticateRequest ReauthenticateRequest
+	if err := c.ShouldBindJSON(&reauthenticateRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	claims_unasserted, exists := c.Get("claims")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	claims, ok := claims_unasserted.(*TokenClaims)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	until, err := ac.authService.Reauthenticate(user, claims.FamilyId, reauthenticateRequest, ClientInfoFromContext(c))
+	if abortIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Re-authentication successful", "reauthenticated_until": until})
+}
+
+// BeginWebAuthnTwoFactor returns the options to confirm a pending login or a re-authentication with a passkey
+func (ac *AuthController) BeginWebAuthnTwoFactor(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	challengeId, options, err := ac.authService.BeginWebAuthnTwoFactor(user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"challenge": challengeId, "options": options})
+}
+
+// FinishWebAuthnTwoFactor exchanges a pending 2FA token and a passkey assertion for a LoginToken
+func (ac *AuthController) FinishWebAuthnTwoFactor(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	token_unasserted, exists := c.Get("token")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	token, ok := token_unasserted.(*tokenModel)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token not found"})
+		return
+	}
+	login, err := ac.authService.FinishWebAuthnTwoFactor(user, token, c.Query("challenge"), c.Request.Body, ClientInfoFromContext(c))
+	if abortIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
+}
+
+// GetPasskeys lists the passkeys of the logged in user
+func (ac *AuthController) GetPasskeys(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	passkeys, err := ac.authService.GetWebAuthnCredentials(user.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"passkeys": passkeys})
+}
+
+// DeletePasskey removes a passkey of the logged in user
+func (ac *AuthController) DeletePasskey(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	err := ac.authService.DeleteWebAuthnCredential(user.Id, c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Passkey removed"})
+}
+
+// GetExternalProviders lists the identity providers users can log in with
+func (ac *AuthController) GetExternalProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": ac.authService.GetExternalProviders()})
+}
+
+// BeginExternalLogin sends the browser to the identity provider
+func (ac *AuthController) BeginExternalLogin(c *gin.Context) {
+	redirectURL, err := ac.authService.BeginExternalLogin(c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// FinishExternalLogin exchanges the code the identity provider returned to the frontend for a LoginToken
+func (ac *AuthController) FinishExternalLogin(c *gin.Context) {
+	var callbackRequest ExternalCallbackRequest
+	if err := c.ShouldBindJSON(&callbackRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	login, err := ac.authService.FinishExternalLogin(c.Param("provider"), callbackRequest, ClientInfoFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if login.Requires2FA {
+		c.JSON(http.StatusOK, gin.H{"message": "Credentials correct", "requires_2fa": true, "token": login.Token, "token_type": login.TokenType})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Login successful", "token": login.Token, "token_type": login.TokenType, "refresh_token": login.RefreshToken, "expires": login.Expires})
+}
+
+// BeginExternalLink returns the URL of the identity provider to link an account to the logged in user
+func (ac *AuthController) BeginExternalLink(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	redirectURL, err := ac.authService.BeginExternalLink(user, c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect_url": redirectURL})
+}
+
+// FinishExternalLink links the account the identity provider returned to the logged in user
+func (ac *AuthController) FinishExternalLink(c *gin.Context) {
+	var callbackRequest ExternalCallbackRequest
+	if err := c.ShouldBindJSON(&callbackRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	identity, err := ac.authService.FinishExternalLink(user, c.Param("provider"), callbackRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "External identity linked", "identity": identity})
+}
+
+// GetExternalIdentities lists the external accounts linked to the logged in user
+func (ac *AuthController) GetExternalIdentities(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	identities, err := ac.authService.GetExternalIdentities(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+// UnlinkExternalIdentity removes an external account of the logged in user
+func (ac *AuthController) UnlinkExternalIdentity(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	err := ac.authService.UnlinkExternalIdentity(user, c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "External identity unlinked"})
+}
+
+// GetAPIKeys lists the API keys of the logged in user
+func (ac *AuthController) GetAPIKeys(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	apiKeys, err := ac.authService.GetAPIKeys(user.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKeys": apiKeys})
+}
+
+// CreateAPIKey creates an API key for the logged in user, the key is only returned here
+func (ac *AuthController) CreateAPIKey(c *gin.Context) {
+	var createAPIKeyRequest CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&createAPIKeyRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	apiKey, key, err := ac.authService.CreateAPIKey(user, createAPIKeyRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "API key created", "apiKey": apiKey, "key": key})
+}
+
+// RevokeAPIKey deletes an API key of the logged in user
+func (ac *AuthController) RevokeAPIKey(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	err := ac.authService.RevokeAPIKey(user.Id, c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// GetUserAPIKeys lists the API keys of another user
+func (ac *AuthController) GetUserAPIKeys(c *gin.Context) {
+	apiKeys, err := ac.authService.GetAPIKeys(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKeys": apiKeys})
+}
+
+// CreateUserAPIKey creates an API key for another user, e.g. for an integration account
+func (ac *AuthController) CreateUserAPIKey(c *gin.Context) {
+	var createAPIKeyRequest CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&createAPIKeyRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	owner, err := ac.authService.AuthDbService.GetUserbyId(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	apiKey, key, err := ac.authService.CreateAPIKey(owner, createAPIKeyRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "API key created", "apiKey": apiKey, "key": key})
+}
+
+// RevokeUserAPIKey deletes an API key of another user
+func (ac *AuthController) RevokeUserAPIKey(c *gin.Context) {
+	err := ac.authService.RevokeAPIKey(c.Param("id"), c.Param("keyId"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// GetServiceAccounts lists all service accounts
+func (ac *AuthController) GetServiceAccounts(c *gin.Context) {
+	serviceAccounts, err := ac.authService.GetServiceAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"serviceAccounts": serviceAccounts})
+}
+
+// CreateServiceAccount creates a service account, the client secret is only returned here
+func (ac *AuthController) CreateServiceAccount(c *gin.Context) {
+	var createServiceAccountRequest CreateServiceAccountRequest
+	if err := c.ShouldBindJSON(&createServiceAccountRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	serviceAccount, secret, err := ac.authService.CreateServiceAccount(createServiceAccountRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Service account created", "serviceAccount": serviceAccount, "client_id": serviceAccount.Id, "client_secret": secret})
+}
+
+// DisableServiceAccount disables a service account and revokes its tokens
+func (ac *AuthController) DisableServiceAccount(c *gin.Context) {
+	err := ac.authService.SetServiceAccountEnabled(c.Param("id"), false, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Service account disabled"})
+}
+
+// EnableServiceAccount enables a disabled service account
+func (ac *AuthController) EnableServiceAccount(c *gin.Context) {
+	err := ac.authService.SetServiceAccountEnabled(c.Param("id"), true, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Service account enabled"})
+}
+
+// RotateServiceAccountSecret replaces the client secret of a service account
+func (ac *AuthController) RotateServiceAccountSecret(c *gin.Context) {
+	secret, err := ac.authService.RotateServiceAccountSecret(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Client secret rotated", "client_id": c.Param("id"), "client_secret": secret})
+}
+
+// DeleteServiceAccount deletes a service account
+func (ac *AuthController) DeleteServiceAccount(c *gin.Context) {
+	err := ac.authService.DeleteServiceAccount(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Service account deleted"})
+}
+
+// Token issues a ServiceToken with the client credentials grant, errors follow RFC 6749
+func (ac *AuthController) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	var clientCredentialsRequest ClientCredentialsRequest
+	if err := c.ShouldBind(&clientCredentialsRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	if clientCredentialsRequest.GrantType != "client_credentials" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type", "error_description": "only the client_credentials grant is supported"})
+		return
+	}
+	if clientId, clientSecret, ok := c.Request.BasicAuth(); ok {
+		clientCredentialsRequest.ClientId = clientId
+		clientCredentialsRequest.ClientSecret = clientSecret
+	}
+	token, err := ac.authService.ClientCredentials(clientCredentialsRequest.ClientId, clientCredentialsRequest.ClientSecret, ClientInfoFromContext(c))
+	if abortIfThrottled(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client", "error_description": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"access_token": token.Token, "token_type": "Bearer", "expires_in": int(time.Until(token.Expires).Seconds())})
+}
@@ -2,32 +2,81 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/R3PTR/go-auth-api/database"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type AuthDbService struct {
 	mongoClient *database.MongoDBClient
+	userCache   *userCache
 }
 
 func NewAuthDbService(mongoClient *database.MongoDBClient) *AuthDbService {
-	return &AuthDbService{mongoClient: mongoClient}
+	userCache := newUserCache(time.Second * time.Duration(mongoClient.Config.UserCacheSeconds))
+	return &AuthDbService{mongoClient: mongoClient, userCache: userCache}
+}
+
+// ErrUsernameTaken is returned when a write would give two users the same username
+var ErrUsernameTaken = errors.New("User already exists")
+
+// usernameError maps a violation of the unique username index to ErrUsernameTaken
+func usernameError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUsernameTaken
+	}
+	return err
 }
 
 // Create User
 func (a *AuthDbService) CreateUser(user User) error {
 	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).InsertOne(context.Background(), user)
-	return err
+	return usernameError(err)
+}
+
+// CreateUsers inserts the users in one batch and returns their ids in the same order.
+// If one insert fails, the users inserted before it are removed again.
+func (a *AuthDbService) CreateUsers(users []User) ([]string, error) {
+	documents := make([]interface{}, len(users))
+	for i, user := range users {
+		documents[i] = user
+	}
+	collection := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection)
+	result, err := collection.InsertMany(context.Background(), documents)
+	if err != nil {
+		// The result holds the ids of all documents, inserted or not
+		if result != nil && len(result.InsertedIDs) > 0 {
+			_, deleteErr := collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": result.InsertedIDs}})
+			if deleteErr != nil {
+				log.Println("Error removing partially imported users:", deleteErr)
+			}
+		}
+		return nil, usernameError(err)
+	}
+	ids := make([]string, len(result.InsertedIDs))
+	for i, id := range result.InsertedIDs {
+		ids[i] = id.(primitive.ObjectID).Hex()
+	}
+	return ids, nil
 }
 
+// usernameCollation compares usernames without letter case, like email providers do.
+// Lookups use it too, so they are served by the unique username index.
+var usernameCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// GetUserbyUsername returns the user with the username in any letter case
 func (a *AuthDbService) GetUserbyUsername(username string) (*User, error) {
 	user := &User{}
-	err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).FindOne(context.Background(), bson.M{"username": username}).Decode(user)
+	findOptions := options.FindOne().SetCollation(usernameCollation)
+	err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).FindOne(context.Background(), bson.M{"username": username}, findOptions).Decode(user)
 	if err != nil {
 		// Handle errors, e.g., user not found
 		fmt.Println("Error:", err)
@@ -52,6 +101,25 @@ func (a *AuthDbService) GetUserbyId(id string) (*User, error) {
 	return user, nil
 }
 
+// Get User by Id, served from the user cache if it is enabled
+func (a *AuthDbService) GetCachedUserbyId(id string) (*User, error) {
+	user, ok := a.userCache.get(id)
+	if ok {
+		return user, nil
+	}
+	user, err := a.GetUserbyId(id)
+	if err != nil {
+		return nil, err
+	}
+	a.userCache.set(user)
+	return user, nil
+}
+
+// Remove a user from the user cache after it was changed
+func (a *AuthDbService) InvalidateCachedUser(id string) {
+	a.userCache.invalidate(id)
+}
+
 func (a *AuthDbService) GetTokenByToken(token string) (*tokenModel, error) {
 	token_model := &tokenModel{}
 	err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).FindOne(context.Background(), bson.M{"token": token}).Decode(token_model)
@@ -62,14 +130,17 @@ func (a *AuthDbService) GetTokenByToken(token string) (*tokenModel, error) {
 	return token_model, nil
 }
 
-func (a *AuthDbService) WriteTokenToDatabase(userId, token, tokenType string, expires time.Time) (*tokenModel, error) {
+func (a *AuthDbService) WriteTokenToDatabase(userId, token, tokenType, familyId string, expires time.Time, requires2FA, twoFAConfirmed bool) (*tokenModel, error) {
 	token_struct := tokenModel{
-		UserId:     userId,
-		Token:      token,
-		TokenType:  tokenType,
-		InsertedAt: time.Now(),
-		UpdatedAt:  time.Now(),
-		Expires:    expires,
+		UserId:         userId,
+		Token:          token,
+		Requires2FA:    requires2FA,
+		TwoFAConfirmed: twoFAConfirmed,
+		TokenType:      tokenType,
+		FamilyId:       familyId,
+		InsertedAt:     time.Now(),
+		UpdatedAt:      time.Now(),
+		Expires:        expires,
 	}
 	insertResult, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).InsertOne(context.Background(), token_struct)
 	if err != nil {
@@ -79,6 +150,27 @@ func (a *AuthDbService) WriteTokenToDatabase(userId, token, tokenType string, ex
 	return &token_struct, nil
 }
 
+// UseRefreshToken marks an unused refresh token as used and returns it
+func (a *AuthDbService) UseRefreshToken(tokenHash string) (*tokenModel, error) {
+	token_model := &tokenModel{}
+	filter := bson.M{"token": tokenHash, "tokenType": RefreshToken, "used": bson.M{"$ne": true}}
+	update := bson.M{"$set": bson.M{"used": true, "updatedAt": time.Now()}}
+	err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).FindOneAndUpdate(context.Background(), filter, update).Decode(token_model)
+	if err != nil {
+		return nil, err
+	}
+	return token_model, nil
+}
+
+// Delete all tokens of a token family
+func (a *AuthDbService) DeleteTokensByFamilyId(familyId string) error {
+	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).DeleteMany(context.Background(), bson.M{"familyId": familyId})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // Delete all tokens for a user
 func (a *AuthDbService) DeleteTokensByUserId(userId string) error {
 	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).DeleteMany(context.Background(), bson.M{"user_id": userId})
@@ -88,15 +180,610 @@ func (a *AuthDbService) DeleteTokensByUserId(userId string) error {
 	return nil
 }
 
-// Delete all tokens for a user
+// UseToken deletes a token of the type and returns it, so single-use tokens work only once
+func (a *AuthDbService) UseToken(token, tokenType string) (*tokenModel, error) {
+	token_model := &tokenModel{}
+	filter := bson.M{"token": token, "tokenType": tokenType, "expires": bson.M{"$gt": time.Now()}}
+	err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).FindOneAndDelete(context.Background(), filter).Decode(token_model)
+	if err != nil {
+		return nil, err
+	}
+	return token_model, nil
+}
+
+// Delete a single token
+func (a *AuthDbService) DeleteToken(token string) error {
+	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).DeleteOne(context.Background(), bson.M{"token": token})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete a single token of a user
 func (a *AuthDbService) DeleteTokenByUserId(userId, token string) error {
-	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).DeleteOne(context.Background(), bson.M{"user_id": userId})
+	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).DeleteOne(context.Background(), bson.M{"user_id": userId, "token": token})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// getSessionCollection returns the session collection
+func (a *AuthDbService) getSessionCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.SessionCollection)
+}
+
+// Create Session
+func (a *AuthDbService) CreateSession(sessionId, userId string, client ClientInfo, expires time.Time) error {
+	session := Session{
+		Id:         sessionId,
+		UserId:     userId,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		InsertedAt: time.Now(),
+		LastUsedAt: time.Now(),
+		Expires:    expires,
+	}
+	_, err := a.getSessionCollection().InsertOne(context.Background(), session)
+	return err
+}
+
+// TouchSession updates the last used time and client of a session. A zero expires keeps the expiry.
+func (a *AuthDbService) TouchSession(sessionId string, client ClientInfo, expires time.Time) error {
+	set := bson.M{"lastUsedAt": time.Now(), "ip": client.IP, "userAgent": client.UserAgent}
+	if !expires.IsZero() {
+		set["expires"] = expires
+	}
+	_, err := a.getSessionCollection().UpdateOne(context.Background(), bson.M{"_id": sessionId}, bson.M{"$set": set})
+	return err
+}
+
+// MarkSessionReauthenticated stores when the user of a session last re-authenticated
+func (a *AuthDbService) MarkSessionReauthenticated(sessionId string, reauthenticatedAt time.Time) error {
+	result, err := a.getSessionCollection().UpdateOne(context.Background(), bson.M{"_id": sessionId}, bson.M{"$set": bson.M{"reauthenticatedAt": reauthenticatedAt}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Get Session by Id
+func (a *AuthDbService) GetSessionById(sessionId string) (*Session, error) {
+	session := &Session{}
+	err := a.getSessionCollection().FindOne(context.Background(), bson.M{"_id": sessionId}).Decode(session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Get all active Sessions of a user
+func (a *AuthDbService) GetSessionsByUserId(userId string) ([]Session, error) {
+	sessions := []Session{}
+	filter := bson.M{"userId": userId, "expires": bson.M{"$gt": time.Now()}}
+	cursor, err := a.getSessionCollection().Find(context.Background(), filter, options.Find().SetSort(bson.M{"lastUsedAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var session Session
+		err := cursor.Decode(&session)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Delete Session
+func (a *AuthDbService) DeleteSession(sessionId string) error {
+	_, err := a.getSessionCollection().DeleteOne(context.Background(), bson.M{"_id": sessionId})
+	return err
+}
+
+// Delete all Sessions of a user
+func (a *AuthDbService) DeleteSessionsByUserId(userId string) error {
+	_, err := a.getSessionCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
+// EnsureIndexes creates the indexes the AuthDbService relies on
+func (a *AuthDbService) EnsureIndexes() error {
+	// The existence checks before writes can race, the index can't. Usernames differing
+	// only in letter case count as the same.
+	_, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"username": 1},
+		Options: options.Index().SetName("username_case_insensitive").SetUnique(true).SetCollation(usernameCollation),
+	})
+	if err != nil {
+		return err
+	}
+	// Tokens are looked up by value and removed by MongoDB once they expired. Used refresh
+	// tokens stay until then, so a replayed one is still recognized.
+	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.TokenCollection).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.M{"token": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.M{"familyId": 1}},
+		{Keys: bson.M{"user_id": 1}},
+	})
+	if err != nil {
+		return err
+	}
+	// Sessions end with their refresh token family
+	_, err = a.getSessionCollection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.M{"userId": 1}},
+	})
+	if err != nil {
+		return err
+	}
+	// Unfinished WebAuthn ceremonies are removed by MongoDB once they expired
+	_, err = a.getWebAuthnChallengeCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"expires": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.getWebAuthnCredentialCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"userId": 1},
+	})
+	if err != nil {
+		return err
+	}
+	// An external account can only be linked to one user
+	_, err = a.getExternalIdentityCollection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"userId": 1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.getExternalLoginStateCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"expires": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.getAPIKeyCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.M{"userId": 1},
+	})
+	if err != nil {
+		return err
+	}
+	// Expired reset links are removed by MongoDB
+	_, err = a.getPasswordResetCollection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.M{"userId": 1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.getEmailChangeCollection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.M{"cancelTokenHash": 1}},
+		{Keys: bson.M{"userId": 1}},
+	})
+	if err != nil {
+		return err
+	}
+	// Every user has at most one invitation, which is removed by MongoDB once its retention is over
+	_, err = a.getInvitationCollection().Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.M{"userId": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"deleteAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// getWebAuthnCredentialCollection returns the passkey collection
+func (a *AuthDbService) getWebAuthnCredentialCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.WebAuthn.CredentialCollection)
+}
+
+// getWebAuthnChallengeCollection returns the collection of running WebAuthn ceremonies
+func (a *AuthDbService) getWebAuthnChallengeCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.WebAuthn.ChallengeCollection)
+}
+
+// Create WebAuthn Credential
+func (a *AuthDbService) CreateWebAuthnCredential(credential WebAuthnCredential) error {
+	_, err := a.getWebAuthnCredentialCollection().InsertOne(context.Background(), credential)
+	return err
+}
+
+// Get all WebAuthn Credentials of a user
+func (a *AuthDbService) GetWebAuthnCredentialsByUserId(userId string) ([]WebAuthnCredential, error) {
+	credentials := []WebAuthnCredential{}
+	cursor, err := a.getWebAuthnCredentialCollection().Find(context.Background(), bson.M{"userId": userId}, options.Find().SetSort(bson.M{"insertedAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var credential WebAuthnCredential
+		err := cursor.Decode(&credential)
+		if err != nil {
+			return nil, err
+		}
+		credential.SignCount = credential.Credential.Authenticator.SignCount
+		credentials = append(credentials, credential)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// Count WebAuthn Credentials of a user
+func (a *AuthDbService) CountWebAuthnCredentials(userId string) (int64, error) {
+	return a.getWebAuthnCredentialCollection().CountDocuments(context.Background(), bson.M{"userId": userId})
+}
+
+// UpdateWebAuthnCredentialUsage stores the sign counter and flags after a successful assertion
+func (a *AuthDbService) UpdateWebAuthnCredentialUsage(credentialId string, authenticator webauthn.Authenticator, flags webauthn.CredentialFlags) error {
+	update := bson.M{"$set": bson.M{"credential.authenticator": authenticator, "credential.flags": flags, "lastUsedAt": time.Now()}}
+	_, err := a.getWebAuthnCredentialCollection().UpdateOne(context.Background(), bson.M{"_id": credentialId}, update)
+	return err
+}
+
+// Delete a WebAuthn Credential of a user
+func (a *AuthDbService) DeleteWebAuthnCredential(userId, credentialId string) error {
+	result, err := a.getWebAuthnCredentialCollection().DeleteOne(context.Background(), bson.M{"_id": credentialId, "userId": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete all WebAuthn Credentials of a user
+func (a *AuthDbService) DeleteWebAuthnCredentialsByUserId(userId string) error {
+	_, err := a.getWebAuthnCredentialCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
+// Create WebAuthn Challenge
+func (a *AuthDbService) CreateWebAuthnChallenge(challenge webAuthnChallenge) error {
+	_, err := a.getWebAuthnChallengeCollection().InsertOne(context.Background(), challenge)
+	return err
+}
+
+// UseWebAuthnChallenge returns and deletes a challenge, so every ceremony can only be finished once
+func (a *AuthDbService) UseWebAuthnChallenge(challengeId, ceremony string) (*webAuthnChallenge, error) {
+	challenge := &webAuthnChallenge{}
+	filter := bson.M{"_id": challengeId, "ceremony": ceremony, "expires": bson.M{"$gt": time.Now()}}
+	err := a.getWebAuthnChallengeCollection().FindOneAndDelete(context.Background(), filter).Decode(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// getExternalIdentityCollection returns the collection of linked external accounts
+func (a *AuthDbService) getExternalIdentityCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.Federation.IdentityCollection)
+}
+
+// getExternalLoginStateCollection returns the collection of running external logins
+func (a *AuthDbService) getExternalLoginStateCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.Federation.StateCollection)
+}
+
+// Create External Identity
+func (a *AuthDbService) CreateExternalIdentity(identity ExternalIdentity) error {
+	_, err := a.getExternalIdentityCollection().InsertOne(context.Background(), identity)
+	return err
+}
+
+// Get the External Identity of an account at a provider
+func (a *AuthDbService) GetExternalIdentity(provider, subject string) (*ExternalIdentity, error) {
+	identity := &ExternalIdentity{}
+	err := a.getExternalIdentityCollection().FindOne(context.Background(), bson.M{"provider": provider, "subject": subject}).Decode(identity)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Get all External Identities of a user
+func (a *AuthDbService) GetExternalIdentitiesByUserId(userId string) ([]ExternalIdentity, error) {
+	identities := []ExternalIdentity{}
+	cursor, err := a.getExternalIdentityCollection().Find(context.Background(), bson.M{"userId": userId}, options.Find().SetSort(bson.M{"insertedAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var identity ExternalIdentity
+		err := cursor.Decode(&identity)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// UpdateExternalIdentityUsage stores the time of the last login with an External Identity
+func (a *AuthDbService) UpdateExternalIdentityUsage(identityId string) error {
+	_, err := a.getExternalIdentityCollection().UpdateOne(context.Background(), bson.M{"_id": identityId}, bson.M{"$set": bson.M{"lastUsedAt": time.Now()}})
+	return err
+}
+
+// Delete an External Identity of a user
+func (a *AuthDbService) DeleteExternalIdentity(userId, identityId string) error {
+	result, err := a.getExternalIdentityCollection().DeleteOne(context.Background(), bson.M{"_id": identityId, "userId": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete all External Identities of a user
+func (a *AuthDbService) DeleteExternalIdentitiesByUserId(userId string) error {
+	_, err := a.getExternalIdentityCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
+// Create External Login State
+func (a *AuthDbService) CreateExternalLoginState(state externalLoginState) error {
+	_, err := a.getExternalLoginStateCollection().InsertOne(context.Background(), state)
+	return err
+}
+
+// UseExternalLoginState returns and deletes a state, so every callback can only be used once
+func (a *AuthDbService) UseExternalLoginState(stateId, provider, ceremony string) (*externalLoginState, error) {
+	state := &externalLoginState{}
+	filter := bson.M{"_id": stateId, "provider": provider, "ceremony": ceremony, "expires": bson.M{"$gt": time.Now()}}
+	err := a.getExternalLoginStateCollection().FindOneAndDelete(context.Background(), filter).Decode(state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// getPasswordResetCollection returns the collection of pending password resets
+func (a *AuthDbService) getPasswordResetCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.PasswordReset.Collection)
+}
+
+// Create Password Reset
+func (a *AuthDbService) CreatePasswordReset(reset passwordReset) error {
+	_, err := a.getPasswordResetCollection().InsertOne(context.Background(), reset)
+	return err
+}
+
+// GetPasswordReset returns a pending password reset that hasn't expired
+func (a *AuthDbService) GetPasswordReset(resetId string) (*passwordReset, error) {
+	reset := &passwordReset{}
+	filter := bson.M{"_id": resetId, "expires": bson.M{"$gt": time.Now()}}
+	err := a.getPasswordResetCollection().FindOne(context.Background(), filter).Decode(reset)
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+// UsePasswordReset deletes a pending password reset, so every link can only be used once
+func (a *AuthDbService) UsePasswordReset(resetId string) (*passwordReset, error) {
+	reset := &passwordReset{}
+	filter := bson.M{"_id": resetId, "expires": bson.M{"$gt": time.Now()}}
+	err := a.getPasswordResetCollection().FindOneAndDelete(context.Background(), filter).Decode(reset)
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+// Delete Password Resets By User Id
+func (a *AuthDbService) DeletePasswordResetsByUserId(userId string) error {
+	_, err := a.getPasswordResetCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
+// getEmailChangeCollection returns the collection of pending email changes
+func (a *AuthDbService) getEmailChangeCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.EmailChange.Collection)
+}
+
+// Create Email Change
+func (a *AuthDbService) CreateEmailChange(change emailChange) error {
+	_, err := a.getEmailChangeCollection().InsertOne(context.Background(), change)
+	return err
+}
+
+// UseEmailChange deletes and returns the pending email change of a confirmation link
+func (a *AuthDbService) UseEmailChange(changeId string) (*emailChange, error) {
+	change := &emailChange{}
+	filter := bson.M{"_id": changeId, "expires": bson.M{"$gt": time.Now()}}
+	err := a.getEmailChangeCollection().FindOneAndDelete(context.Background(), filter).Decode(change)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// CancelEmailChange deletes and returns the pending email change of a cancel link
+func (a *AuthDbService) CancelEmailChange(cancelTokenHash string) (*emailChange, error) {
+	change := &emailChange{}
+	filter := bson.M{"cancelTokenHash": cancelTokenHash, "expires": bson.M{"$gt": time.Now()}}
+	err := a.getEmailChangeCollection().FindOneAndDelete(context.Background(), filter).Decode(change)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// Delete Email Changes By User Id
+func (a *AuthDbService) DeleteEmailChangesByUserId(userId string) error {
+	_, err := a.getEmailChangeCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
+// getInvitationCollection returns the invitation collection
+func (a *AuthDbService) getInvitationCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.Invitation.Collection)
+}
+
+// Create Invitation
+func (a *AuthDbService) CreateInvitation(invitation Invitation) error {
+	_, err := a.getInvitationCollection().InsertOne(context.Background(), invitation)
+	return err
+}
+
+// GetOpenInvitations returns the invitations that weren't accepted, newest first
+func (a *AuthDbService) GetOpenInvitations() ([]Invitation, error) {
+	invitations := []Invitation{}
+	filter := bson.M{"state": bson.M{"$ne": InvitationAccepted}}
+	cursor, err := a.getInvitationCollection().Find(context.Background(), filter, options.Find().SetSort(bson.M{"sentAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var invitation Invitation
+		err := cursor.Decode(&invitation)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// Get Invitation By Id
+func (a *AuthDbService) GetInvitationById(invitationId string) (*Invitation, error) {
+	invitation := &Invitation{}
+	err := a.getInvitationCollection().FindOne(context.Background(), bson.M{"_id": invitationId}).Decode(invitation)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// UpdateInvitation sets fields of an invitation
+func (a *AuthDbService) UpdateInvitation(invitationId string, fields bson.M) error {
+	result, err := a.getInvitationCollection().UpdateOne(context.Background(), bson.M{"_id": invitationId}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// AcceptInvitation marks an open invitation as accepted, so every link can only be used once
+func (a *AuthDbService) AcceptInvitation(invitationId, tokenHash string, deleteAt time.Time) (*Invitation, error) {
+	invitation := &Invitation{}
+	filter := bson.M{
+		"_id":       invitationId,
+		"tokenHash": tokenHash,
+		"state":     bson.M{"$in": []string{InvitationSent, InvitationOpened}},
+		"expires":   bson.M{"$gt": time.Now()},
+	}
+	update := bson.M{"$set": bson.M{"state": InvitationAccepted, "acceptedAt": time.Now(), "deleteAt": deleteAt}}
+	err := a.getInvitationCollection().FindOneAndUpdate(context.Background(), filter, update).Decode(invitation)
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// Delete Invitations By User Id
+func (a *AuthDbService) DeleteInvitationsByUserId(userId string) error {
+	_, err := a.getInvitationCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
+// getAPIKeyCollection returns the API key collection
+func (a *AuthDbService) getAPIKeyCollection() *mongo.Collection {
+	return a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.APIKeyCollection)
+}
+
+// Create API Key
+func (a *AuthDbService) CreateAPIKey(apiKey APIKey) error {
+	_, err := a.getAPIKeyCollection().InsertOne(context.Background(), apiKey)
+	return err
+}
+
+// Get an API Key by its prefix
+func (a *AuthDbService) GetAPIKeyById(apiKeyId string) (*APIKey, error) {
+	apiKey := &APIKey{}
+	err := a.getAPIKeyCollection().FindOne(context.Background(), bson.M{"_id": apiKeyId}).Decode(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// Get all API Keys of a user
+func (a *AuthDbService) GetAPIKeysByUserId(userId string) ([]APIKey, error) {
+	apiKeys := []APIKey{}
+	cursor, err := a.getAPIKeyCollection().Find(context.Background(), bson.M{"userId": userId}, options.Find().SetSort(bson.M{"insertedAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var apiKey APIKey
+		err := cursor.Decode(&apiKey)
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return apiKeys, nil
+}
+
+// UpdateAPIKeyUsage stores the time an API Key was last used
+func (a *AuthDbService) UpdateAPIKeyUsage(apiKeyId string, lastUsedAt time.Time) error {
+	_, err := a.getAPIKeyCollection().UpdateOne(context.Background(), bson.M{"_id": apiKeyId}, bson.M{"$set": bson.M{"lastUsedAt": lastUsedAt}})
+	return err
+}
+
+// Delete an API Key of a user
+func (a *AuthDbService) DeleteAPIKey(userId, apiKeyId string) error {
+	result, err := a.getAPIKeyCollection().DeleteOne(context.Background(), bson.M{"_id": apiKeyId, "userId": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Delete all API Keys of a user
+func (a *AuthDbService) DeleteAPIKeysByUserId(userId string) error {
+	_, err := a.getAPIKeyCollection().DeleteMany(context.Background(), bson.M{"userId": userId})
+	return err
+}
+
 // Delete User
 func (a *AuthDbService) DeleteUserById(userId string) error {
 	objectId, err := primitive.ObjectIDFromHex(userId)
@@ -108,41 +795,162 @@ func (a *AuthDbService) DeleteUserById(userId string) error {
 	if err != nil {
 		return err
 	}
+	a.InvalidateCachedUser(userId)
 	return nil
 }
 
-// Update User
-func (a *AuthDbService) UpdateUser(user *User) error {
-	// Delete Id from stuct, to prevent overwriting
-	fmt.Println("Updating user")
-	userId := user.Id
-	user.Id = ""
+// UpdateUserFields sets fields of a user
+func (a *AuthDbService) UpdateUserFields(userId string, fields bson.M) error {
 	objectId, err := primitive.ObjectIDFromHex(userId)
 	if err != nil {
-		log.Println("Invalid id")
+		return err
 	}
-	filter := bson.M{"_id": objectId}
-	result, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).ReplaceOne(context.Background(), filter, user)
+	fields["updatedAt"] = time.Now()
+	result, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), bson.M{"_id": objectId}, bson.M{"$set": fields})
+	if err != nil {
+		return usernameError(err)
+	}
+	a.InvalidateCachedUser(userId)
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// GetDeletedUsers returns the deleted users that weren't purged yet
+func (a *AuthDbService) GetDeletedUsers() ([]DeletedUser, error) {
+	users := []DeletedUser{}
+	filter := bson.M{"state": DELETED, "purgedAt": bson.M{"$exists": false}}
+	cursor, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).Find(context.Background(), filter, options.Find().SetSort(bson.M{"deletedAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var user DeletedUser
+		err := cursor.Decode(&user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetUsersToPurge returns the users that were deleted before the time and weren't purged yet
+func (a *AuthDbService) GetUsersToPurge(deletedBefore time.Time) ([]User, error) {
+	users := []User{}
+	filter := bson.M{"state": DELETED, "deletedAt": bson.M{"$lt": deletedBefore}, "purgedAt": bson.M{"$exists": false}}
+	cursor, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var user User
+		err := cursor.Decode(&user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// UpdatePasswordHash replaces the password hash, as long as it was not changed in the meantime
+func (a *AuthDbService) UpdatePasswordHash(userId, oldHash, newHash string) error {
+	objectId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"_id": objectId, "password": oldHash}
+	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, bson.M{"$set": bson.M{"password": newHash}})
 	if err != nil {
 		return err
 	}
-	if result.ModifiedCount != 0 {
-		return nil
+	a.InvalidateCachedUser(userId)
+	return nil
+}
+
+// Create Service Account, returns the id of the new account
+func (a *AuthDbService) CreateServiceAccount(serviceAccount ServiceAccount) (string, error) {
+	result, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).InsertOne(context.Background(), serviceAccount)
+	if err != nil {
+		return "", usernameError(err)
+	}
+	objectId, ok := result.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", fmt.Errorf("unexpected id type")
+	}
+	return objectId.Hex(), nil
+}
+
+// Get all Service Accounts
+func (a *AuthDbService) GetServiceAccounts() ([]ServiceAccount, error) {
+	serviceAccounts := []ServiceAccount{}
+	cursor, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).Find(context.Background(), bson.M{"type": ServiceAccountType}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var serviceAccount ServiceAccount
+		err := cursor.Decode(&serviceAccount)
+		if err != nil {
+			return nil, err
+		}
+		serviceAccounts = append(serviceAccounts, serviceAccount)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return serviceAccounts, nil
+}
+
+// Get a Service Account by Id
+func (a *AuthDbService) GetServiceAccountById(id string) (*ServiceAccount, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccount := &ServiceAccount{}
+	err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).FindOne(context.Background(), bson.M{"_id": objectId, "type": ServiceAccountType}).Decode(serviceAccount)
+	if err != nil {
+		return nil, err
 	}
-	result, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, bson.M{"$set": user})
+	return serviceAccount, nil
+}
+
+// UpdateServiceAccount sets fields of a Service Account
+func (a *AuthDbService) UpdateServiceAccount(id string, fields bson.M) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	fields["updatedAt"] = time.Now()
+	result, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), bson.M{"_id": objectId, "type": ServiceAccountType}, bson.M{"$set": fields})
 	if err != nil {
 		return err
 	}
-	if result.ModifiedCount != 0 {
-		return nil
+	a.InvalidateCachedUser(id)
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
 	}
-	return fmt.Errorf("something went wrong, user not updated")
+	return nil
 }
 
 // Get All Users
 func (a *AuthDbService) GetAllUsers() ([]UserOutputAll, error) {
 	var users []UserOutputAll
-	cursor, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).Find(context.Background(), bson.M{})
+	// Service accounts are no people and only listed by GetServiceAccounts, deleted users by GetDeletedUsers
+	filter := bson.M{"type": bson.M{"$ne": ServiceAccountType}, "state": bson.M{"$ne": DELETED}}
+	cursor, err := a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).Find(context.Background(), filter)
 	if err != nil {
 		return nil, err
 	}
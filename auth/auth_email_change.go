@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RequestEmailChange sends a confirmation link to the new address and a cancel link
+// to the old one. The username only changes once the new address is confirmed.
+func (a *AuthService) RequestEmailChange(user *User, newEmail string, actor audit.Actor) error {
+	newEmail = strings.TrimSpace(newEmail)
+	address, err := mail.ParseAddress(newEmail)
+	if err != nil || address.Address != newEmail {
+		return errors.New("email address is not valid")
+	}
+	if user.AuthSource != "" {
+		return errors.New("the email of this user is managed by the directory")
+	}
+	if strings.EqualFold(newEmail, user.Username) {
+		return errors.New("email address is the current one")
+	}
+	err = a.throttlingService.Check(throttling.EmailChange, user.Username, actor.IP)
+	if err != nil {
+		return err
+	}
+	// Every request counts, so nobody can send mails to arbitrary addresses over and over
+	_, err = a.throttlingService.RegisterFailure(throttling.EmailChange, user.Username, actor.IP)
+	if err != nil {
+		return err
+	}
+	existing, _ := a.AuthDbService.GetUserbyUsername(newEmail)
+	if existing != nil {
+		return errors.New("email address is already in use")
+	}
+	confirmToken, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	cancelToken, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	// Only the newest request can be confirmed
+	err = a.AuthDbService.DeleteEmailChangesByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.CreateEmailChange(emailChange{
+		Id:              hashToken(confirmToken),
+		CancelTokenHash: hashToken(cancelToken),
+		UserId:          user.Id,
+		OldEmail:        user.Username,
+		NewEmail:        newEmail,
+		Expires:         time.Now().Add(time.Duration(a.config.EmailChange.Hours) * time.Hour),
+		InsertedAt:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	a.record(actor, audit.EmailChangeRequested, user.Id, nil, map[string]interface{}{"newEmail": newEmail})
+	confirmLink, err := linkWithToken(a.config.EmailChange.ConfirmURL, confirmToken)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Open this link to confirm %s as the new email address of your account: %s\n\nThe link is valid for %d hours.", newEmail, confirmLink, a.config.EmailChange.Hours)
+	err = a.EmailSender.SendEmail(newEmail, "Confirm your new email address", body)
+	if err != nil {
+		return err
+	}
+	cancelLink, err := linkWithToken(a.config.EmailChange.CancelURL, cancelToken)
+	if err != nil {
+		return err
+	}
+	body = fmt.Sprintf("Someone requested to change the email address of your account to %s. If this was not you, open this link to cancel the change, log out everywhere and choose a new password: %s", newEmail, cancelLink)
+	return a.EmailSender.SendEmail(user.Username, "Your email address is about to change", body)
+}
+
+// linkWithToken appends the token to the page of the frontend
+func linkWithToken(page, token string) (string, error) {
+	link, err := url.Parse(page)
+	if err != nil {
+		return "", err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// ConfirmEmailChange changes the username to the confirmed address
+func (a *AuthService) ConfirmEmailChange(token string, client ClientInfo) error {
+	change, err := a.AuthDbService.UseEmailChange(hashToken(token))
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	user, err := a.AuthDbService.GetUserbyId(change.UserId)
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	// The link belongs to the old address, a change in between makes it useless
+	if user.State != ACTIVE || user.Username != change.OldEmail {
+		return errors.New("link is invalid or expired")
+	}
+	// The address could have been taken since the request
+	existing, _ := a.AuthDbService.GetUserbyUsername(change.NewEmail)
+	if existing != nil {
+		return errors.New("email address is already in use")
+	}
+	err = a.AuthDbService.UpdateUserFields(user.Id, bson.M{"username": change.NewEmail})
+	if errors.Is(err, ErrUsernameTaken) {
+		return errors.New("email address is already in use")
+	}
+	if err != nil {
+		return err
+	}
+	after := *user
+	after.Username = change.NewEmail
+	a.record(actorFromClient(user, client), audit.EmailChanged, user.Id, *user, after)
+	body := fmt.Sprintf("The email address of your account was changed to %s. If this was not you, please contact an administrator.", change.NewEmail)
+	err = a.EmailSender.SendEmail(change.OldEmail, "Your email address was changed", body)
+	if err != nil {
+		fmt.Println("Error sending email change notification:", err)
+	}
+	return nil
+}
+
+// CancelEmailChange drops a pending email change with the link sent to the old address.
+// Whoever requested the change had a session of the user, so every session ends and the
+// user gets a link to choose a new password.
+func (a *AuthService) CancelEmailChange(token string, client ClientInfo) error {
+	change, err := a.AuthDbService.CancelEmailChange(hashToken(token))
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	user, err := a.AuthDbService.GetUserbyId(change.UserId)
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	a.record(actorFromClient(user, client), audit.EmailChangeCancelled, user.Id, nil, nil)
+	err = a.revokeUserTokens(user.Id)
+	if err != nil {
+		return err
+	}
+	if user.State != ACTIVE {
+		return nil
+	}
+	link, err := a.createPasswordResetLink(user)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("The change of your email address was cancelled and you were logged out everywhere. Open this link to choose a new password: %s\n\nThe link is valid for %d minutes and can only be used once.", link, a.config.PasswordReset.Minutes)
+	return a.EmailSender.SendEmail(user.Username, "Choose a new password", body)
+}
@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+// ceremonyLink links an external account to a logged in user, logins use ceremonyLogin
+const ceremonyLink = "link"
+
+// externalProvider is an external OIDC identity provider. Its metadata is
+// discovered on first use, so a provider that is down doesn't prevent startup.
+type externalProvider struct {
+	config   config.ExternalProviderConfig
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// externalClaims are the claims of the ID token used to find or create the user
+type externalClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+func newExternalProviders(config config.FederationConfig) map[string]*externalProvider {
+	providers := map[string]*externalProvider{}
+	for _, providerConfig := range config.Providers {
+		providers[providerConfig.Name] = &externalProvider{config: providerConfig}
+	}
+	return providers
+}
+
+// discover returns the provider metadata, fetching it if it wasn't loaded yet
+func (p *externalProvider) discover() (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider != nil {
+		return p.provider, nil
+	}
+	provider, err := oidc.NewProvider(context.Background(), p.config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.provider = provider
+	return provider, nil
+}
+
+func (p *externalProvider) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.ClientId,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.config.Scopes,
+	}
+}
+
+// GetExternalProviders returns the names of the configured identity providers
+func (a *AuthService) GetExternalProviders() []string {
+	names := []string{}
+	for _, providerConfig := range a.config.Federation.Providers {
+		names = append(names, providerConfig.Name)
+	}
+	return names
+}
+
+// BeginExternalLogin returns the URL of the identity provider the browser is sent to
+func (a *AuthService) BeginExternalLogin(providerName string) (string, error) {
+	return a.beginExternal(providerName, ceremonyLogin, "")
+}
+
+// BeginExternalLink starts linking an account at an identity provider to the user
+func (a *AuthService) BeginExternalLink(user *User, providerName string) (string, error) {
+	return a.beginExternal(providerName, ceremonyLink, user.Id)
+}
+
+// beginExternal stores state, nonce and PKCE verifier until the callback and returns the authorization URL
+func (a *AuthService) beginExternal(providerName, ceremony, userId string) (string, error) {
+	p, exists := a.externalProviders[providerName]
+	if !exists {
+		return "", errors.New("unknown identity provider")
+	}
+	provider, err := p.discover()
+	if err != nil {
+		return "", errors.New("identity provider is not reachable")
+	}
+	state, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+	err = a.AuthDbService.CreateExternalLoginState(externalLoginState{
+		Id:           hashToken(state),
+		Provider:     providerName,
+		Ceremony:     ceremony,
+		UserId:       userId,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		Expires:      time.Now().Add(time.Duration(a.config.Federation.StateMinutes) * time.Minute),
+	})
+	if err != nil {
+		return "", err
+	}
+	return p.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// exchangeExternalCode redeems the code of a callback and verifies the ID token
+func (a *AuthService) exchangeExternalCode(providerName, ceremony string, request ExternalCallbackRequest) (*oidc.IDToken, *externalClaims, *externalLoginState, error) {
+	p, exists := a.externalProviders[providerName]
+	if !exists {
+		return nil, nil, nil, errors.New("unknown identity provider")
+	}
+	state, err := a.AuthDbService.UseExternalLoginState(hashToken(request.State), providerName, ceremony)
+	if err != nil {
+		return nil, nil, nil, errors.New("login expired, please try again")
+	}
+	provider, err := p.discover()
+	if err != nil {
+		return nil, nil, nil, errors.New("identity provider is not reachable")
+	}
+	token, err := p.oauth2Config(provider).Exchange(context.Background(), request.Code, oauth2.VerifierOption(state.CodeVerifier))
+	if err != nil {
+		return nil, nil, nil, errors.New("identity provider rejected the login")
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, nil, errors.New("identity provider returned no ID token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientId}).Verify(context.Background(), rawIdToken)
+	if err != nil {
+		return nil, nil, nil, errors.New("ID token could not be verified")
+	}
+	if idToken.Nonce != state.Nonce {
+		return nil, nil, nil, errors.New("ID token could not be verified")
+	}
+	claims := &externalClaims{}
+	err = idToken.Claims(claims)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return idToken, claims, state, nil
+}
+
+// FinishExternalLogin logs the user of a linked external account in. Unlinked accounts
+// are matched by their verified email or provisioned if the provider allows it.
+func (a *AuthService) FinishExternalLogin(providerName string, request ExternalCallbackRequest, client ClientInfo) (*tokenModel, error) {
+	idToken, claims, _, err := a.exchangeExternalCode(providerName, ceremonyLogin, request)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.resolveExternalUser(providerName, idToken.Subject, claims, client)
+	if err != nil {
+		return nil, err
+	}
+	if user.State != ACTIVE {
+		return nil, errors.New("User is not active")
+	}
+	// The identity provider doesn't replace our own second factor
+	if user.TotpActive || a.hasPasskeys(user) {
+		return a.issueToken(user, TwoFactorToken, "", time.Now().Add(time.Minute*5), true, false)
+	}
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueLoginTokens(user, "", false, client)
+}
+
+// resolveExternalUser returns the user linked to the external account, linking or creating it if needed
+func (a *AuthService) resolveExternalUser(providerName, subject string, claims *externalClaims, client ClientInfo) (*User, error) {
+	identity, err := a.AuthDbService.GetExternalIdentity(providerName, subject)
+	if err == nil {
+		user, err := a.AuthDbService.GetUserbyId(identity.UserId)
+		if err != nil {
+			return nil, errors.New("User not found")
+		}
+		err = a.AuthDbService.UpdateExternalIdentityUsage(identity.Id)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	// Unverified emails could belong to anyone, they are never used to find or create a user
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errors.New("no user is linked to this account")
+	}
+	user, err := a.AuthDbService.GetUserbyUsername(claims.Email)
+	if err != nil {
+		user, err = a.provisionExternalUser(providerName, claims, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if user.Type == ServiceAccountType {
+		return nil, errors.New("no user is linked to this account")
+	}
+	_, err = a.linkExternalIdentity(user, providerName, subject, claims.Email, actorFromClient(user, client))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// provisionExternalUser creates an active user without password for an external account
+func (a *AuthService) provisionExternalUser(providerName string, claims *externalClaims, client ClientInfo) (*User, error) {
+	p := a.externalProviders[providerName]
+	if !p.config.AutoProvision {
+		return nil, errors.New("no user is linked to this account")
+	}
+	if !a.roleService.RoleExists(p.config.DefaultRole) {
+		return nil, errors.New("Role does not exist")
+	}
+	timestamp := time.Now()
+	err := a.AuthDbService.CreateUser(User{
+		Username:   claims.Email,
+		FirstName:  claims.GivenName,
+		LastName:   claims.FamilyName,
+		Role:       p.config.DefaultRole,
+		State:      ACTIVE,
+		InsertedAt: timestamp,
+		UpdatedAt:  timestamp,
+	})
+	if err != nil {
+		return nil, errors.New("something went wrong creating the user")
+	}
+	user, err := a.AuthDbService.GetUserbyUsername(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	a.record(actorFromClient(user, client), audit.UserCreated, user.Id, nil, *user)
+	return user, nil
+}
+
+// FinishExternalLink links the external account of the callback to the user that started linking
+func (a *AuthService) FinishExternalLink(user *User, providerName string, request ExternalCallbackRequest, actor audit.Actor) (*ExternalIdentity, error) {
+	idToken, claims, state, err := a.exchangeExternalCode(providerName, ceremonyLink, request)
+	if err != nil {
+		return nil, err
+	}
+	if state.UserId != user.Id {
+		return nil, errors.New("login expired, please try again")
+	}
+	return a.linkExternalIdentity(user, providerName, idToken.Subject, claims.Email, actor)
+}
+
+// linkExternalIdentity stores the link between a user and an external account
+func (a *AuthService) linkExternalIdentity(user *User, providerName, subject, email string, actor audit.Actor) (*ExternalIdentity, error) {
+	existing, err := a.AuthDbService.GetExternalIdentity(providerName, subject)
+	if err == nil {
+		if existing.UserId != user.Id {
+			return nil, errors.New("account is already linked to another user")
+		}
+		return existing, nil
+	}
+	identity := ExternalIdentity{
+		Id:         primitive.NewObjectID().Hex(),
+		UserId:     user.Id,
+		Provider:   providerName,
+		Subject:    subject,
+		Email:      email,
+		InsertedAt: time.Now(),
+		LastUsedAt: time.Now(),
+	}
+	err = a.AuthDbService.CreateExternalIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+	a.record(actor, audit.ExternalIdentityLinked, user.Id, nil, identity)
+	return &identity, nil
+}
+
+// GetExternalIdentities returns the external accounts linked to the user
+func (a *AuthService) GetExternalIdentities(user *User) ([]ExternalIdentity, error) {
+	return a.AuthDbService.GetExternalIdentitiesByUserId(user.Id)
+}
+
+// UnlinkExternalIdentity removes the link to an external account
+func (a *AuthService) UnlinkExternalIdentity(user *User, identityId string, actor audit.Actor) error {
+	err := a.AuthDbService.DeleteExternalIdentity(user.Id, identityId)
+	if err == mongo.ErrNoDocuments {
+		return errors.New("External identity not found")
+	}
+	if err != nil {
+		return err
+	}
+	a.record(actor, audit.ExternalIdentityUnlinked, user.Id, nil, nil)
+	return nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/roles"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Impersonate issues a short-lived token to act as the user. Only users whose role grants
+// nothing the admin doesn't have can be impersonated, and no users that can impersonate.
+func (a *AuthService) Impersonate(admin *User, userId, reason string, actor audit.Actor) (*tokenModel, error) {
+	if admin.Id == userId {
+		return nil, errors.New("you can't impersonate yourself")
+	}
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil || user.Type == ServiceAccountType {
+		return nil, errors.New("User not found")
+	}
+	if user.State != ACTIVE {
+		return nil, errors.New("User is not active")
+	}
+	if a.roleService.HasPermission(user.Role, roles.UsersImpersonate) {
+		return nil, errors.New("users that can impersonate can't be impersonated")
+	}
+	if !a.roleService.Covers(admin.Role, user.Role) {
+		return nil, errors.New("users with permissions you don't have can't be impersonated")
+	}
+	jti := primitive.NewObjectID().Hex()
+	expires := time.Now().Add(time.Duration(a.config.ImpersonationMinutes) * time.Minute)
+	token_string, err := a.generateJWTToken(TokenClaims{
+		Username:       user.Username,
+		Role:           user.Role,
+		TokenType:      ImpersonationToken,
+		ImpersonatorId: admin.Id,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   user.Id,
+			Issuer:    a.config.JWTIssuer,
+			Audience:  jwt.ClaimStrings{a.config.JWTAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	token, err := a.AuthDbService.WriteTokenToDatabase(user.Id, token_string, ImpersonationToken, "", expires, false, false)
+	if err != nil {
+		return nil, err
+	}
+	token.Jti = jti
+	a.record(actor, audit.ImpersonationStarted, user.Id, nil, map[string]interface{}{"reason": reason, "expires": expires})
+	return token, nil
+}
+
+// resolveImpersonator returns the admin behind an impersonation token, as long as the admin
+// may still impersonate the user. Roles can change while the token is valid.
+func (a *AuthService) resolveImpersonator(claims *TokenClaims, user *User) (*User, error) {
+	admin, err := a.AuthDbService.GetCachedUserbyId(claims.ImpersonatorId)
+	if err != nil {
+		return nil, errors.New("Unauthorized")
+	}
+	if admin.State != ACTIVE || !a.roleService.HasPermission(admin.Role, roles.UsersImpersonate) || !a.roleService.Covers(admin.Role, user.Role) {
+		return nil, errors.New("Unauthorized")
+	}
+	return admin, nil
+}
+
+// EndImpersonation revokes the impersonation token of the request before it expires
+func (a *AuthService) EndImpersonation(token *tokenModel, user *User, actor audit.Actor) error {
+	if token.TokenType != ImpersonationToken {
+		return errors.New("token is not an impersonation token")
+	}
+	err := a.revokeToken(token)
+	if err != nil {
+		return err
+	}
+	a.record(actor, audit.ImpersonationEnded, user.Id, nil, nil)
+	return nil
+}
+
+// recordImpersonatedRequest writes every request of an impersonation to the audit log with the admin as actor
+func (a *AuthService) recordImpersonatedRequest(actor audit.Actor, user *User, method, path string) {
+	a.record(actor, audit.ImpersonatedRequest, user.Id, nil, map[string]interface{}{"method": method, "path": path})
+}
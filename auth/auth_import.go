@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+)
+
+// maxImportRows limits how many users one import creates
+const maxImportRows = 1000
+
+// ImportUsers validates every row and, unless it is a dry run, creates the users in one
+// batch and invites them. If a row is invalid no user is created, so a corrected file
+// can be imported again as a whole.
+func (a *AuthService) ImportUsers(rows []ImportRow, dryRun bool, actor audit.Actor) (*ImportReport, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("file contains no users")
+	}
+	if len(rows) > maxImportRows {
+		return nil, fmt.Errorf("an import can contain at most %d users", maxImportRows)
+	}
+	report := &ImportReport{DryRun: dryRun, Total: len(rows), Rows: make([]ImportRowResult, len(rows))}
+	users := make([]User, len(rows))
+	seen := map[string]int{}
+	for i, row := range rows {
+		report.Rows[i] = ImportRowResult{Line: row.Line, Username: row.Username, Status: ImportValid}
+		user, err := a.validateImportRow(row, actor)
+		if err == nil {
+			if line, exists := seen[strings.ToLower(row.Username)]; exists {
+				err = fmt.Errorf("username is already used in line %d", line)
+			}
+			seen[strings.ToLower(row.Username)] = row.Line
+		}
+		if err != nil {
+			report.Rows[i].Status = ImportFailed
+			report.Rows[i].Error = err.Error()
+			report.Failed++
+			continue
+		}
+		users[i] = *user
+	}
+	if dryRun || report.Failed > 0 {
+		return report, nil
+	}
+	ids, err := a.AuthDbService.CreateUsers(users)
+	if errors.Is(err, ErrUsernameTaken) {
+		return nil, errors.New("a user of the file was created in the meantime, nothing was imported")
+	}
+	if err != nil {
+		return nil, errors.New("something went wrong creating the users")
+	}
+	for i := range users {
+		users[i].Id = ids[i]
+		report.Rows[i].Status = ImportCreated
+		report.Rows[i].UserId = ids[i]
+		report.Created++
+		a.record(actor, audit.UserCreated, ids[i], nil, users[i])
+		// The user exists either way, a failed invitation can be resent from the invitations
+		err = a.inviteUser(&users[i], actor)
+		if err != nil {
+			report.Rows[i].Error = "user was created, but the invitation could not be sent: " + err.Error()
+		}
+	}
+	return report, nil
+}
+
+// validateImportRow checks a row and returns the user it creates
+func (a *AuthService) validateImportRow(row ImportRow, actor audit.Actor) (*User, error) {
+	if row.Username == "" {
+		return nil, errors.New("username is missing")
+	}
+	address, err := mail.ParseAddress(row.Username)
+	if err != nil || address.Address != row.Username {
+		return nil, errors.New("username is not a valid email address")
+	}
+	if row.FirstName == "" || row.LastName == "" {
+		return nil, errors.New("first and last name are required")
+	}
+	if !a.roleService.RoleExists(row.Role) {
+		return nil, errors.New("Role does not exist")
+	}
+	err = a.checkRoleCovered(row.Role, actor)
+	if err != nil {
+		return nil, err
+	}
+	vacationDaysPerYear, err := parseImportInt(row.VacationDaysPerYear)
+	if err != nil {
+		return nil, errors.New("VacationDaysPerYear is not a whole number of at least 0")
+	}
+	targetHoursPerWeek, err := parseImportHours(row.TargetHoursPerWeek)
+	if err != nil {
+		return nil, errors.New("TargetHoursPerWeek is not a number of hours between 0 and 168")
+	}
+	maximumHoursPerWeek, err := parseImportHours(row.MaximumHoursPerWeek)
+	if err != nil {
+		return nil, errors.New("MaximumHoursPerWeek is not a number of hours between 0 and 168")
+	}
+	if maximumHoursPerWeek != 0 && maximumHoursPerWeek < targetHoursPerWeek {
+		return nil, errors.New("MaximumHoursPerWeek is lower than TargetHoursPerWeek")
+	}
+	// Like the duplicates within the file, existing users are matched in any letter case
+	existingUser, _ := a.AuthDbService.GetUserbyUsername(row.Username)
+	if existingUser != nil {
+		return nil, errors.New("User already exists")
+	}
+	timestamp := time.Now()
+	return &User{
+		Username:            row.Username,
+		FirstName:           row.FirstName,
+		LastName:            row.LastName,
+		Role:                row.Role,
+		Personnelnumber:     row.Personnelnumber,
+		VacationDaysPerYear: vacationDaysPerYear,
+		TargetHoursPerWeek:  targetHoursPerWeek,
+		MaximumHoursPerWeek: maximumHoursPerWeek,
+		State:               NEW,
+		InsertedAt:          timestamp,
+		UpdatedAt:           timestamp,
+	}, nil
+}
+
+// parseImportInt parses an optional whole number that is not negative
+func parseImportInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, errors.New("invalid number")
+	}
+	return number, nil
+}
+
+// parseImportHours parses an optional number of hours per week, with a decimal point or comma
+func parseImportHours(value string) (float32, error) {
+	if value == "" {
+		return 0, nil
+	}
+	hours, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 32)
+	if err != nil || hours < 0 || hours > 168 {
+		return 0, errors.New("invalid number of hours")
+	}
+	return float32(hours), nil
+}
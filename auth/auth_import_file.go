@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxImportFileSize limits the size of an import file, XLSX files are read into memory
+const maxImportFileSize = 10 << 20
+
+// maxXLSXPartSize limits the uncompressed size of a part of an XLSX file, so a small
+// file can't unpack to gigabytes
+const maxXLSXPartSize = 50 << 20
+
+// importColumns maps the normalized header of a column to the field of the row it fills
+var importColumns = map[string]func(row *ImportRow) *string{
+	"username":            func(row *ImportRow) *string { return &row.Username },
+	"email":               func(row *ImportRow) *string { return &row.Username },
+	"firstname":           func(row *ImportRow) *string { return &row.FirstName },
+	"lastname":            func(row *ImportRow) *string { return &row.LastName },
+	"role":                func(row *ImportRow) *string { return &row.Role },
+	"personnelnumber":     func(row *ImportRow) *string { return &row.Personnelnumber },
+	"vacationdaysperyear": func(row *ImportRow) *string { return &row.VacationDaysPerYear },
+	"targethoursperweek":  func(row *ImportRow) *string { return &row.TargetHoursPerWeek },
+	"maximumhoursperweek": func(row *ImportRow) *string { return &row.MaximumHoursPerWeek },
+}
+
+// ReadImportFile reads the rows of a CSV or XLSX file. The first row names the columns,
+// headers are matched case-insensitively and spaces and underscores are ignored.
+func ReadImportFile(filename string, r io.Reader) ([]ImportRow, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImportFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportFileSize {
+		return nil, errors.New("file is too large")
+	}
+	var records [][]string
+	var lines []int
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		records, lines, err = readCSVRecords(data)
+	case ".xlsx":
+		records, lines, err = readXLSXRecords(data)
+	default:
+		return nil, errors.New("only CSV and XLSX files can be imported")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("file is empty")
+	}
+	fields := make([]func(row *ImportRow) *string, len(records[0]))
+	hasUsername := false
+	for i, header := range records[0] {
+		name := strings.ToLower(strings.NewReplacer(" ", "", "_", "", "\ufeff", "").Replace(strings.TrimSpace(header)))
+		if name == "" {
+			continue
+		}
+		field, exists := importColumns[name]
+		if !exists {
+			return nil, errors.New("unknown column " + header)
+		}
+		fields[i] = field
+		hasUsername = hasUsername || name == "username" || name == "email"
+	}
+	if !hasUsername {
+		return nil, errors.New("column username is missing")
+	}
+	rows := []ImportRow{}
+	for i, record := range records[1:] {
+		row := ImportRow{Line: lines[i+1]}
+		empty := true
+		for j, value := range record {
+			if j >= len(fields) || fields[j] == nil {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			*fields[j](&row) = value
+			empty = empty && value == ""
+		}
+		// Spreadsheets often end with formatted but empty rows
+		if empty {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// readCSVRecords reads a CSV file separated by commas or, like Excel exports in many locales, semicolons
+func readCSVRecords(data []byte) ([][]string, []int, error) {
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	records := [][]string{}
+	lines := []int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	return records, lines, nil
+}
+
+// xlsxWorkbook, xlsxRelationships, xlsxSharedStrings and xlsxWorksheet are the parts of an
+// XLSX file needed to read the cells of its first sheet
+type xlsxWorkbook struct {
+	Sheets []struct {
+		RelationshipId string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		Id     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	text := t.Text
+	for _, run := range t.Runs {
+		text += run.Text
+	}
+	return text
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		Number int `xml:"r,attr"`
+		Cells  []struct {
+			Reference string   `xml:"r,attr"`
+			Type      string   `xml:"t,attr"`
+			Value     string   `xml:"v"`
+			Inline    xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSXRecords reads the cells of the first sheet of an XLSX file as text
+func readXLSXRecords(data []byte) ([][]string, []int, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, errors.New("file is not a valid XLSX file")
+	}
+	var workbook xlsxWorkbook
+	err = readXLSXPart(archive, "xl/workbook.xml", &workbook)
+	if err != nil || len(workbook.Sheets) == 0 {
+		return nil, nil, errors.New("file is not a valid XLSX file")
+	}
+	var relationships xlsxRelationships
+	err = readXLSXPart(archive, "xl/_rels/workbook.xml.rels", &relationships)
+	if err != nil {
+		return nil, nil, errors.New("file is not a valid XLSX file")
+	}
+	sheetPath := ""
+	for _, relationship := range relationships.Relationships {
+		if relationship.Id == workbook.Sheets[0].RelationshipId {
+			sheetPath = relationship.Target
+		}
+	}
+	if sheetPath == "" {
+		return nil, nil, errors.New("file is not a valid XLSX file")
+	}
+	// Targets are relative to xl/ unless they are absolute within the package
+	if strings.HasPrefix(sheetPath, "/") {
+		sheetPath = strings.TrimPrefix(sheetPath, "/")
+	} else {
+		sheetPath = path.Join("xl", sheetPath)
+	}
+	var sharedStrings xlsxSharedStrings
+	// Sheets with numbers only have no shared strings
+	_ = readXLSXPart(archive, "xl/sharedStrings.xml", &sharedStrings)
+	var sheet xlsxWorksheet
+	err = readXLSXPart(archive, sheetPath, &sheet)
+	if err != nil {
+		return nil, nil, errors.New("file is not a valid XLSX file")
+	}
+	records := [][]string{}
+	lines := []int{}
+	for _, row := range sheet.Rows {
+		record := []string{}
+		for i, cell := range row.Cells {
+			column := xlsxColumn(cell.Reference)
+			if column < 0 {
+				column = i
+			}
+			for len(record) <= column {
+				record = append(record, "")
+			}
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(cell.Value)
+				if err != nil || index < 0 || index >= len(sharedStrings.Items) {
+					return nil, nil, errors.New("file is not a valid XLSX file")
+				}
+				record[column] = sharedStrings.Items[index].String()
+			case "inlineStr":
+				record[column] = cell.Inline.String()
+			default:
+				record[column] = cell.Value
+			}
+		}
+		records = append(records, record)
+		lines = append(lines, row.Number)
+	}
+	return records, lines, nil
+}
+
+// readXLSXPart decodes an XML part of an XLSX file
+func readXLSXPart(archive *zip.Reader, name string, v interface{}) error {
+	for _, file := range archive.File {
+		if file.Name != name {
+			continue
+		}
+		if file.UncompressedSize64 > maxXLSXPartSize {
+			return errors.New("file is too large")
+		}
+		part, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer part.Close()
+		// The size in the header could be wrong, the reader stops at the limit either way
+		return xml.NewDecoder(io.LimitReader(part, maxXLSXPartSize)).Decode(v)
+	}
+	return errors.New("part " + name + " not found")
+}
+
+// xlsxColumn returns the zero-based column of a cell reference like "C12", or -1 without one
+func xlsxColumn(reference string) int {
+	column := 0
+	letters := 0
+	for _, char := range reference {
+		if char < 'A' || char > 'Z' {
+			break
+		}
+		column = column*26 + int(char-'A'+1)
+		letters++
+	}
+	if letters == 0 {
+		return -1
+	}
+	return column - 1
+}
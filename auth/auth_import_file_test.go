@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// xlsxFile builds an XLSX file with one sheet and the given shared strings
+func xlsxFile(t *testing.T, sheetData string, sharedStrings []string) []byte {
+	t.Helper()
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="Users" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			sheetData + `</sheetData></worksheet>`,
+	}
+	if sharedStrings != nil {
+		items := ""
+		for _, s := range sharedStrings {
+			items += "<si><t>" + s + "</t></si>"
+		}
+		parts["xl/sharedStrings.xml"] = `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` + items + `</sst>`
+	}
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range parts {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestReadImportFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     []ImportRow
+		wantErr  string
+	}{
+		{
+			name:     "comma separated",
+			filename: "users.csv",
+			data:     []byte("username,firstName,lastName\nanna@example.com,Anna,Berg\n"),
+			want:     []ImportRow{{Line: 2, Username: "anna@example.com", FirstName: "Anna", LastName: "Berg"}},
+		},
+		{
+			name:     "semicolon separated",
+			filename: "users.csv",
+			data:     []byte("username;firstName;lastName;targetHoursPerWeek\nanna@example.com;Anna;Berg;38,5\n"),
+			want:     []ImportRow{{Line: 2, Username: "anna@example.com", FirstName: "Anna", LastName: "Berg", TargetHoursPerWeek: "38,5"}},
+		},
+		{
+			name:     "commas in a semicolon separated header",
+			filename: "users.csv",
+			data:     []byte("email;\"first name, given\";lastName\nanna@example.com;Anna;Berg\n"),
+			wantErr:  "unknown column first name, given",
+		},
+		{
+			name:     "headers with spaces, underscores, case and BOM",
+			filename: "USERS.CSV",
+			data:     []byte("\ufeffEmail,First Name,last_name, ROLE ,Vacation_Days_Per_Year\nanna@example.com,Anna,Berg,user,30\n"),
+			want:     []ImportRow{{Line: 2, Username: "anna@example.com", FirstName: "Anna", LastName: "Berg", Role: "user", VacationDaysPerYear: "30"}},
+		},
+		{
+			name:     "empty rows and columns without header",
+			filename: "users.csv",
+			data:     []byte("username,,lastName\nanna@example.com,ignored,Berg\n,,\nbernd@example.com\n"),
+			want: []ImportRow{
+				{Line: 2, Username: "anna@example.com", LastName: "Berg"},
+				{Line: 4, Username: "bernd@example.com"},
+			},
+		},
+		{
+			name:     "missing username column",
+			filename: "users.csv",
+			data:     []byte("firstName,lastName\nAnna,Berg\n"),
+			wantErr:  "column username is missing",
+		},
+		{
+			name:     "unsupported extension",
+			filename: "users.txt",
+			data:     []byte("username\nanna@example.com\n"),
+			wantErr:  "only CSV and XLSX files can be imported",
+		},
+		{
+			name:     "shared strings",
+			filename: "users.xlsx",
+			data: xlsxFile(t, `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>`+
+				`<row r="2"><c r="A2" t="s"><v>2</v></c><c r="B2" t="s"><v>3</v></c></row>`,
+				[]string{"username", "firstName", "anna@example.com", "Anna"}),
+			want: []ImportRow{{Line: 2, Username: "anna@example.com", FirstName: "Anna"}},
+		},
+		{
+			name:     "inline strings and numbers",
+			filename: "users.xlsx",
+			data: xlsxFile(t, `<row r="1"><c r="A1" t="inlineStr"><is><t>username</t></is></c><c r="B1" t="inlineStr"><is><r><t>vacation</t></r><r><t>DaysPerYear</t></r></is></c></row>`+
+				`<row r="2"><c r="A2" t="inlineStr"><is><t>anna@example.com</t></is></c><c r="B2"><v>30</v></c></row>`, nil),
+			want: []ImportRow{{Line: 2, Username: "anna@example.com", VacationDaysPerYear: "30"}},
+		},
+		{
+			name:     "column gaps",
+			filename: "users.xlsx",
+			data: xlsxFile(t, `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="s"><v>1</v></c></row>`+
+				`<row r="3"><c r="C3" t="s"><v>3</v></c><c r="A3" t="s"><v>2</v></c></row>`,
+				[]string{"username", "lastName", "anna@example.com", "Berg"}),
+			want: []ImportRow{{Line: 3, Username: "anna@example.com", LastName: "Berg"}},
+		},
+		{
+			name:     "shared string out of range",
+			filename: "users.xlsx",
+			data:     xlsxFile(t, `<row r="1"><c r="A1" t="s"><v>5</v></c></row>`, []string{"username"}),
+			wantErr:  "file is not a valid XLSX file",
+		},
+		{
+			name:     "not a zip file",
+			filename: "users.xlsx",
+			data:     []byte("username\nanna@example.com\n"),
+			wantErr:  "file is not a valid XLSX file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, err := ReadImportFile(test.filename, bytes.NewReader(test.data))
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if !reflect.DeepEqual(rows, test.want) {
+				t.Fatalf("got %+v, want %+v", rows, test.want)
+			}
+		})
+	}
+}
+
+func TestReadXLSXPartLimitsSize(t *testing.T) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	w, err := archive.Create("xl/workbook.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compresses to a few kilobytes, but unpacks beyond the limit
+	_, err = w.Write([]byte("<workbook>" + strings.Repeat(" ", maxXLSXPartSize) + "</workbook>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var workbook xlsxWorkbook
+	err = readXLSXPart(reader, "xl/workbook.xml", &workbook)
+	if err == nil || err.Error() != "file is too large" {
+		t.Fatalf("got error %v, want file is too large", err)
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	tests := []struct {
+		reference string
+		want      int
+	}{
+		{"A1", 0},
+		{"C12", 2},
+		{"Z3", 25},
+		{"AA7", 26},
+		{"AB1", 27},
+		{"", -1},
+		{"12", -1},
+	}
+	for _, test := range tests {
+		got := xlsxColumn(test.reference)
+		if got != test.want {
+			t.Errorf("xlsxColumn(%q) = %d, want %d", test.reference, got, test.want)
+		}
+	}
+}
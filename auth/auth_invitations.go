@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// inviteUser creates the invitation of a new user and emails it
+func (a *AuthService) inviteUser(user *User, actor audit.Actor) error {
+	invitation := Invitation{
+		Id:         primitive.NewObjectID().Hex(),
+		UserId:     user.Id,
+		Username:   user.Username,
+		InvitedBy:  actor.UserId,
+		InsertedAt: time.Now(),
+	}
+	token, err := a.renewInvitation(&invitation)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.CreateInvitation(invitation)
+	if err != nil {
+		return err
+	}
+	a.record(actor, audit.InvitationSent, user.Id, nil, invitation)
+	return a.sendInvitation(user, token)
+}
+
+// renewInvitation signs a new token for the invitation, which replaces the link of earlier emails
+func (a *AuthService) renewInvitation(invitation *Invitation) (string, error) {
+	expires := time.Now().Add(time.Duration(a.config.Invitation.Hours) * time.Hour)
+	token, err := a.generateJWTToken(TokenClaims{
+		Username:  invitation.Username,
+		TokenType: InvitationToken,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        invitation.Id,
+			Subject:   invitation.UserId,
+			Issuer:    a.config.JWTIssuer,
+			Audience:  jwt.ClaimStrings{a.config.JWTAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	invitation.TokenHash = hashToken(token)
+	invitation.State = InvitationSent
+	invitation.Expires = expires
+	invitation.DeleteAt = a.invitationDeleteAt(expires)
+	invitation.SentAt = time.Now()
+	invitation.SendCount++
+	invitation.OpenedAt = time.Time{}
+	return token, nil
+}
+
+// invitationDeleteAt returns when an invitation that is closed at the time is removed
+func (a *AuthService) invitationDeleteAt(closed time.Time) time.Time {
+	return closed.AddDate(0, 0, a.config.Invitation.RetentionDays)
+}
+
+func (a *AuthService) sendInvitation(user *User, token string) error {
+	link, err := url.Parse(a.config.Invitation.URL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	body := fmt.Sprintf("You have been invited to create an account for %s.\n\nOpen this link to choose your password: %s\n\nThe link is valid for %d hours.", user.Username, link.String(), a.config.Invitation.Hours)
+	err = a.EmailSender.SendEmail(user.Username, "Your invitation", body)
+	if err != nil {
+		return errors.New("invitation could not be sent, please resend it")
+	}
+	return nil
+}
+
+// withCurrentState reports open invitations whose link is over as expired
+func withCurrentState(invitation Invitation) Invitation {
+	if (invitation.State == InvitationSent || invitation.State == InvitationOpened) && invitation.Expires.Before(time.Now()) {
+		invitation.State = InvitationExpired
+	}
+	return invitation
+}
+
+// GetOpenInvitations returns the invitations that weren't accepted yet
+func (a *AuthService) GetOpenInvitations() ([]Invitation, error) {
+	invitations, err := a.AuthDbService.GetOpenInvitations()
+	if err != nil {
+		return nil, err
+	}
+	for i := range invitations {
+		invitations[i] = withCurrentState(invitations[i])
+	}
+	return invitations, nil
+}
+
+// ResendInvitation emails a new link with a new expiry, the links of earlier emails stop working
+func (a *AuthService) ResendInvitation(invitationId string, actor audit.Actor) error {
+	invitation, err := a.AuthDbService.GetInvitationById(invitationId)
+	if err != nil {
+		return errors.New("Invitation not found")
+	}
+	if invitation.State == InvitationAccepted {
+		return errors.New("Invitation was already accepted")
+	}
+	user, err := a.AuthDbService.GetUserbyId(invitation.UserId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	before := *invitation
+	token, err := a.renewInvitation(invitation)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.UpdateInvitation(invitation.Id, bson.M{
+		"tokenHash": invitation.TokenHash,
+		"state":     invitation.State,
+		"expires":   invitation.Expires,
+		"deleteAt":  invitation.DeleteAt,
+		"sentAt":    invitation.SentAt,
+		"sendCount": invitation.SendCount,
+		"openedAt":  invitation.OpenedAt,
+	})
+	if err != nil {
+		return err
+	}
+	a.record(actor, audit.InvitationSent, user.Id, before, *invitation)
+	return a.sendInvitation(user, token)
+}
+
+// InviteUserAgain sends a new invitation to a user that never accepted one. Closed
+// invitations are removed after their retention, this brings their users back in.
+func (a *AuthService) InviteUserAgain(userId string, actor audit.Actor) error {
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	if user.State != NEW || user.Type == ServiceAccountType || user.AuthSource != "" {
+		return errors.New("only new users can be invited")
+	}
+	// The new invitation replaces all earlier ones
+	err = a.AuthDbService.DeleteInvitationsByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	return a.inviteUser(user, actor)
+}
+
+// RevokeInvitation makes the link of an invitation unusable
+func (a *AuthService) RevokeInvitation(invitationId string, actor audit.Actor) error {
+	invitation, err := a.AuthDbService.GetInvitationById(invitationId)
+	if err != nil {
+		return errors.New("Invitation not found")
+	}
+	if invitation.State == InvitationAccepted {
+		return errors.New("Invitation was already accepted")
+	}
+	err = a.AuthDbService.UpdateInvitation(invitation.Id, bson.M{"state": InvitationRevoked, "deleteAt": a.invitationDeleteAt(time.Now())})
+	if err != nil {
+		return err
+	}
+	after := *invitation
+	after.State = InvitationRevoked
+	a.record(actor, audit.InvitationRevoked, invitation.UserId, *invitation, after)
+	return nil
+}
+
+// verifyInvitation returns the open invitation of the token
+func (a *AuthService) verifyInvitation(token string) (*Invitation, error) {
+	claims, err := a.ParseToken(token)
+	if err != nil || claims.TokenType != InvitationToken {
+		return nil, errors.New("invitation is invalid or expired")
+	}
+	invitation, err := a.AuthDbService.GetInvitationById(claims.ID)
+	if err != nil || invitation.TokenHash != hashToken(token) {
+		return nil, errors.New("invitation is invalid or expired")
+	}
+	if invitation.State != InvitationSent && invitation.State != InvitationOpened {
+		return nil, errors.New("invitation is invalid or expired")
+	}
+	return invitation, nil
+}
+
+// OpenInvitation marks the invitation as opened and returns it, so the frontend can greet the user
+func (a *AuthService) OpenInvitation(token string) (*Invitation, error) {
+	invitation, err := a.verifyInvitation(token)
+	if err != nil {
+		return nil, err
+	}
+	if invitation.State == InvitationSent {
+		invitation.State = InvitationOpened
+		invitation.OpenedAt = time.Now()
+		err = a.AuthDbService.UpdateInvitation(invitation.Id, bson.M{"state": invitation.State, "openedAt": invitation.OpenedAt})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation sets the first password of the invited user and activates the user
+func (a *AuthService) AcceptInvitation(token, newPassword string, client ClientInfo) error {
+	invitation, err := a.verifyInvitation(token)
+	if err != nil {
+		return err
+	}
+	user, err := a.AuthDbService.GetUserbyId(invitation.UserId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	if user.State != NEW {
+		return errors.New("User is already activated")
+	}
+	// The invitation stays open if the password is rejected by the policy
+	err = a.validateNewPassword(user, newPassword)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := a.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	// Only one of two concurrent requests with the same link gets here
+	_, err = a.AuthDbService.AcceptInvitation(invitation.Id, invitation.TokenHash, a.invitationDeleteAt(time.Now()))
+	if err == mongo.ErrNoDocuments {
+		return errors.New("invitation is invalid or expired")
+	}
+	if err != nil {
+		return err
+	}
+	filter := bson.M{"username": user.Username}
+	update := bson.M{"$set": bson.M{"state": ACTIVE, "password": hashedPassword, "passwordHistory": a.passwordHistory(user), "oneTimePassword": nil, "updatedAt": time.Now()}}
+	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return err
+	}
+	a.AuthDbService.InvalidateCachedUser(user.Id)
+	a.record(actorFromClient(user, client), audit.UserActivated, user.Id, nil, nil)
+	return nil
+}
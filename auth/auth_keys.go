@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/R3PTR/go-auth-api/database"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	// iat is written with milliseconds, so revoking a user also catches the tokens of the same second
+	jwt.TimePrecision = time.Millisecond
+}
+
+// signingKey is a private key used to sign JWTs. A key signs new tokens until
+// RetiresAt and is published for verification until ExpiresAt.
+type signingKey struct {
+	Kid        string    `bson:"_id" json:"kid"`
+	Algorithm  string    `bson:"algorithm" json:"algorithm"`
+	PrivateKey string    `bson:"privateKey" json:"private_key"`
+	CreatedAt  time.Time `bson:"createdAt" json:"created_at"`
+	RetiresAt  time.Time `bson:"retiresAt" json:"retires_at"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expires_at"`
+	signer     crypto.Signer
+}
+
+// KeyStore persists signing keys
+type KeyStore interface {
+	LoadKeys() ([]*signingKey, error)
+	SaveKey(key *signingKey) error
+	DeleteKey(kid string) error
+}
+
+// mongoKeyStore stores signing keys in MongoDB
+type mongoKeyStore struct {
+	mongoClient *database.MongoDBClient
+}
+
+func (m *mongoKeyStore) LoadKeys() ([]*signingKey, error) {
+	var keys []*signingKey
+	cursor, err := m.mongoClient.GetCollection(m.mongoClient.Config.UserDatabase, m.mongoClient.Config.KeyCollection).Find(context.Background(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		key := &signingKey{}
+		err := cursor.Decode(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *mongoKeyStore) SaveKey(key *signingKey) error {
+	_, err := m.mongoClient.GetCollection(m.mongoClient.Config.UserDatabase, m.mongoClient.Config.KeyCollection).InsertOne(context.Background(), key)
+	return err
+}
+
+func (m *mongoKeyStore) DeleteKey(kid string) error {
+	_, err := m.mongoClient.GetCollection(m.mongoClient.Config.UserDatabase, m.mongoClient.Config.KeyCollection).DeleteOne(context.Background(), bson.M{"_id": kid})
+	return err
+}
+
+// fileKeyStore stores every signing key as a JSON file in a directory
+type fileKeyStore struct {
+	directory string
+}
+
+func (f *fileKeyStore) LoadKeys() ([]*signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(f.directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*signingKey
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key := &signingKey{}
+		err = json.Unmarshal(content, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file %s: %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (f *fileKeyStore) SaveKey(key *signingKey) error {
+	err := os.MkdirAll(f.directory, 0700)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(key, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(f.directory, key.Kid+".json"), content, 0600)
+}
+
+func (f *fileKeyStore) DeleteKey(kid string) error {
+	err := os.Remove(filepath.Join(f.directory, kid+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// KeyManager signs and verifies JWTs with rotating asymmetric keys
+type KeyManager struct {
+	store    KeyStore
+	config   *config.Config
+	mu       sync.RWMutex
+	keys     []*signingKey
+	rotation time.Duration
+	grace    time.Duration
+}
+
+// NewKeyManager creates a KeyManager that stores its keys on disk if a key
+// directory is configured and in MongoDB otherwise
+func NewKeyManager(mongoClient *database.MongoDBClient, config *config.Config) (*KeyManager, error) {
+	if config.JWTSigningAlgorithm != jwt.SigningMethodRS256.Alg() && config.JWTSigningAlgorithm != jwt.SigningMethodEdDSA.Alg() {
+		return nil, fmt.Errorf("unsupported signing algorithm %s", config.JWTSigningAlgorithm)
+	}
+	var store KeyStore = &mongoKeyStore{mongoClient: mongoClient}
+	if config.JWTKeyDirectory != "" {
+		store = &fileKeyStore{directory: config.JWTKeyDirectory}
+	}
+	return &KeyManager{
+		store:    store,
+		config:   config,
+		rotation: time.Hour * time.Duration(config.JWTKeyRotationHours),
+		grace:    time.Hour * time.Duration(config.JWTKeyGraceHours),
+	}, nil
+}
+
+// Start loads the keys, creates a signing key if necessary and keeps rotating them
+func (k *KeyManager) Start() error {
+	err := k.Rotate()
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := k.Rotate()
+			if err != nil {
+				fmt.Println("Error rotating signing keys:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Rotate reloads the keys from the store, creates a new signing key once the
+// current one retires and deletes keys whose grace period is over
+func (k *KeyManager) Rotate() error {
+	keys, err := k.store.LoadKeys()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var active []*signingKey
+	for _, key := range keys {
+		if key.ExpiresAt.Before(now) {
+			err := k.store.DeleteKey(key.Kid)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := key.parse()
+		if err != nil {
+			return err
+		}
+		active = append(active, key)
+	}
+	if !hasSigningKey(active, now) {
+		key, err := k.generateKey(now)
+		if err != nil {
+			return err
+		}
+		err = k.store.SaveKey(key)
+		if err != nil {
+			return err
+		}
+		active = append(active, key)
+	}
+	// Newest keys first
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].CreatedAt.After(active[j].CreatedAt)
+	})
+	k.mu.Lock()
+	k.keys = active
+	k.mu.Unlock()
+	return nil
+}
+
+func hasSigningKey(keys []*signingKey, now time.Time) bool {
+	for _, key := range keys {
+		if key.RetiresAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KeyManager) generateKey(now time.Time) (*signingKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch k.config.JWTSigningAlgorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{
+		Kid:        primitive.NewObjectID().Hex(),
+		Algorithm:  k.config.JWTSigningAlgorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:  now,
+		RetiresAt:  now.Add(k.rotation),
+		ExpiresAt:  now.Add(k.rotation + k.grace),
+		signer:     signer,
+	}, nil
+}
+
+// parse decodes the PEM encoded private key
+func (s *signingKey) parse() error {
+	if s.signer != nil {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(s.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("key %s is not PEM encoded", s.Kid)
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("key %s is not a signing key", s.Kid)
+	}
+	s.signer = signer
+	return nil
+}
+
+func (s *signingKey) signingMethod() jwt.SigningMethod {
+	if s.Algorithm == jwt.SigningMethodEdDSA.Alg() {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// Sign signs the claims with the newest signing key
+func (k *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.RetiresAt.After(now) {
+			token := jwt.NewWithClaims(key.signingMethod(), claims)
+			token.Header["kid"] = key.Kid
+			return token.SignedString(key.signer)
+		}
+	}
+	return "", errors.New("no signing key available")
+}
+
+// Keyfunc returns the public key referenced by the kid header of a token
+func (k *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no kid")
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Kid == kid {
+			if key.Algorithm != token.Method.Alg() {
+				return nil, errors.New("token algorithm does not match the key")
+			}
+			return key.signer.Public(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown kid %s", kid)
+}
+
+// Algorithms returns the algorithms accepted for verification
+func (k *KeyManager) Algorithms() []string {
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of all keys that are still valid for verification
+func (k *KeyManager) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{Use: "sig", Alg: key.Algorithm, Kid: key.Kid}
+		switch publicKey := key.signer.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPBackend authenticates users with a bind against an LDAP directory or Active Directory
+type LDAPBackend struct {
+	config config.LDAPConfig
+}
+
+func NewLDAPBackend(config config.LDAPConfig) *LDAPBackend {
+	return &LDAPBackend{config: config}
+}
+
+func (l *LDAPBackend) Name() string {
+	return l.config.Name
+}
+
+func (l *LDAPBackend) ProvisionUsers() bool {
+	return l.config.JITProvisioning
+}
+
+// Authenticate binds as the user with every DN template until one is accepted and
+// reads the names, email and groups of the user with the same connection
+func (l *LDAPBackend) Authenticate(username, password string) (*BackendAccount, error) {
+	// An empty password would be an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	bound := false
+	for _, template := range l.config.UserDNTemplates {
+		bindDN := strings.ReplaceAll(template, "{username}", ldap.EscapeDN(username))
+		err = conn.Bind(bindDN, password)
+		if err == nil {
+			bound = true
+			break
+		}
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, err
+		}
+	}
+	if !bound {
+		return nil, ErrInvalidCredentials
+	}
+	account := &BackendAccount{Username: username}
+	entry, err := l.searchUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	if entry != nil {
+		account.FirstName = entry.GetAttributeValue(l.config.FirstNameAttribute)
+		account.LastName = entry.GetAttributeValue(l.config.LastNameAttribute)
+		account.Email = entry.GetAttributeValue(l.config.EmailAttribute)
+		groups = entry.GetAttributeValues(l.config.GroupAttribute)
+	}
+	account.Role = l.mapRole(groups)
+	return account, nil
+}
+
+// dial connects to the directory, upgrading plain connections with StartTLS if configured
+func (l *LDAPBackend) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: l.config.InsecureSkipVerify}
+	parsed, err := url.Parse(l.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = parsed.Hostname()
+	timeout := time.Duration(l.config.TimeoutSeconds) * time.Second
+	conn, err := ldap.DialURL(l.config.URL, ldap.DialWithTLSConfig(tlsConfig), ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if l.config.StartTLS && parsed.Scheme == "ldap" {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// searchUser returns the entry of the user, or nil if the bound user can't see it
+func (l *LDAPBackend) searchUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	if l.config.BaseDN == "" {
+		return nil, nil
+	}
+	request := ldap.NewSearchRequest(
+		l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, l.config.TimeoutSeconds, false,
+		strings.ReplaceAll(l.config.UserFilter, "{username}", ldap.EscapeFilter(username)),
+		[]string{l.config.FirstNameAttribute, l.config.LastNameAttribute, l.config.EmailAttribute, l.config.GroupAttribute},
+		nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	if len(result.Entries) > 1 {
+		return nil, errors.New("user filter matches more than one entry")
+	}
+	return result.Entries[0], nil
+}
+
+// mapRole returns the role of the first configured group the user is a member of
+func (l *LDAPBackend) mapRole(groups []string) string {
+	for _, mapping := range l.config.GroupRoles {
+		for _, group := range groups {
+			// DNs are compared case-insensitively, like the directory does
+			if strings.EqualFold(group, mapping.Group) {
+				return mapping.Role
+			}
+		}
+	}
+	return l.config.DefaultRole
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// systemActor is the actor of changes made by background jobs
+var systemActor = audit.Actor{Username: "system"}
+
+// SuspendUser locks the user out until the user is restored
+func (a *AuthService) SuspendUser(userId, reason string, actor audit.Actor) error {
+	return a.setUserState(userId, SUSPENDED, reason, audit.UserSuspended, actor)
+}
+
+// DisableUser deactivates the user, for example after leaving the company
+func (a *AuthService) DisableUser(userId, reason string, actor audit.Actor) error {
+	return a.setUserState(userId, DISABLED, reason, audit.UserDisabled, actor)
+}
+
+// DeleteOtherUser deletes the user, who can be restored until the retention period is over
+func (a *AuthService) DeleteOtherUser(userId, reason string, actor audit.Actor) error {
+	return a.setUserState(userId, DELETED, reason, audit.UserDeleted, actor)
+}
+
+// setUserState moves a user into a state that blocks login and revokes every token of the user
+func (a *AuthService) setUserState(userId, state, reason, action string, actor audit.Actor) error {
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	if user.Type == ServiceAccountType {
+		return errors.New("User not found")
+	}
+	if user.State == DELETED {
+		return errors.New("User is deleted")
+	}
+	// Nobody can lock out users with permissions they don't have themselves
+	err = a.checkRoleCovered(user.Role, actor)
+	if err != nil {
+		return err
+	}
+	if user.State == state {
+		return nil
+	}
+	now := time.Now()
+	fields := bson.M{"state": state, "stateReason": reason, "stateChangedAt": now}
+	if state == DELETED {
+		fields["deletedAt"] = now
+	}
+	err = a.AuthDbService.UpdateUserFields(userId, fields)
+	if err != nil {
+		return err
+	}
+	after := *user
+	after.State = state
+	after.StateReason = reason
+	after.StateChangedAt = now
+	if state == DELETED {
+		after.DeletedAt = now
+	}
+	a.record(actor, action, userId, *user, after)
+	// Pending links must not bring the user back in
+	err = a.AuthDbService.DeletePasswordResetsByUserId(userId)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteEmailChangesByUserId(userId)
+	if err != nil {
+		return err
+	}
+	return a.revokeUserTokens(userId)
+}
+
+// RestoreUser reactivates a suspended, disabled or deleted user. Users that never
+// accepted their invitation go back to NEW.
+func (a *AuthService) RestoreUser(userId string, actor audit.Actor) error {
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	if user.Type == ServiceAccountType {
+		return errors.New("User not found")
+	}
+	if user.State != SUSPENDED && user.State != DISABLED && user.State != DELETED {
+		return errors.New("User is not suspended, disabled or deleted")
+	}
+	if !user.PurgedAt.IsZero() {
+		return errors.New("User was purged and can't be restored")
+	}
+	err = a.checkRoleCovered(user.Role, actor)
+	if err != nil {
+		return err
+	}
+	state := ACTIVE
+	if user.Password == "" && user.AuthSource == "" {
+		state = NEW
+	}
+	err = a.AuthDbService.UpdateUserFields(userId, bson.M{"state": state, "stateReason": nil, "stateChangedAt": time.Now(), "deletedAt": nil})
+	if err != nil {
+		return err
+	}
+	after := *user
+	after.State = state
+	after.StateReason = ""
+	after.DeletedAt = time.Time{}
+	a.record(actor, audit.UserRestored, userId, *user, after)
+	return nil
+}
+
+// GetDeletedUsers returns the deleted users that can still be restored
+func (a *AuthService) GetDeletedUsers() ([]DeletedUser, error) {
+	users, err := a.AuthDbService.GetDeletedUsers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].RestorableUntil = users[i].DeletedAt.AddDate(0, 0, a.config.UserLifecycle.RetentionDays)
+	}
+	return users, nil
+}
+
+// StartPurge anonymizes deleted users once their retention period is over and keeps doing so in the background
+func (a *AuthService) StartPurge() error {
+	err := a.PurgeDeletedUsers()
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(a.config.UserLifecycle.PurgeIntervalMinutes) * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := a.PurgeDeletedUsers()
+			if err != nil {
+				fmt.Println("Error purging deleted users:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// PurgeDeletedUsers anonymizes every user whose retention period is over. A user that
+// can't be purged doesn't hold up the others, the errors are returned together.
+func (a *AuthService) PurgeDeletedUsers() error {
+	users, err := a.AuthDbService.GetUsersToPurge(time.Now().AddDate(0, 0, -a.config.UserLifecycle.RetentionDays))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, user := range users {
+		err := a.purgeUser(&user, systemActor)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", user.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// purgeUser removes the personal data of a deleted user. The document stays, so
+// the audit log still points at a user, but nobody can tell who it was.
+func (a *AuthService) purgeUser(user *User, actor audit.Actor) error {
+	err := a.AuthDbService.UpdateUserFields(user.Id, bson.M{
+		"username":        "deleted-" + user.Id,
+		"firstName":       "",
+		"lastName":        "",
+		"password":        "",
+		"passwordHistory": nil,
+		"oneTimePassword": nil,
+		"personnelnumber": nil,
+		"totpSecret":      nil,
+		"totpActive":      false,
+		"backupCodes":     nil,
+		"authSource":      nil,
+		"stateReason":     nil,
+		"purgedAt":        time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteWebAuthnCredentialsByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteExternalIdentitiesByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteAPIKeysByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteInvitationsByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteEmailChangesByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+	for _, hook := range a.purgeHooks {
+		err = hook(user.Id, actor)
+		if err != nil {
+			return err
+		}
+	}
+	a.record(actor, audit.UserPurged, user.Id, nil, nil)
+	return nil
+}
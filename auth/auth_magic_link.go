@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
+)
+
+// RequestMagicLink emails a single-use login link to the user. Unknown users and
+// users whose role doesn't allow magic links get the same response without an email.
+func (a *AuthService) RequestMagicLink(username string, client ClientInfo) error {
+	err := a.throttlingService.Check(throttling.MagicLink, username, client.IP)
+	if err != nil {
+		return err
+	}
+	// Every request counts, so the inbox of a user can't be flooded
+	_, err = a.throttlingService.RegisterFailure(throttling.MagicLink, username, client.IP)
+	if err != nil {
+		return err
+	}
+	user, err := a.AuthDbService.GetUserbyUsername(username)
+	if err != nil {
+		return nil
+	}
+	if user.Type == ServiceAccountType || user.State != ACTIVE || !a.roleService.AllowsMagicLink(user.Role) {
+		return nil
+	}
+	expires := time.Now().Add(time.Duration(a.config.MagicLink.Minutes) * time.Minute)
+	token, err := a.issueToken(user, MagicLinkToken, "", expires, false, false)
+	if err != nil {
+		return err
+	}
+	a.record(actorFromClient(nil, client), audit.MagicLinkRequested, user.Id, nil, nil)
+	link, err := url.Parse(a.config.MagicLink.URL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token.Token)
+	link.RawQuery = query.Encode()
+	body := fmt.Sprintf("Open this link to log in: %s\n\nThe link is valid for %d minutes and can only be used once. If you didn't request it, you can ignore this email.", link.String(), a.config.MagicLink.Minutes)
+	return a.EmailSender.SendEmail(user.Username, "Your login link", body)
+}
+
+// VerifyMagicLink exchanges the token of a magic link for a LoginToken, or for a
+// TwoFactorToken if the user has a second factor
+func (a *AuthService) VerifyMagicLink(tokenString string, client ClientInfo) (*tokenModel, error) {
+	claims, err := a.ParseToken(tokenString)
+	if err != nil || claims.TokenType != MagicLinkToken {
+		return nil, errors.New("link is invalid or expired")
+	}
+	// Deleting the token makes the link single-use, even if it is opened twice at the same time
+	_, err = a.AuthDbService.UseToken(tokenString, MagicLinkToken)
+	if err != nil {
+		return nil, errors.New("link is invalid or expired")
+	}
+	user, err := a.AuthDbService.GetUserbyId(claims.Subject)
+	if err != nil {
+		return nil, errors.New("link is invalid or expired")
+	}
+	// The role may have lost magic links since the link was sent
+	if user.State != ACTIVE || !a.roleService.AllowsMagicLink(user.Role) {
+		return nil, errors.New("link is invalid or expired")
+	}
+	if user.TotpActive || a.hasPasskeys(user) {
+		return a.issueToken(user, TwoFactorToken, "", time.Now().Add(time.Minute*5), true, false)
+	}
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueLoginTokens(user, "", false, client)
+}
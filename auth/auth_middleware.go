@@ -3,11 +3,10 @@ package auth
 
 import (
 	"errors"
-	"fmt"
 	"slices"
 	"strings"
-	"time"
 
+	"github.com/R3PTR/go-auth-api/audit"
 	"github.com/R3PTR/go-auth-api/database"
 	"github.com/gin-gonic/gin"
 )
@@ -22,7 +21,13 @@ func NewMiddleware(mongoClient *database.MongoDBClient, authDbService *AuthDbSer
 	return &AuthMiddleware{mongoClient: mongoClient, AuthDbService: authDbService, AuthService: authService}
 }
 
-func (AuthMiddleware *AuthMiddleware) AuthMiddleware(roleRequired, tokenTypesAllowed []string) gin.HandlerFunc {
+// AuthMiddleware verifies the JWT locally. Only the in-memory revocation list is
+// checked per request, the user is loaded through the user cache. The role of the
+// user has to grant the permission, an empty permission only requires a valid token.
+// API keys are accepted if APIKeyToken is allowed and one of their scopes is the permission.
+// Routes that allow ImpersonationToken run as the impersonated user with the admin as actor,
+// so password and 2FA routes never allow it.
+func (AuthMiddleware *AuthMiddleware) AuthMiddleware(permission string, tokenTypesAllowed []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		header := c.GetHeader("Authorization")
 		jwt_token, err := ExtractToken(header)
@@ -30,82 +35,88 @@ func (AuthMiddleware *AuthMiddleware) AuthMiddleware(roleRequired, tokenTypesAll
 			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
 			return
 		}
-		fmt.Println(jwt_token)
-		token_model, err := AuthMiddleware.AuthDbService.GetTokenByToken(jwt_token)
+		if IsAPIKey(jwt_token) {
+			AuthMiddleware.authenticateAPIKey(c, jwt_token, permission, tokenTypesAllowed)
+			return
+		}
+		claims, err := AuthMiddleware.AuthService.ParseToken(jwt_token)
 		if err != nil {
 			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
 			return
 		}
-		if token_model.Expires.Before(time.Now()) {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Token expired"})
+		if !slices.Contains(tokenTypesAllowed, claims.TokenType) {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
 			return
 		}
-		user, err := AuthMiddleware.AuthDbService.GetUserbyId(token_model.UserId)
+		user, err := AuthMiddleware.AuthDbService.GetCachedUserbyId(claims.Subject)
 		if err != nil {
 			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
 			return
 		}
-		if !slices.Contains(roleRequired, user.Role) {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+		if user.State != ACTIVE {
+			c.AbortWithStatusJSON(401, gin.H{"error": "User is not active"})
 			return
 		}
-		if !slices.Contains(tokenTypesAllowed, token_model.TokenType) {
+		if permission != "" && !AuthMiddleware.AuthService.roleService.HasPermission(user.Role, permission) {
 			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
 			return
 		}
+		actor := audit.Actor{UserId: user.Id, Username: user.Username, Role: user.Role}
+		if claims.TokenType == ImpersonationToken {
+			// The route sees the impersonated user, the audit log sees the admin
+			impersonator, err := AuthMiddleware.AuthService.resolveImpersonator(claims, user)
+			if err != nil {
+				c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+				return
+			}
+			actor = audit.Actor{UserId: impersonator.Id, Username: impersonator.Username, Role: impersonator.Role}
+			c.Set("impersonator", impersonator)
+			AuthMiddleware.AuthService.recordImpersonatedRequest(actorFromClient(impersonator, ClientInfoFromContext(c)), user, c.Request.Method, c.FullPath())
+		}
+		AuthMiddleware.AuthService.TouchSession(claims.FamilyId, ClientInfoFromContext(c))
 		c.Set("user", user)
-		c.Set("token", token_model)
+		c.Set("actor", actor)
+		c.Set("token", tokenFromClaims(jwt_token, claims))
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
 
-// Middleware for Methods that require Password Check
-func (AuthMiddleware *AuthMiddleware) PasswordMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		user_unasserted, exists := c.Get("user")
-		if !exists {
-			c.AbortWithStatusJSON(401, gin.H{"error": "User not found"})
-			return
-		}
-		user := user_unasserted.(*User)
-		password := c.GetHeader("Password")
-		if password == "" {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Password not provided"})
-			return
-		}
-		err := AuthMiddleware.AuthService.VerifyPassword(user, password)
-		if err != nil {
-			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
-			return
-		}
-		c.Next()
+// authenticateAPIKey handles requests that authenticate with an API key instead of a JWT.
+// Routes without a permission never accept API keys, a key can only do what its scopes name.
+func (AuthMiddleware *AuthMiddleware) authenticateAPIKey(c *gin.Context, key, permission string, tokenTypesAllowed []string) {
+	if permission == "" || !slices.Contains(tokenTypesAllowed, APIKeyToken) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+		return
 	}
+	apiKey, user, err := AuthMiddleware.AuthService.AuthenticateAPIKey(key)
+	if err != nil {
+		c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+		return
+	}
+	// The role of the owner still has to grant the scope, keys lose permissions together with their owner
+	if !apiKey.HasScope(permission) || !AuthMiddleware.AuthService.roleService.HasPermission(user.Role, permission) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Set("user", user)
+	c.Set("actor", audit.Actor{UserId: user.Id, Username: user.Username, Role: user.Role})
+	c.Set("apiKey", apiKey)
+	c.Next()
 }
 
-func (AuthMiddleware *AuthMiddleware) TOTPMiddleware() gin.HandlerFunc {
+// ReauthenticationMiddleware guards sensitive routes. The user has to confirm the
+// credentials with /auth/reauthenticate shortly before, so no password is sent in headers.
+func (AuthMiddleware *AuthMiddleware) ReauthenticationMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user_unasserted, exists := c.Get("user")
+		claims_unasserted, exists := c.Get("claims")
 		if !exists {
-			c.AbortWithStatusJSON(401, gin.H{"error": "User not found"})
-			return
-		}
-		user := user_unasserted.(*User)
-		if !user.TotpActive {
-			c.AbortWithStatusJSON(401, gin.H{"error": "TOTP not activated"})
-			return
-		}
-		totp := c.GetHeader("TOTP")
-		if totp == "" {
-			c.AbortWithStatusJSON(401, gin.H{"error": "TOTP not provided"})
-			return
-		}
-		correct, error := AuthMiddleware.AuthService.VerifyTOTP(user, totp)
-		if error != nil {
-			c.AbortWithStatusJSON(401, gin.H{"error": error.Error()})
+			c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
 			return
 		}
-		if !correct {
-			c.AbortWithStatusJSON(401, gin.H{"error": "TOTP not valid"})
+		claims := claims_unasserted.(*TokenClaims)
+		if !AuthMiddleware.AuthService.RecentlyAuthenticated(claims.FamilyId) {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Re-authentication required", "reauthentication_required": true})
 			return
 		}
 		c.Next()
@@ -1,7 +1,11 @@
 package auth
 
 import (
+	"encoding/json"
 	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type User struct {
@@ -10,6 +14,7 @@ type User struct {
 	LastName            string    `bson:"lastName"`
 	Username            string    `bson:"username"`
 	Password            string    `bson:"password"`
+	PasswordHistory     []string  `bson:"passwordHistory,omitempty"`
 	OneTimePassword     string    `bson:"oneTimePassword,omitempty"`
 	Role                string    `bson:"role"`
 	State               string    `bson:"state"`
@@ -22,7 +27,32 @@ type User struct {
 	BackupCodes         []string  `bson:"backupCodes,omitempty"`
 	InsertedAt          time.Time `bson:"insertedAt"`
 	UpdatedAt           time.Time `bson:"updatedAt"`
-	ResetValidUntil     time.Time `bson:"resetValidUntil,omitempty"`
+	// AuthSource is the credential backend of directory users, empty for local users
+	AuthSource string `bson:"authSource,omitempty"`
+	// Type is ServiceAccount for non-human principals, empty for humans
+	Type             string `bson:"type,omitempty"`
+	Description      string `bson:"description,omitempty"`
+	ClientSecretHash string `bson:"clientSecretHash,omitempty"`
+	// StateReason explains why the user was suspended, disabled or deleted
+	StateReason    string    `bson:"stateReason,omitempty"`
+	StateChangedAt time.Time `bson:"stateChangedAt,omitempty"`
+	DeletedAt      time.Time `bson:"deletedAt,omitempty"`
+	PurgedAt       time.Time `bson:"purgedAt,omitempty"`
+}
+
+// ServiceAccount is a non-human principal for backend jobs. It is stored in the user
+// collection, so API keys and tokens work the same, but has none of the human fields.
+type ServiceAccount struct {
+	Id               string    `bson:"_id,omitempty" json:"id"`
+	Name             string    `bson:"username" json:"name"`
+	Description      string    `bson:"description,omitempty" json:"description"`
+	Role             string    `bson:"role" json:"role"`
+	State            string    `bson:"state" json:"state"`
+	Type             string    `bson:"type" json:"-"`
+	ClientSecretHash string    `bson:"clientSecretHash" json:"-"`
+	CreatedBy        string    `bson:"createdBy" json:"createdBy"`
+	InsertedAt       time.Time `bson:"insertedAt" json:"insertedAt"`
+	UpdatedAt        time.Time `bson:"updatedAt" json:"updatedAt"`
 }
 
 type UserOutputAll struct {
@@ -36,6 +66,39 @@ type UserOutputAll struct {
 	VacationDaysPerYear int     `bson:"vacationDaysPerYear"`
 	TargetHoursPerWeek  float32 `bson:"targetHoursPerWeek"`
 	MaximumHoursPerWeek float32 `bson:"MaximumHoursPerWeek,omitempty"`
+	AuthSource          string  `bson:"authSource,omitempty"`
+	StateReason         string  `bson:"stateReason,omitempty"`
+}
+
+// DeletedUser is a deleted user that can still be restored
+type DeletedUser struct {
+	Id              string    `bson:"_id" json:"id"`
+	Username        string    `bson:"username" json:"username"`
+	FirstName       string    `bson:"firstName" json:"firstName"`
+	LastName        string    `bson:"lastName" json:"lastName"`
+	Role            string    `bson:"role" json:"role"`
+	StateReason     string    `bson:"stateReason,omitempty" json:"reason,omitempty"`
+	DeletedAt       time.Time `bson:"deletedAt" json:"deletedAt"`
+	RestorableUntil time.Time `bson:"-" json:"restorableUntil"`
+}
+
+// UserExport is the user record in a data export
+type UserExport struct {
+	Id                  string    `json:"id"`
+	Username            string    `json:"username"`
+	FirstName           string    `json:"firstName"`
+	LastName            string    `json:"lastName"`
+	Role                string    `json:"role"`
+	State               string    `json:"state"`
+	StateReason         string    `json:"stateReason,omitempty"`
+	Personnelnumber     string    `json:"personnelnumber,omitempty"`
+	VacationDaysPerYear int       `json:"vacationDaysPerYear"`
+	TargetHoursPerWeek  float32   `json:"targetHoursPerWeek"`
+	MaximumHoursPerWeek float32   `json:"maximumHoursPerWeek"`
+	TotpActive          bool      `json:"totpActive"`
+	AuthSource          string    `json:"authSource,omitempty"`
+	InsertedAt          time.Time `json:"insertedAt"`
+	UpdatedAt           time.Time `json:"updatedAt"`
 }
 
 type UserOutput struct {
@@ -50,6 +113,7 @@ type UserOutput struct {
 	TargetHoursPerWeek  float32 `bson:"targetHoursPerWeek"`
 	MaximumHoursPerWeek float32 `bson:"MaximumHoursPerWeek,omitempty"`
 	TotpActive          bool    `bson:"totpActive,omitempty"`
+	AuthSource          string  `bson:"authSource,omitempty"`
 }
 
 type tokenModel struct {
@@ -58,9 +122,182 @@ type tokenModel struct {
 	Requires2FA    bool      `bson:"requires2FA,omitempty"`
 	TwoFAConfirmed bool      `bson:"TwoFAConfirmed,omitempty"`
 	TokenType      string    `bson:"tokenType"`
+	FamilyId       string    `bson:"familyId,omitempty"`
+	Jti            string    `bson:"jti,omitempty"`
+	Used           bool      `bson:"used,omitempty"`
 	InsertedAt     time.Time `bson:"insertedAt"`
 	UpdatedAt      time.Time `bson:"updatedAt"`
 	Expires        time.Time `bson:"expires"`
+	// RefreshToken is only set on freshly issued access tokens and never stored
+	RefreshToken string `bson:"-"`
+}
+
+// Session is a login on one device, it lives as long as its refresh token family
+type Session struct {
+	Id         string    `bson:"_id" json:"id"`
+	UserId     string    `bson:"userId" json:"userId"`
+	UserAgent  string    `bson:"userAgent" json:"userAgent"`
+	IP         string    `bson:"ip" json:"ip"`
+	InsertedAt time.Time `bson:"insertedAt" json:"insertedAt"`
+	LastUsedAt time.Time `bson:"lastUsedAt" json:"lastUsedAt"`
+	Expires    time.Time `bson:"expires" json:"expires"`
+	// ReauthenticatedAt is when the user last confirmed the credentials in this session
+	ReauthenticatedAt time.Time `bson:"reauthenticatedAt,omitempty" json:"reauthenticatedAt,omitempty"`
+	Current           bool      `bson:"-" json:"current"`
+}
+
+// WebAuthnCredential is a passkey of a user
+type WebAuthnCredential struct {
+	Id         string              `bson:"_id" json:"id"`
+	UserId     string              `bson:"userId" json:"userId"`
+	Name       string              `bson:"name" json:"name"`
+	Credential webauthn.Credential `bson:"credential" json:"-"`
+	SignCount  uint32              `bson:"-" json:"signCount"`
+	InsertedAt time.Time           `bson:"insertedAt" json:"insertedAt"`
+	LastUsedAt time.Time           `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
+
+// webAuthnChallenge keeps the session data of a running WebAuthn ceremony until it is finished
+type webAuthnChallenge struct {
+	Id       string               `bson:"_id"`
+	Ceremony string               `bson:"ceremony"`
+	UserId   string               `bson:"userId,omitempty"`
+	Name     string               `bson:"name,omitempty"`
+	Session  webauthn.SessionData `bson:"session"`
+	Expires  time.Time            `bson:"expires"`
+}
+
+// ExternalIdentity links a user to an account at an external identity provider
+type ExternalIdentity struct {
+	Id         string    `bson:"_id" json:"id"`
+	UserId     string    `bson:"userId" json:"-"`
+	Provider   string    `bson:"provider" json:"provider"`
+	Subject    string    `bson:"subject" json:"subject"`
+	Email      string    `bson:"email,omitempty" json:"email,omitempty"`
+	InsertedAt time.Time `bson:"insertedAt" json:"insertedAt"`
+	LastUsedAt time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+}
+
+// externalLoginState remembers an authorization request to an external provider until its callback
+type externalLoginState struct {
+	Id           string    `bson:"_id"`
+	Provider     string    `bson:"provider"`
+	Ceremony     string    `bson:"ceremony"`
+	UserId       string    `bson:"userId,omitempty"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"codeVerifier"`
+	Expires      time.Time `bson:"expires"`
+}
+
+// passwordReset is a pending password reset, the id is the hash of the token of the emailed link
+type passwordReset struct {
+	Id         string    `bson:"_id"`
+	UserId     string    `bson:"userId"`
+	Expires    time.Time `bson:"expires"`
+	InsertedAt time.Time `bson:"insertedAt"`
+}
+
+// emailChange is a pending change of the username, the id is the hash of the token of the confirmation link
+type emailChange struct {
+	Id              string    `bson:"_id"`
+	CancelTokenHash string    `bson:"cancelTokenHash"`
+	UserId          string    `bson:"userId"`
+	OldEmail        string    `bson:"oldEmail"`
+	NewEmail        string    `bson:"newEmail"`
+	Expires         time.Time `bson:"expires"`
+	InsertedAt      time.Time `bson:"insertedAt"`
+}
+
+// Results of a row of a user import
+const (
+	ImportValid   = "VALID"
+	ImportCreated = "CREATED"
+	ImportFailed  = "FAILED"
+)
+
+// ImportRow is a row of an import file with the text of its cells, Line is the line in the file
+type ImportRow struct {
+	Line                int
+	Username            string
+	FirstName           string
+	LastName            string
+	Role                string
+	Personnelnumber     string
+	VacationDaysPerYear string
+	TargetHoursPerWeek  string
+	MaximumHoursPerWeek string
+}
+
+// ImportRowResult is the outcome of a row of a user import
+type ImportRowResult struct {
+	Line     int    `json:"line"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	UserId   string `json:"userId,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportReport is the outcome of a user import. Nothing is created unless every row is valid.
+type ImportReport struct {
+	DryRun  bool              `json:"dryRun"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// Invitation is the invitation of a new user to set a password. Expired states are not
+// stored, an invitation counts as expired once Expires is over and it wasn't accepted.
+type Invitation struct {
+	Id        string    `bson:"_id" json:"id"`
+	UserId    string    `bson:"userId" json:"userId"`
+	Username  string    `bson:"username" json:"username"`
+	TokenHash string    `bson:"tokenHash" json:"-"`
+	State     string    `bson:"state" json:"state"`
+	Expires   time.Time `bson:"expires" json:"expires"`
+	// DeleteAt is when MongoDB removes the invitation, a while after it expired or was closed
+	DeleteAt   time.Time `bson:"deleteAt" json:"-"`
+	SentAt     time.Time `bson:"sentAt" json:"sentAt"`
+	SendCount  int       `bson:"sendCount" json:"sendCount"`
+	OpenedAt   time.Time `bson:"openedAt,omitempty" json:"openedAt,omitempty"`
+	AcceptedAt time.Time `bson:"acceptedAt,omitempty" json:"acceptedAt,omitempty"`
+	InvitedBy  string    `bson:"invitedBy" json:"invitedBy"`
+	InsertedAt time.Time `bson:"insertedAt" json:"insertedAt"`
+}
+
+// APIKey is a named key for scripts and integrations that acts as its user, limited to its scopes.
+// Only the hash of the key is stored, the id is the public prefix of the key.
+type APIKey struct {
+	Id         string    `bson:"_id" json:"id"`
+	UserId     string    `bson:"userId" json:"userId"`
+	Name       string    `bson:"name" json:"name"`
+	KeyHash    string    `bson:"keyHash" json:"-"`
+	Scopes     []string  `bson:"scopes" json:"scopes"`
+	ExpiresAt  time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	LastUsedAt time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	CreatedBy  string    `bson:"createdBy" json:"createdBy"`
+	InsertedAt time.Time `bson:"insertedAt" json:"insertedAt"`
+}
+
+// ClientInfo describes the client a request came from
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// TokenClaims are the claims of every JWT issued by the AuthService
+type TokenClaims struct {
+	Username       string `json:"username"`
+	Role           string `json:"role"`
+	TokenType      string `json:"token_type"`
+	FamilyId       string `json:"fid,omitempty"`
+	TwoFAConfirmed bool   `json:"2fa,omitempty"`
+	// ClientId and Scope are only set on OIDC access tokens
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// ImpersonatorId is the admin behind an impersonation token
+	ImpersonatorId string `json:"imp,omitempty"`
+	jwt.RegisteredClaims
 }
 
 type CreateUserRequest struct {
@@ -79,12 +316,18 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-type ActivateUserRequest struct {
-	NewPassword string `json:"newPassword"`
+type OpenInvitationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type AcceptInvitationRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
 }
 
 type ResetPasswordRequest struct {
-	NewPassword string `json:"newPassword"`
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
 }
 
 type ChangePasswordRequest struct {
@@ -93,16 +336,60 @@ type ChangePasswordRequest struct {
 
 type DeleteOtherUserRequest struct {
 	UserId string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type ImpersonateRequest struct {
+	UserId string `json:"id" binding:"required"`
+	// Reason is recorded in the audit log, for example the support ticket
+	Reason string `json:"reason" binding:"required"`
+}
+
+type UserStateRequest struct {
+	Reason string `json:"reason" binding:"required"`
 }
 
 type ForgotPasswordRequest struct {
 	Username string `json:"username"`
 }
 
+type MagicLinkRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+type VerifyMagicLinkRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
 type ActivateTOTPRequest struct {
 	TOTP string `json:"totp"`
 }
 
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type VerifyTwoFactorRequest struct {
+	TOTP string `json:"totp"`
+}
+
+// ReauthenticateRequest confirms the credentials of the logged in user. Users with a
+// second factor send a TOTP or backup code, or a passkey assertion for a challenge.
+type ReauthenticateRequest struct {
+	Password  string          `json:"password"`
+	TOTP      string          `json:"totp"`
+	Challenge string          `json:"challenge"`
+	Passkey   json.RawMessage `json:"passkey"`
+}
+
+type BeginWebAuthnRegistrationRequest struct {
+	Name string `json:"name"`
+}
+
+type BeginWebAuthnLoginRequest struct {
+	Username string `json:"username,omitempty"`
+}
+
 type UpdateOtherUserRequest struct {
 	Id                  string  `json:"id,omitempty"`
 	Username            string  `json:"username,omitempty"`
@@ -120,3 +407,30 @@ type UpdateOwnUserRequest struct {
 	FirstName string `json:"firstName,omitempty"`
 	LastName  string `json:"lastName,omitempty"`
 }
+
+type EmailChangeTokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ExternalCallbackRequest struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string    `json:"name" binding:"required"`
+	Scopes    []string  `json:"scopes" binding:"required"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+type CreateServiceAccountRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Role        string `json:"role" binding:"required"`
+}
+
+type ClientCredentialsRequest struct {
+	GrantType    string `form:"grant_type"`
+	ClientId     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
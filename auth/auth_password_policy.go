@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/R3PTR/go-auth-api/config"
+)
+
+//go:embed breached_passwords.txt
+var breachedPasswordList string
+
+// PolicyViolation is a single rule a password did not satisfy
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a new password violated
+type PasswordPolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return "password does not meet the password policy: " + strings.Join(messages, ", ")
+}
+
+// PasswordPolicy validates new passwords against the configured rules
+type PasswordPolicy struct {
+	config   config.PasswordPolicyConfig
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy creates a PasswordPolicy with the bundled breached password list
+func NewPasswordPolicy(config config.PasswordPolicyConfig) *PasswordPolicy {
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(strings.NewReader(breachedPasswordList))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+	return &PasswordPolicy{config: config, breached: breached}
+}
+
+// Rules describes the active rules, so clients can show them before submitting
+func (p *PasswordPolicy) Rules() config.PasswordPolicyConfig {
+	return p.config
+}
+
+// Validate checks a password against all rules that don't need the password history
+func (p *PasswordPolicy) Validate(password string, user *User) []PolicyViolation {
+	var violations []PolicyViolation
+	if len([]rune(password)) < p.config.MinLength {
+		violations = append(violations, PolicyViolation{Rule: "min_length", Message: "must be at least " + strconv.Itoa(p.config.MinLength) + " characters long"})
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	if p.config.RequireUppercase && !hasUpper {
+		violations = append(violations, PolicyViolation{Rule: "uppercase", Message: "must contain an uppercase letter"})
+	}
+	if p.config.RequireLowercase && !hasLower {
+		violations = append(violations, PolicyViolation{Rule: "lowercase", Message: "must contain a lowercase letter"})
+	}
+	if p.config.RequireDigit && !hasDigit {
+		violations = append(violations, PolicyViolation{Rule: "digit", Message: "must contain a digit"})
+	}
+	if p.config.RequireSymbol && !hasSymbol {
+		violations = append(violations, PolicyViolation{Rule: "symbol", Message: "must contain a special character"})
+	}
+	if p.config.DisallowPersonalInfo && user != nil && containsPersonalInfo(password, user) {
+		violations = append(violations, PolicyViolation{Rule: "personal_info", Message: "must not contain your username or name"})
+	}
+	if p.config.CheckBreached {
+		if _, breached := p.breached[strings.ToLower(password)]; breached {
+			violations = append(violations, PolicyViolation{Rule: "breached", Message: "is a commonly used password that appeared in data breaches"})
+		}
+	}
+	return violations
+}
+
+// containsPersonalInfo checks the password for fragments of the username and the names of the user
+func containsPersonalInfo(password string, user *User) bool {
+	lowerPassword := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(user.Username, "@")
+	fields := []string{user.FirstName, user.LastName}
+	fields = append(fields, strings.FieldsFunc(localPart, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})...)
+	for _, field := range fields {
+		field = strings.ToLower(strings.TrimSpace(field))
+		// Very short fragments would reject too many passwords
+		if len([]rune(field)) < 3 {
+			continue
+		}
+		if strings.Contains(lowerPassword, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNewPassword checks the policy and the password history of the user
+func (a *AuthService) validateNewPassword(user *User, newPassword string) error {
+	violations := a.passwordPolicy.Validate(newPassword, user)
+	if a.config.PasswordPolicy.HistorySize > 0 && a.isPreviousPassword(user, newPassword) {
+		violations = append(violations, PolicyViolation{Rule: "history", Message: "must not be one of your last " + strconv.Itoa(a.config.PasswordPolicy.HistorySize) + " passwords"})
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// isPreviousPassword compares the password with the current and the previous password hashes
+func (a *AuthService) isPreviousPassword(user *User, password string) bool {
+	hashes := append([]string{user.Password}, user.PasswordHistory...)
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+		if a.hasher.Compare(hash, password) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordHistory returns the history to store when the current password is replaced
+func (a *AuthService) passwordHistory(user *User) []string {
+	size := a.config.PasswordPolicy.HistorySize
+	if size <= 0 {
+		return nil
+	}
+	history := user.PasswordHistory
+	if user.Password != "" {
+		history = append([]string{user.Password}, history...)
+	}
+	// The current password is checked separately, so only size-1 previous ones are kept
+	if len(history) > size-1 {
+		history = history[:size-1]
+	}
+	return history
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ForgotPassword emails a single-use link to reset the password. Unknown usernames
+// get the same response as known ones, so the endpoint can't be used to find users.
+func (a *AuthService) ForgotPassword(username string, client ClientInfo) error {
+	err := a.throttlingService.Check(throttling.ForgotPassword, username, client.IP)
+	if err != nil {
+		return err
+	}
+	// Every request counts, so the inbox of a user can't be flooded
+	_, err = a.throttlingService.RegisterFailure(throttling.ForgotPassword, username, client.IP)
+	if err != nil {
+		return err
+	}
+	user, err := a.AuthDbService.GetUserbyUsername(username)
+	if err != nil {
+		return nil
+	}
+	if user.Type == ServiceAccountType || user.State != ACTIVE {
+		return nil
+	}
+	a.record(actorFromClient(nil, client), audit.PasswordResetRequested, user.Id, nil, nil)
+	if user.AuthSource != "" {
+		body := "Someone requested a password reset for your account. Your password is managed by your company directory, please change it there."
+		return a.EmailSender.SendEmail(user.Username, "Reset your password", body)
+	}
+	link, err := a.createPasswordResetLink(user)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Open this link to choose a new password: %s\n\nThe link is valid for %d minutes and can only be used once. If you didn't request it, you can ignore this email.", link, a.config.PasswordReset.Minutes)
+	return a.EmailSender.SendEmail(user.Username, "Reset your password", body)
+}
+
+// createPasswordResetLink stores a new reset token for the user and returns the link with it
+func (a *AuthService) createPasswordResetLink(user *User) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	// Only the newest link works
+	err = a.AuthDbService.DeletePasswordResetsByUserId(user.Id)
+	if err != nil {
+		return "", err
+	}
+	err = a.AuthDbService.CreatePasswordReset(passwordReset{
+		Id:         hashToken(token),
+		UserId:     user.Id,
+		Expires:    time.Now().Add(time.Duration(a.config.PasswordReset.Minutes) * time.Minute),
+		InsertedAt: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return linkWithToken(a.config.PasswordReset.URL, token)
+}
+
+// ResetPassword sets a new password with the token of a reset link and ends every session of the user
+func (a *AuthService) ResetPassword(token, newPassword string, client ClientInfo) error {
+	resetId := hashToken(token)
+	reset, err := a.AuthDbService.GetPasswordReset(resetId)
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	user, err := a.AuthDbService.GetUserbyId(reset.UserId)
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	if user.State != ACTIVE {
+		return errors.New("User is not active")
+	}
+	// The link stays valid if the new password is rejected by the policy
+	err = a.validateNewPassword(user, newPassword)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := a.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	// Only one of two concurrent requests with the same link gets here
+	_, err = a.AuthDbService.UsePasswordReset(resetId)
+	if err != nil {
+		return errors.New("link is invalid or expired")
+	}
+	filter := bson.M{"username": user.Username}
+	update := bson.M{"$set": bson.M{"password": hashedPassword, "passwordHistory": a.passwordHistory(user), "oneTimePassword": nil, "updatedAt": time.Now()}}
+	_, err = a.mongoClient.GetCollection(a.mongoClient.Config.UserDatabase, a.mongoClient.Config.UserCollection).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return err
+	}
+	a.record(actorFromClient(user, client), audit.PasswordReset, user.Id, nil, nil)
+	return a.revokeUserTokens(user.Id)
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/R3PTR/go-auth-api/audit"
+)
+
+// PurgeHook removes or anonymizes the data another package keeps about a purged user
+type PurgeHook func(userId string, actor audit.Actor) error
+
+// RegisterPurgeHook adds a hook that runs whenever a user is purged
+func (a *AuthService) RegisterPurgeHook(hook PurgeHook) {
+	a.purgeHooks = append(a.purgeHooks, hook)
+}
+
+// ExportUser returns the personal data of the user record, without passwords, secrets or hashes
+func (a *AuthService) ExportUser(userId string) (*UserExport, error) {
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil || user.Type == ServiceAccountType {
+		return nil, errors.New("User not found")
+	}
+	if !user.PurgedAt.IsZero() {
+		return nil, errors.New("User was purged")
+	}
+	return &UserExport{
+		Id:                  user.Id,
+		Username:            user.Username,
+		FirstName:           user.FirstName,
+		LastName:            user.LastName,
+		Role:                user.Role,
+		State:               user.State,
+		StateReason:         user.StateReason,
+		Personnelnumber:     user.Personnelnumber,
+		VacationDaysPerYear: user.VacationDaysPerYear,
+		TargetHoursPerWeek:  user.TargetHoursPerWeek,
+		MaximumHoursPerWeek: user.MaximumHoursPerWeek,
+		TotpActive:          user.TotpActive,
+		AuthSource:          user.AuthSource,
+		InsertedAt:          user.InsertedAt,
+		UpdatedAt:           user.UpdatedAt,
+	}, nil
+}
+
+// RecordDataExport writes the export of the personal data of a user to the audit log
+func (a *AuthService) RecordDataExport(userId string, actor audit.Actor) {
+	a.record(actor, audit.DataExported, userId, nil, nil)
+}
+
+// DeleteOwnUser erases the account of the user on request of the user
+func (a *AuthService) DeleteOwnUser(userId string, actor audit.Actor) error {
+	return a.EraseUser(userId, "Erasure requested by the user", actor)
+}
+
+// EraseUser deletes the user and purges the personal data right away, without
+// the retention period of DeleteOtherUser. The purge hooks anonymize the data of
+// other packages, so aggregate statistics survive without pointing at the user.
+func (a *AuthService) EraseUser(userId, reason string, actor audit.Actor) error {
+	user, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil || user.Type == ServiceAccountType {
+		return errors.New("User not found")
+	}
+	if !user.PurgedAt.IsZero() {
+		return errors.New("User was purged")
+	}
+	// Erasure can't be undone, so it needs the same coverage as every other change of the user
+	err = a.checkRoleCovered(user.Role, actor)
+	if err != nil {
+		return err
+	}
+	if user.State != DELETED {
+		err = a.setUserState(userId, DELETED, reason, audit.UserDeleted, actor)
+		if err != nil {
+			return err
+		}
+	}
+	return a.purgeUser(user, actor)
+}
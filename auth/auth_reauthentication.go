@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
+)
+
+// Reauthenticate checks the password and the second factor of the user again and marks
+// the session as recently authenticated, which sensitive routes require
+func (a *AuthService) Reauthenticate(user *User, sessionId string, request ReauthenticateRequest, client ClientInfo) (time.Time, error) {
+	if sessionId == "" {
+		return time.Time{}, errors.New("session not found")
+	}
+	err := a.verifyReauthenticationPassword(user, request.Password, client)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if user.TotpActive || a.hasPasskeys(user) {
+		err = a.verifyReauthenticationSecondFactor(user, request, client)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	now := time.Now()
+	err = a.AuthDbService.MarkSessionReauthenticated(sessionId, now)
+	if err != nil {
+		return time.Time{}, errors.New("session not found")
+	}
+	a.record(actorFromClient(user, client), audit.UserReauthenticated, user.Id, nil, nil)
+	return now.Add(time.Duration(a.config.ReauthenticationMinutes) * time.Minute), nil
+}
+
+// verifyReauthenticationPassword checks the local or directory password. Users without
+// one, like users of an external identity provider, have to confirm with a passkey.
+func (a *AuthService) verifyReauthenticationPassword(user *User, password string, client ClientInfo) error {
+	if user.AuthSource == "" && user.Password == "" {
+		if !a.hasPasskeys(user) {
+			return errors.New("re-authentication requires a password or passkey")
+		}
+		return nil
+	}
+	if password == "" {
+		return errors.New("Password not provided")
+	}
+	err := a.throttlingService.Check(throttling.Login, user.Username, client.IP)
+	if err != nil {
+		return err
+	}
+	if user.AuthSource != "" {
+		backendUser, err := a.authenticateWithBackends(user.Username, password, user, client)
+		if err != nil || backendUser.Id != user.Id {
+			a.registerFailedAttempt(throttling.Login, user.Username, client)
+			return errors.New("username or Password incorrect")
+		}
+	} else {
+		err = a.hasher.Compare(user.Password, password)
+		if err != nil {
+			a.registerFailedAttempt(throttling.Login, user.Username, client)
+			return errors.New("username or Password incorrect")
+		}
+		a.rehashPassword(user, password)
+	}
+	a.throttlingService.RegisterSuccess(throttling.Login, user.Username)
+	return nil
+}
+
+// verifyReauthenticationSecondFactor checks a passkey assertion or a TOTP or backup code
+func (a *AuthService) verifyReauthenticationSecondFactor(user *User, request ReauthenticateRequest, client ClientInfo) error {
+	if request.Challenge != "" {
+		return a.verifyWebAuthnTwoFactor(user, request.Challenge, bytes.NewReader(request.Passkey), client)
+	}
+	if !user.TotpActive {
+		return errors.New("passkey not provided")
+	}
+	if request.TOTP == "" {
+		return errors.New("TOTP not provided")
+	}
+	err := a.throttlingService.Check(throttling.TwoFactor, user.Username, client.IP)
+	if err != nil {
+		return err
+	}
+	valid, err := a.VerifyTOTP(user, request.TOTP)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		a.registerFailedAttempt(throttling.TwoFactor, user.Username, client)
+		return errors.New("TOTP is not valid")
+	}
+	a.throttlingService.RegisterSuccess(throttling.TwoFactor, user.Username)
+	return nil
+}
+
+// RecentlyAuthenticated reports whether the user logged in or re-authenticated in the session within the
+// configured window. The login counts, so users that can't re-authenticate, like users of an external
+// identity provider without passkey, can still register their first passkey right after logging in.
+func (a *AuthService) RecentlyAuthenticated(sessionId string) bool {
+	if sessionId == "" {
+		return false
+	}
+	session, err := a.AuthDbService.GetSessionById(sessionId)
+	if err != nil {
+		return false
+	}
+	window := time.Duration(a.config.ReauthenticationMinutes) * time.Minute
+	authenticatedAt := session.ReauthenticatedAt
+	if session.InsertedAt.After(authenticatedAt) {
+		authenticatedAt = session.InsertedAt
+	}
+	return time.Since(authenticatedAt) <= window
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/R3PTR/go-auth-api/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	revokeByJti    = "jti"
+	revokeByFamily = "family"
+	revokeByUser   = "user"
+)
+
+type revocationEntry struct {
+	Kind      string    `bson:"kind"`
+	Value     string    `bson:"value"`
+	RevokedAt time.Time `bson:"revokedAt"`
+	Expires   time.Time `bson:"expires"`
+}
+
+// RevocationList keeps the revoked token ids, token families and users in memory.
+// Entries are written to MongoDB and periodically reloaded, so revocations of other
+// instances become visible after at most one refresh interval.
+type RevocationList struct {
+	mongoClient     *database.MongoDBClient
+	config          *config.Config
+	mu              sync.RWMutex
+	entries         map[string]revocationEntry
+	refreshInterval time.Duration
+}
+
+// NewRevocationList creates a new RevocationList
+func NewRevocationList(mongoClient *database.MongoDBClient, config *config.Config) *RevocationList {
+	return &RevocationList{
+		mongoClient:     mongoClient,
+		config:          config,
+		entries:         map[string]revocationEntry{},
+		refreshInterval: time.Second * time.Duration(config.RevocationRefreshSeconds),
+	}
+}
+
+// getRevocationCollection returns the revocation collection
+func (r *RevocationList) getRevocationCollection() *mongo.Collection {
+	return r.mongoClient.GetCollection(r.config.UserDatabase, r.config.RevocationCollection)
+}
+
+// Start loads the revocation list and keeps refreshing it in the background
+func (r *RevocationList) Start() error {
+	// Entries are removed by MongoDB once every token they could match has expired
+	_, err := r.getRevocationCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"expires": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	err = r.Refresh()
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(r.refreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := r.Refresh()
+			if err != nil {
+				fmt.Println("Error refreshing revocation list:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Refresh reloads all active entries from MongoDB
+func (r *RevocationList) Refresh() error {
+	now := time.Now()
+	cursor, err := r.getRevocationCollection().Find(context.Background(), bson.M{"expires": bson.M{"$gt": now}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	entries := map[string]revocationEntry{}
+	for cursor.Next(context.Background()) {
+		var entry revocationEntry
+		err := cursor.Decode(&entry)
+		if err != nil {
+			return err
+		}
+		entries[entry.Kind+":"+entry.Value] = entry
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Keep local entries that were added while loading
+	for key, entry := range r.entries {
+		if _, exists := entries[key]; !exists && entry.Expires.After(now) {
+			entries[key] = entry
+		}
+	}
+	r.entries = entries
+	return nil
+}
+
+// Revoke adds an entry to the list. Entries only have to live as long as the
+// longest-lived JWT, after that every token they could match is expired anyway.
+func (r *RevocationList) Revoke(kind, value string) error {
+	if value == "" {
+		return nil
+	}
+	now := time.Now()
+	entry := revocationEntry{
+		Kind:      kind,
+		Value:     value,
+		RevokedAt: now,
+		Expires:   now.Add(r.maxTokenLifetime()),
+	}
+	r.mu.Lock()
+	r.entries[kind+":"+value] = entry
+	r.mu.Unlock()
+	_, err := r.getRevocationCollection().InsertOne(context.Background(), entry)
+	return err
+}
+
+// IsRevoked checks the claims of a token against the list
+func (r *RevocationList) IsRevoked(claims *TokenClaims) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, exists := r.entries[revokeByJti+":"+claims.ID]; exists {
+		return true
+	}
+	if claims.FamilyId != "" {
+		if _, exists := r.entries[revokeByFamily+":"+claims.FamilyId]; exists {
+			return true
+		}
+	}
+	// Revoking a user invalidates every token issued before the revocation. Tokens carry
+	// milliseconds and the database keeps milliseconds, so tokens of the same millisecond count as revoked.
+	if entry, exists := r.entries[revokeByUser+":"+claims.Subject]; exists {
+		if claims.IssuedAt == nil || !claims.IssuedAt.Time.After(entry.RevokedAt.Truncate(time.Millisecond)) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTokenLifetime returns the lifetime of the longest-lived JWT
+func (r *RevocationList) maxTokenLifetime() time.Duration {
+	lifetime := time.Minute * time.Duration(r.config.AccessTokenMinutes)
+	if lifetime < time.Minute*15 {
+		// Activation and reset tokens live 15 minutes
+		lifetime = time.Minute * 15
+	}
+	if impersonation := time.Minute * time.Duration(r.config.ImpersonationMinutes); lifetime < impersonation {
+		lifetime = impersonation
+	}
+	return lifetime + time.Minute
+}
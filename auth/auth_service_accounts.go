@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/throttling"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// serviceAccountNameRegexp keeps service account names apart from usernames, which are email addresses
+var serviceAccountNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{2,63}$`)
+
+// GetServiceAccounts returns all service accounts
+func (a *AuthService) GetServiceAccounts() ([]ServiceAccount, error) {
+	return a.AuthDbService.GetServiceAccounts()
+}
+
+// CreateServiceAccount creates a service account and returns it with its client secret, which is only shown once
+func (a *AuthService) CreateServiceAccount(createServiceAccountRequest CreateServiceAccountRequest, actor audit.Actor) (*ServiceAccount, string, error) {
+	if !serviceAccountNameRegexp.MatchString(createServiceAccountRequest.Name) {
+		return nil, "", errors.New("name has to consist of 3 to 64 lowercase letters, digits or dashes")
+	}
+	existingUser, _ := a.AuthDbService.GetUserbyUsername(createServiceAccountRequest.Name)
+	if existingUser != nil {
+		return nil, "", errors.New("User already exists")
+	}
+	if !a.roleService.RoleExists(createServiceAccountRequest.Role) {
+		return nil, "", errors.New("Role does not exist")
+	}
+	// Whoever creates the account knows its secret and acts with its role
+	err := a.checkRoleCovered(createServiceAccountRequest.Role, actor)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	timestamp := time.Now()
+	serviceAccount := ServiceAccount{
+		Name:             createServiceAccountRequest.Name,
+		Description:      createServiceAccountRequest.Description,
+		Role:             createServiceAccountRequest.Role,
+		State:            ACTIVE,
+		Type:             ServiceAccountType,
+		ClientSecretHash: hashToken(secret),
+		CreatedBy:        actor.UserId,
+		InsertedAt:       timestamp,
+		UpdatedAt:        timestamp,
+	}
+	serviceAccount.Id, err = a.AuthDbService.CreateServiceAccount(serviceAccount)
+	if errors.Is(err, ErrUsernameTaken) {
+		return nil, "", err
+	}
+	if err != nil {
+		return nil, "", errors.New("something went wrong creating the service account")
+	}
+	a.record(actor, audit.UserCreated, serviceAccount.Id, nil, serviceAccount)
+	return &serviceAccount, secret, nil
+}
+
+// SetServiceAccountEnabled enables or disables a service account. Disabling revokes
+// its tokens, its API keys stop working until it is enabled again.
+func (a *AuthService) SetServiceAccountEnabled(serviceAccountId string, enabled bool, actor audit.Actor) error {
+	serviceAccount, err := a.AuthDbService.GetServiceAccountById(serviceAccountId)
+	if err != nil {
+		return errors.New("Service account not found")
+	}
+	err = a.checkRoleCovered(serviceAccount.Role, actor)
+	if err != nil {
+		return err
+	}
+	state := DISABLED
+	if enabled {
+		state = ACTIVE
+	}
+	if serviceAccount.State == state {
+		return nil
+	}
+	err = a.AuthDbService.UpdateServiceAccount(serviceAccountId, bson.M{"state": state})
+	if err != nil {
+		return err
+	}
+	after := *serviceAccount
+	after.State = state
+	a.record(actor, audit.UserUpdated, serviceAccountId, *serviceAccount, after)
+	if enabled {
+		return nil
+	}
+	return a.revokeUserTokens(serviceAccountId)
+}
+
+// RotateServiceAccountSecret replaces the client secret and revokes the tokens issued for the old one
+func (a *AuthService) RotateServiceAccountSecret(serviceAccountId string, actor audit.Actor) (string, error) {
+	serviceAccount, err := a.AuthDbService.GetServiceAccountById(serviceAccountId)
+	if err != nil {
+		return "", errors.New("Service account not found")
+	}
+	err = a.checkRoleCovered(serviceAccount.Role, actor)
+	if err != nil {
+		return "", err
+	}
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	err = a.AuthDbService.UpdateServiceAccount(serviceAccountId, bson.M{"clientSecretHash": hashToken(secret)})
+	if err != nil {
+		return "", err
+	}
+	after := *serviceAccount
+	after.ClientSecretHash = hashToken(secret)
+	a.record(actor, audit.ClientSecretRotated, serviceAccountId, *serviceAccount, after)
+	return secret, a.revokeUserTokens(serviceAccountId)
+}
+
+// ClientCredentials issues a ServiceToken for the client id and secret of a service account.
+// Failures are only throttled by IP: client ids aren't secret, so counting them per account
+// would let anyone lock an integration out, and the random secrets can't be guessed anyway.
+func (a *AuthService) ClientCredentials(clientId, clientSecret string, client ClientInfo) (*tokenModel, error) {
+	err := a.throttlingService.Check(throttling.ClientCredentials, "", client.IP)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccount, err := a.AuthDbService.GetServiceAccountById(clientId)
+	if err != nil || clientSecret == "" || subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(serviceAccount.ClientSecretHash)) != 1 {
+		targetId := ""
+		if serviceAccount != nil {
+			targetId = serviceAccount.Id
+		}
+		a.record(actorFromClient(nil, client), audit.UserLoginFailed, targetId, nil, nil)
+		_, err = a.throttlingService.RegisterFailure(throttling.ClientCredentials, "", client.IP)
+		if err != nil {
+			fmt.Println("Error registering failed attempt:", err)
+		}
+		return nil, errors.New("client authentication failed")
+	}
+	if serviceAccount.State != ACTIVE {
+		return nil, errors.New("Service account is disabled")
+	}
+	user, err := a.AuthDbService.GetUserbyId(serviceAccount.Id)
+	if err != nil {
+		return nil, err
+	}
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueToken(user, ServiceToken, "", time.Now().Add(time.Duration(a.config.AccessTokenMinutes)*time.Minute), false, false)
+}
+
+// DeleteServiceAccount deletes a service account together with its API keys and tokens
+func (a *AuthService) DeleteServiceAccount(serviceAccountId string, actor audit.Actor) error {
+	serviceAccount, err := a.AuthDbService.GetServiceAccountById(serviceAccountId)
+	if err != nil {
+		return errors.New("Service account not found")
+	}
+	err = a.checkRoleCovered(serviceAccount.Role, actor)
+	if err != nil {
+		return err
+	}
+	return a.removeUser(serviceAccountId, actor)
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/gin-gonic/gin"
+)
+
+// sessionTouchInterval limits how often the AuthMiddleware writes the last used time of a session
+const sessionTouchInterval = time.Minute
+
+// sessionTracker remembers when a session was last written to the database
+type sessionTracker struct {
+	mu          sync.Mutex
+	lastTouched map[string]time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{lastTouched: map[string]time.Time{}}
+}
+
+// due reports whether the session has to be written again and marks it as written
+func (s *sessionTracker) due(sessionId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastTouched[sessionId]) < sessionTouchInterval {
+		return false
+	}
+	// Forget sessions that were not used for a while
+	for id, touched := range s.lastTouched {
+		if now.Sub(touched) > sessionTouchInterval {
+			delete(s.lastTouched, id)
+		}
+	}
+	s.lastTouched[sessionId] = now
+	return true
+}
+
+// ClientInfoFromContext returns the IP and user agent of a request
+func ClientInfoFromContext(c *gin.Context) ClientInfo {
+	return ClientInfo{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// TouchSession updates the last used time of a session in the background, at most once per interval
+func (a *AuthService) TouchSession(sessionId string, client ClientInfo) {
+	if sessionId == "" || !a.sessionTracker.due(sessionId) {
+		return
+	}
+	go func() {
+		err := a.AuthDbService.TouchSession(sessionId, client, time.Time{})
+		if err != nil {
+			fmt.Println("Error updating session:", err)
+		}
+	}()
+}
+
+// GetSessions returns the active sessions of a user and marks the current one
+func (a *AuthService) GetSessions(userId, currentSessionId string) ([]Session, error) {
+	sessions, err := a.AuthDbService.GetSessionsByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == currentSessionId
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes a session of a user together with all of its tokens
+func (a *AuthService) RevokeSession(userId, sessionId string, actor audit.Actor) error {
+	session, err := a.AuthDbService.GetSessionById(sessionId)
+	if err != nil || session.UserId != userId {
+		return errors.New("session not found")
+	}
+	a.auditService.Record(actor, audit.SessionRevoked, "session", session.Id, *session, nil)
+	return a.revokeTokenFamily(session.Id)
+}
+
+// RevokeAllSessions revokes every session and token of a user
+func (a *AuthService) RevokeAllSessions(userId string, actor audit.Actor) error {
+	_, err := a.AuthDbService.GetUserbyId(userId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	a.record(actor, audit.SessionRevoked, userId, nil, nil)
+	return a.revokeUserTokens(userId)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// issueToken generates a JWT for the user and writes it to the database
+func (a *AuthService) issueToken(user *User, tokenType, familyId string, expires time.Time, requires2FA, twoFAConfirmed bool) (*tokenModel, error) {
+	jti := primitive.NewObjectID().Hex()
+	token_string, err := a.generateJWTToken(TokenClaims{
+		Username:       user.Username,
+		Role:           user.Role,
+		TokenType:      tokenType,
+		FamilyId:       familyId,
+		TwoFAConfirmed: twoFAConfirmed,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   user.Id,
+			Issuer:    a.config.JWTIssuer,
+			Audience:  jwt.ClaimStrings{a.config.JWTAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	token, err := a.AuthDbService.WriteTokenToDatabase(user.Id, token_string, tokenType, familyId, expires, requires2FA, twoFAConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	token.Jti = jti
+	return token, nil
+}
+
+// IssueOIDCAccessToken issues an access token for a client of the OIDC provider.
+// It is stored like every other token, so logout and revocation of the user cover it.
+func (a *AuthService) IssueOIDCAccessToken(user *User, clientId, scope string) (string, time.Time, error) {
+	jti := primitive.NewObjectID().Hex()
+	expires := time.Now().Add(time.Duration(a.config.AccessTokenMinutes) * time.Minute)
+	token_string, err := a.generateJWTToken(TokenClaims{
+		Username:  user.Username,
+		Role:      user.Role,
+		TokenType: OIDCAccessToken,
+		ClientId:  clientId,
+		Scope:     scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   user.Id,
+			Issuer:    a.config.JWTIssuer,
+			Audience:  jwt.ClaimStrings{a.config.JWTAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, err = a.AuthDbService.WriteTokenToDatabase(user.Id, token_string, OIDCAccessToken, "", expires, false, true)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token_string, expires, nil
+}
+
+// tokenFromClaims rebuilds the token model of a verified JWT without a database lookup
+func tokenFromClaims(tokenString string, claims *TokenClaims) *tokenModel {
+	token := &tokenModel{
+		UserId:         claims.Subject,
+		Token:          tokenString,
+		Requires2FA:    claims.TokenType == TwoFactorToken,
+		TwoFAConfirmed: claims.TwoFAConfirmed,
+		TokenType:      claims.TokenType,
+		FamilyId:       claims.FamilyId,
+		Jti:            claims.ID,
+	}
+	if claims.IssuedAt != nil {
+		token.InsertedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		token.Expires = claims.ExpiresAt.Time
+	}
+	return token
+}
+
+// revokeToken deletes a single token and adds it to the revocation list
+func (a *AuthService) revokeToken(token *tokenModel) error {
+	err := a.AuthDbService.DeleteToken(token.Token)
+	if err != nil {
+		return err
+	}
+	return a.revocationList.Revoke(revokeByJti, token.Jti)
+}
+
+// revokeTokenFamily deletes all tokens and the session of a family and adds it to the revocation list
+func (a *AuthService) revokeTokenFamily(familyId string) error {
+	err := a.AuthDbService.DeleteTokensByFamilyId(familyId)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteSession(familyId)
+	if err != nil {
+		return err
+	}
+	return a.revocationList.Revoke(revokeByFamily, familyId)
+}
+
+// revokeUserTokens deletes all tokens and sessions of a user and adds the user to the revocation list
+func (a *AuthService) revokeUserTokens(userId string) error {
+	err := a.AuthDbService.DeleteTokensByUserId(userId)
+	if err != nil {
+		return err
+	}
+	err = a.AuthDbService.DeleteSessionsByUserId(userId)
+	if err != nil {
+		return err
+	}
+	a.AuthDbService.InvalidateCachedUser(userId)
+	return a.revocationList.Revoke(revokeByUser, userId)
+}
+
+// issueLoginTokens issues a short-lived LoginToken together with a new refresh token.
+// An empty familyId starts a new token family and with it a new session.
+func (a *AuthService) issueLoginTokens(user *User, familyId string, twoFAConfirmed bool, client ClientInfo) (*tokenModel, error) {
+	newSession := familyId == ""
+	if newSession {
+		familyId = primitive.NewObjectID().Hex()
+	}
+	accessExpires := time.Now().Add(time.Minute * time.Duration(a.config.AccessTokenMinutes))
+	token, err := a.issueToken(user, LoginToken, familyId, accessExpires, false, twoFAConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshExpires := time.Now().Add(time.Hour * time.Duration(a.config.RefreshTokenHours))
+	_, err = a.AuthDbService.WriteTokenToDatabase(user.Id, hashToken(refreshToken), RefreshToken, familyId, refreshExpires, false, twoFAConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	if newSession {
+		err = a.AuthDbService.CreateSession(familyId, user.Id, client, refreshExpires)
+	} else {
+		err = a.AuthDbService.TouchSession(familyId, client, refreshExpires)
+	}
+	if err != nil {
+		return nil, err
+	}
+	token.RefreshToken = refreshToken
+	return token, nil
+}
+
+// Refresh rotates a refresh token and issues a new LoginToken of the same family.
+// Presenting an already used refresh token revokes the whole family.
+func (a *AuthService) Refresh(refreshToken string, client ClientInfo) (*tokenModel, error) {
+	if refreshToken == "" {
+		return nil, errors.New("no refresh token provided")
+	}
+	tokenHash := hashToken(refreshToken)
+	token, err := a.AuthDbService.UseRefreshToken(tokenHash)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		existing, err := a.AuthDbService.GetTokenByToken(tokenHash)
+		if err == nil && existing.TokenType == RefreshToken && existing.Used {
+			err = a.revokeTokenFamily(existing.FamilyId)
+			if err != nil {
+				return nil, err
+			}
+			a.auditService.Record(actorFromClient(nil, client), audit.RefreshTokenReused, "session", existing.FamilyId, nil, nil)
+			return nil, errors.New("refresh token reuse detected, session revoked")
+		}
+		return nil, errors.New("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.Expires.Before(time.Now()) {
+		return nil, errors.New("refresh token expired")
+	}
+	user, err := a.AuthDbService.GetUserbyId(token.UserId)
+	if err != nil {
+		return nil, errors.New("invalid refresh token")
+	}
+	if user.State != ACTIVE {
+		return nil, errors.New("User is not active")
+	}
+	return a.issueLoginTokens(user, token.FamilyId, token.TwoFAConfirmed, client)
+}
+
+// generateOpaqueToken returns a random URL safe token
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the SHA-256 hash of an opaque token as stored in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestPasskeyOnlyUserCantUseTOTP(t *testing.T) {
+	a := &AuthService{}
+	user := &User{Id: "1", Username: "anna@example.com", State: ACTIVE}
+	code, err := totp.GenerateCode("", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := a.VerifyTOTP(user, code)
+	if err != nil || valid {
+		t.Fatalf("VerifyTOTP with an empty secret = %v, %v, want false", valid, err)
+	}
+	pending := &tokenModel{TokenType: TwoFactorToken, Requires2FA: true}
+	_, err = a.CompleteTwoFactorLogin(user, pending, code, ClientInfo{})
+	if err == nil || err.Error() != "passkey required" {
+		t.Fatalf("CompleteTwoFactorLogin = %v, want passkey required", err)
+	}
+}
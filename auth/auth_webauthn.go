@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/R3PTR/go-auth-api/throttling"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthn ceremonies, a challenge can only be finished by the ceremony that started it
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	ceremonyTwoFactor    = "2fa"
+)
+
+// webAuthnCeremonyTimeout is used when the library does not set an expiry on the session data
+const webAuthnCeremonyTimeout = time.Minute * 5
+
+// NewWebAuthn creates the WebAuthn relying party from the config
+func NewWebAuthn(config *config.Config) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:          config.WebAuthn.RPID,
+		RPDisplayName: config.WebAuthn.RPDisplayName,
+		RPOrigins:     config.WebAuthn.RPOrigins,
+	})
+}
+
+// webAuthnUser adapts a User and its passkeys to the webauthn.User interface
+type webAuthnUser struct {
+	user        *User
+	credentials []webauthn.Credential
+}
+
+func (w *webAuthnUser) WebAuthnID() []byte {
+	return []byte(w.user.Id)
+}
+
+func (w *webAuthnUser) WebAuthnName() string {
+	return w.user.Username
+}
+
+func (w *webAuthnUser) WebAuthnDisplayName() string {
+	return w.user.FirstName + " " + w.user.LastName
+}
+
+func (w *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (w *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return w.credentials
+}
+
+// loadWebAuthnUser loads the passkeys of a user
+func (a *AuthService) loadWebAuthnUser(user *User) (*webAuthnUser, error) {
+	credentials, err := a.AuthDbService.GetWebAuthnCredentialsByUserId(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	w := &webAuthnUser{user: user}
+	for _, credential := range credentials {
+		w.credentials = append(w.credentials, credential.Credential)
+	}
+	return w, nil
+}
+
+// hasPasskeys reports whether the user registered at least one passkey
+func (a *AuthService) hasPasskeys(user *User) bool {
+	count, err := a.AuthDbService.CountWebAuthnCredentials(user.Id)
+	if err != nil {
+		fmt.Println("Error counting passkeys:", err)
+		return false
+	}
+	return count > 0
+}
+
+// saveWebAuthnChallenge stores the session data of a ceremony and returns its id
+func (a *AuthService) saveWebAuthnChallenge(ceremony, userId, name string, session *webauthn.SessionData) (string, error) {
+	challengeId, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	expires := session.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(webAuthnCeremonyTimeout)
+	}
+	err = a.AuthDbService.CreateWebAuthnChallenge(webAuthnChallenge{
+		Id:       challengeId,
+		Ceremony: ceremony,
+		UserId:   userId,
+		Name:     name,
+		Session:  *session,
+		Expires:  expires,
+	})
+	if err != nil {
+		return "", err
+	}
+	return challengeId, nil
+}
+
+// BeginWebAuthnRegistration starts registering a new passkey for the user
+func (a *AuthService) BeginWebAuthnRegistration(user *User, name string) (string, *protocol.CredentialCreation, error) {
+	if name == "" {
+		return "", nil, errors.New("no name provided")
+	}
+	w, err := a.loadWebAuthnUser(user)
+	if err != nil {
+		return "", nil, err
+	}
+	// Passkeys already registered on the authenticator are rejected by the browser
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range w.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	creation, session, err := a.webAuthn.BeginRegistration(w,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		// A passkey replaces password and TOTP, so a touch without PIN or biometric is not enough
+		func(options *protocol.PublicKeyCredentialCreationOptions) {
+			options.AuthenticatorSelection.UserVerification = protocol.VerificationRequired
+		},
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	challengeId, err := a.saveWebAuthnChallenge(ceremonyRegistration, user.Id, name, session)
+	if err != nil {
+		return "", nil, err
+	}
+	return challengeId, creation, nil
+}
+
+// FinishWebAuthnRegistration verifies the attestation of the authenticator and stores the passkey
+func (a *AuthService) FinishWebAuthnRegistration(user *User, challengeId string, body io.Reader, actor audit.Actor) (*WebAuthnCredential, error) {
+	challenge, err := a.AuthDbService.UseWebAuthnChallenge(challengeId, ceremonyRegistration)
+	if err != nil || challenge.UserId != user.Id {
+		return nil, errors.New("registration not found or expired")
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return nil, errors.New("invalid registration response")
+	}
+	w, err := a.loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := a.webAuthn.CreateCredential(w, challenge.Session, parsed)
+	if err != nil {
+		return nil, errors.New("passkey could not be verified")
+	}
+	webAuthnCredential := WebAuthnCredential{
+		Id:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserId:     user.Id,
+		Name:       challenge.Name,
+		Credential: *credential,
+		SignCount:  credential.Authenticator.SignCount,
+		InsertedAt: time.Now(),
+	}
+	err = a.AuthDbService.CreateWebAuthnCredential(webAuthnCredential)
+	if err != nil {
+		return nil, err
+	}
+	a.record(actor, audit.PasskeyRegistered, user.Id, nil, webAuthnCredential)
+	return &webAuthnCredential, nil
+}
+
+// BeginWebAuthnLogin starts a passwordless login. Without a username any passkey
+// stored on the authenticator can be used.
+func (a *AuthService) BeginWebAuthnLogin(username string) (string, *protocol.CredentialAssertion, error) {
+	if username == "" {
+		assertion, session, err := a.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return "", nil, err
+		}
+		challengeId, err := a.saveWebAuthnChallenge(ceremonyLogin, "", "", session)
+		if err != nil {
+			return "", nil, err
+		}
+		return challengeId, assertion, nil
+	}
+	user, err := a.AuthDbService.GetUserbyUsername(username)
+	if err != nil {
+		return "", nil, errors.New("no passkey registered")
+	}
+	w, err := a.loadWebAuthnUser(user)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(w.credentials) == 0 {
+		return "", nil, errors.New("no passkey registered")
+	}
+	// The passkey counts as both factors, which needs user verification
+	assertion, session, err := a.webAuthn.BeginLogin(w, webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return "", nil, err
+	}
+	challengeId, err := a.saveWebAuthnChallenge(ceremonyLogin, user.Id, "", session)
+	if err != nil {
+		return "", nil, err
+	}
+	return challengeId, assertion, nil
+}
+
+// FinishWebAuthnLogin verifies the assertion and issues login tokens. A passkey with
+// user verification counts as both factors, so no TOTP is required afterwards.
+func (a *AuthService) FinishWebAuthnLogin(challengeId string, body io.Reader, client ClientInfo) (*tokenModel, error) {
+	err := a.throttlingService.Check(throttling.Login, "", client.IP)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := a.AuthDbService.UseWebAuthnChallenge(challengeId, ceremonyLogin)
+	if err != nil {
+		return nil, errors.New("login not found or expired")
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return nil, errors.New("invalid login response")
+	}
+	var w *webAuthnUser
+	var credential *webauthn.Credential
+	if challenge.UserId == "" {
+		handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+			user, err := a.AuthDbService.GetUserbyId(string(userHandle))
+			if err != nil {
+				return nil, err
+			}
+			w, err = a.loadWebAuthnUser(user)
+			return w, err
+		}
+		credential, err = a.webAuthn.ValidateDiscoverableLogin(handler, challenge.Session, parsed)
+	} else {
+		var user *User
+		user, err = a.AuthDbService.GetUserbyId(challenge.UserId)
+		if err != nil {
+			return nil, errors.New("passkey could not be verified")
+		}
+		w, err = a.loadWebAuthnUser(user)
+		if err != nil {
+			return nil, err
+		}
+		credential, err = a.webAuthn.ValidateLogin(w, challenge.Session, parsed)
+	}
+	// The library checks the flag against the challenge, this also covers challenges stored before it was required
+	if err == nil && !credential.Flags.UserVerified {
+		err = errors.New("user verification missing")
+	}
+	if err != nil || w == nil {
+		username := ""
+		if w != nil {
+			username = w.user.Username
+		}
+		a.registerFailedAttempt(throttling.Login, username, client)
+		return nil, errors.New("passkey could not be verified")
+	}
+	err = a.useWebAuthnCredential(credential)
+	if err != nil {
+		return nil, err
+	}
+	if w.user.State != ACTIVE {
+		return nil, errors.New("User is not active")
+	}
+	a.throttlingService.RegisterSuccess(throttling.Login, w.user.Username)
+	a.record(actorFromClient(w.user, client), audit.UserLogin, w.user.Id, nil, nil)
+	return a.issueLoginTokens(w.user, "", true, client)
+}
+
+// BeginWebAuthnTwoFactor starts the second step of a login or re-authentication with a passkey instead of a TOTP code
+func (a *AuthService) BeginWebAuthnTwoFactor(user *User) (string, *protocol.CredentialAssertion, error) {
+	w, err := a.loadWebAuthnUser(user)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(w.credentials) == 0 {
+		return "", nil, errors.New("no passkey registered")
+	}
+	assertion, session, err := a.webAuthn.BeginLogin(w)
+	if err != nil {
+		return "", nil, err
+	}
+	challengeId, err := a.saveWebAuthnChallenge(ceremonyTwoFactor, user.Id, "", session)
+	if err != nil {
+		return "", nil, err
+	}
+	return challengeId, assertion, nil
+}
+
+// FinishWebAuthnTwoFactor exchanges a pending TwoFactorToken and a passkey assertion for a LoginToken
+func (a *AuthService) FinishWebAuthnTwoFactor(user *User, pending *tokenModel, challengeId string, body io.Reader, client ClientInfo) (*tokenModel, error) {
+	if pending.TokenType != TwoFactorToken || !pending.Requires2FA {
+		return nil, errors.New("token is not a pending 2FA token")
+	}
+	err := a.verifyWebAuthnTwoFactor(user, challengeId, body, client)
+	if err != nil {
+		return nil, err
+	}
+	err = a.revokeToken(pending)
+	if err != nil {
+		return nil, err
+	}
+	a.record(actorFromClient(user, client), audit.UserLogin, user.Id, nil, nil)
+	return a.issueLoginTokens(user, "", true, client)
+}
+
+// verifyWebAuthnTwoFactor checks a passkey assertion for a challenge of BeginWebAuthnTwoFactor
+func (a *AuthService) verifyWebAuthnTwoFactor(user *User, challengeId string, body io.Reader, client ClientInfo) error {
+	err := a.throttlingService.Check(throttling.TwoFactor, user.Username, client.IP)
+	if err != nil {
+		return err
+	}
+	challenge, err := a.AuthDbService.UseWebAuthnChallenge(challengeId, ceremonyTwoFactor)
+	if err != nil || challenge.UserId != user.Id {
+		return errors.New("verification not found or expired")
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return errors.New("invalid verification response")
+	}
+	w, err := a.loadWebAuthnUser(user)
+	if err != nil {
+		return err
+	}
+	credential, err := a.webAuthn.ValidateLogin(w, challenge.Session, parsed)
+	if err != nil {
+		a.registerFailedAttempt(throttling.TwoFactor, user.Username, client)
+		return errors.New("passkey could not be verified")
+	}
+	err = a.useWebAuthnCredential(credential)
+	if err != nil {
+		return err
+	}
+	a.throttlingService.RegisterSuccess(throttling.TwoFactor, user.Username)
+	return nil
+}
+
+// useWebAuthnCredential rejects cloned authenticators and stores the new sign counter
+func (a *AuthService) useWebAuthnCredential(credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		return errors.New("passkey could not be verified")
+	}
+	return a.AuthDbService.UpdateWebAuthnCredentialUsage(base64.RawURLEncoding.EncodeToString(credential.ID), credential.Authenticator, credential.Flags)
+}
+
+// GetWebAuthnCredentials returns the passkeys of a user
+func (a *AuthService) GetWebAuthnCredentials(userId string) ([]WebAuthnCredential, error) {
+	return a.AuthDbService.GetWebAuthnCredentialsByUserId(userId)
+}
+
+// DeleteWebAuthnCredential removes a passkey of a user
+func (a *AuthService) DeleteWebAuthnCredential(userId, credentialId string, actor audit.Actor) error {
+	err := a.AuthDbService.DeleteWebAuthnCredential(userId, credentialId)
+	if err != nil {
+		return errors.New("passkey not found")
+	}
+	a.record(actor, audit.PasskeyRemoved, userId, nil, nil)
+	return nil
+}
@@ -0,0 +1,130 @@
+// Command importusers creates the users of a CSV or XLSX file and invites them. It uses
+// the config of the API, so it is run from the directory the API runs in:
+//
+//	go run ./cmd/importusers -dry-run users.xlsx
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/auth"
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/R3PTR/go-auth-api/database"
+	"github.com/R3PTR/go-auth-api/emails"
+	"github.com/R3PTR/go-auth-api/roles"
+	"github.com/R3PTR/go-auth-api/throttling"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only validate the file, no user is created")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: importusers [-dry-run] <file.csv|file.xlsx>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(flag.Arg(0), *dryRun))
+}
+
+// run imports the file and returns the exit code, 1 if the file or a row is invalid
+func run(filename string, dryRun bool) int {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Println("Error opening file:", err)
+		return 1
+	}
+	defer file.Close()
+	rows, err := auth.ReadImportFile(filename, file)
+	if err != nil {
+		fmt.Println("Error reading file:", err)
+		return 1
+	}
+	authService, closeServices, err := newAuthService()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer closeServices()
+	report, err := authService.ImportUsers(rows, dryRun, audit.Actor{Username: "importusers"})
+	if err != nil {
+		fmt.Println("Error importing users:", err)
+		return 1
+	}
+	printReport(report)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// newAuthService creates the AuthService like the API does
+func newAuthService() (*auth.AuthService, func(), error) {
+	config, err := config.NewConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading config: %w", err)
+	}
+	mongoClient, err := database.NewMongoDBClient(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error connecting to MongoDB: %w", err)
+	}
+	closeServices := func() { mongoClient.Close() }
+	emailSender := emails.NewEmailSender("ems@te-autoteile.de", "localhost", 1025, "", "")
+	auditService := audit.NewAuditService(audit.NewAuditDbService(mongoClient))
+	roleService := roles.NewRoleService(roles.NewRolesDbService(mongoClient), auditService)
+	err = roleService.Start()
+	if err != nil {
+		closeServices()
+		return nil, nil, fmt.Errorf("Error loading roles: %w", err)
+	}
+	authDbService := auth.NewAuthDbService(mongoClient)
+	err = authDbService.EnsureIndexes()
+	if err != nil {
+		closeServices()
+		return nil, nil, fmt.Errorf("Error creating indexes: %w", err)
+	}
+	keyManager, err := auth.NewKeyManager(mongoClient, config)
+	if err != nil {
+		closeServices()
+		return nil, nil, fmt.Errorf("Error creating key manager: %w", err)
+	}
+	// Invitation links are signed with the keys of the API
+	err = keyManager.Start()
+	if err != nil {
+		closeServices()
+		return nil, nil, fmt.Errorf("Error loading signing keys: %w", err)
+	}
+	throttlingService := throttling.NewThrottlingService(throttling.NewThrottlingDbService(mongoClient), config)
+	webAuthn, err := auth.NewWebAuthn(config)
+	if err != nil {
+		closeServices()
+		return nil, nil, fmt.Errorf("Error configuring WebAuthn: %w", err)
+	}
+	revocationList := auth.NewRevocationList(mongoClient, config)
+	authService := auth.NewAuthService(mongoClient, config, authDbService, emailSender, revocationList, keyManager, throttlingService, auditService, roleService, webAuthn, []auth.CredentialBackend{})
+	return authService, closeServices, nil
+}
+
+// printReport prints a line per row of the import
+func printReport(report *auth.ImportReport) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "LINE\tUSERNAME\tSTATUS\tERROR")
+	for _, row := range report.Rows {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", row.Line, row.Username, row.Status, row.Error)
+	}
+	writer.Flush()
+	switch {
+	case report.Failed > 0:
+		fmt.Printf("%d of %d rows are invalid, no user was created\n", report.Failed, report.Total)
+	case report.DryRun:
+		fmt.Printf("All %d rows are valid\n", report.Total)
+	default:
+		fmt.Printf("%d users created\n", report.Created)
+	}
+}
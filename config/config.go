@@ -18,7 +18,186 @@ type Config struct {
 	AbsencesDatabase    string `json:"absences_database"`
 	JWTSecret           string `json:"jwt_secret"`
 	TokenCollection     string `json:"token_collection"`
+	SessionCollection   string `json:"session_collection"`
 	TOTPIssuer          string `json:"totp_issuer"`
+	AccessTokenMinutes  int    `json:"access_token_minutes"`
+	// ImpersonationMinutes is how long an admin can act as another user with one token
+	ImpersonationMinutes int `json:"impersonation_minutes"`
+	// ReauthenticationMinutes is how long sensitive routes accept a session after re-authentication
+	ReauthenticationMinutes int    `json:"reauthentication_minutes"`
+	RefreshTokenHours       int    `json:"refresh_token_hours"`
+	JWTIssuer               string `json:"jwt_issuer"`
+	JWTAudience             string `json:"jwt_audience"`
+	// Revoked tokens are kept in this collection and mirrored in memory
+	RevocationCollection     string `json:"revocation_collection"`
+	RevocationRefreshSeconds int    `json:"revocation_refresh_seconds"`
+	// UserCacheSeconds enables the user cache of the AuthMiddleware if greater than 0
+	UserCacheSeconds int `json:"user_cache_seconds"`
+	// JWTs are signed with RS256 or EdDSA keys, stored in KeyCollection or in JWTKeyDirectory if set
+	JWTSigningAlgorithm string                `json:"jwt_signing_algorithm"`
+	KeyCollection       string                `json:"key_collection"`
+	JWTKeyDirectory     string                `json:"jwt_key_directory"`
+	JWTKeyRotationHours int                   `json:"jwt_key_rotation_hours"`
+	JWTKeyGraceHours    int                   `json:"jwt_key_grace_hours"`
+	AuditCollection     string                `json:"audit_collection"`
+	RoleCollection      string                `json:"role_collection"`
+	APIKeyCollection    string                `json:"api_key_collection"`
+	Throttling          ThrottlingConfig      `json:"throttling"`
+	PasswordPolicy      PasswordPolicyConfig  `json:"password_policy"`
+	PasswordHashing     PasswordHashingConfig `json:"password_hashing"`
+	WebAuthn            WebAuthnConfig        `json:"webauthn"`
+	OIDC                OIDCConfig            `json:"oidc"`
+	Federation          FederationConfig      `json:"federation"`
+	LDAP                LDAPConfig            `json:"ldap"`
+	MagicLink           MagicLinkConfig       `json:"magic_link"`
+	PasswordReset       PasswordResetConfig   `json:"password_reset"`
+	Invitation          InvitationConfig      `json:"invitation"`
+	UserLifecycle       UserLifecycleConfig   `json:"user_lifecycle"`
+	EmailChange         EmailChangeConfig     `json:"email_change"`
+}
+
+// EmailChangeConfig configures the confirmation of new email addresses.
+type EmailChangeConfig struct {
+	// ConfirmURL and CancelURL are pages of the frontend, the token is appended as query parameter
+	ConfirmURL string `json:"confirm_url"`
+	CancelURL  string `json:"cancel_url"`
+	Hours      int    `json:"hours"`
+	Collection string `json:"collection"`
+}
+
+// UserLifecycleConfig configures how long deleted users can be restored before they are anonymized.
+type UserLifecycleConfig struct {
+	RetentionDays        int `json:"retention_days"`
+	PurgeIntervalMinutes int `json:"purge_interval_minutes"`
+}
+
+// InvitationConfig configures the invitations of new users.
+type InvitationConfig struct {
+	// URL is the page of the frontend that accepts the invitation, the token is appended as query parameter
+	URL   string `json:"url"`
+	Hours int    `json:"hours"`
+	// RetentionDays is how long expired, revoked and accepted invitations are kept before they are removed
+	RetentionDays int    `json:"retention_days"`
+	Collection    string `json:"collection"`
+}
+
+// PasswordResetConfig configures the password reset links sent by email.
+type PasswordResetConfig struct {
+	// URL is the page of the frontend that sets the new password, the token is appended as query parameter
+	URL        string `json:"url"`
+	Minutes    int    `json:"minutes"`
+	Collection string `json:"collection"`
+}
+
+// MagicLinkConfig configures the passwordless login by email.
+type MagicLinkConfig struct {
+	// URL is the page of the frontend that exchanges the link, the token is appended as query parameter
+	URL     string `json:"url"`
+	Minutes int    `json:"minutes"`
+}
+
+// LDAPConfig configures the LDAP / Active Directory credential backend.
+type LDAPConfig struct {
+	Enabled bool `json:"enabled"`
+	// Name is stored as the auth source of the users the backend authenticated
+	Name               string `json:"name"`
+	URL                string `json:"url"`
+	StartTLS           bool   `json:"start_tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	TimeoutSeconds     int    `json:"timeout_seconds"`
+	// UserDNTemplates are tried in order to bind as the user, {username} is replaced,
+	// e.g. "uid={username},ou=people,dc=example,dc=com" or "{username}@corp.example.com"
+	UserDNTemplates []string `json:"user_dn_templates"`
+	// The entry of the user is searched in BaseDN with UserFilter after the bind
+	BaseDN             string             `json:"base_dn"`
+	UserFilter         string             `json:"user_filter"`
+	FirstNameAttribute string             `json:"first_name_attribute"`
+	LastNameAttribute  string             `json:"last_name_attribute"`
+	EmailAttribute     string             `json:"email_attribute"`
+	GroupAttribute     string             `json:"group_attribute"`
+	GroupRoles         []LDAPGroupRoleMap `json:"group_roles"`
+	// DefaultRole is used if no group matches, users without a role can't log in
+	DefaultRole     string `json:"default_role"`
+	JITProvisioning bool   `json:"jit_provisioning"`
+}
+
+// LDAPGroupRoleMap maps the members of a directory group to a role, the first matching group wins.
+type LDAPGroupRoleMap struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+// FederationConfig configures login through external OIDC identity providers.
+type FederationConfig struct {
+	Providers          []ExternalProviderConfig `json:"providers"`
+	IdentityCollection string                   `json:"identity_collection"`
+	StateCollection    string                   `json:"state_collection"`
+	StateMinutes       int                      `json:"state_minutes"`
+}
+
+// ExternalProviderConfig describes one external OIDC identity provider.
+type ExternalProviderConfig struct {
+	// Name identifies the provider in routes and linked identities
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	// Unknown users are created with DefaultRole if AutoProvision is set
+	AutoProvision bool   `json:"auto_provision"`
+	DefaultRole   string `json:"default_role"`
+}
+
+// OIDCConfig configures the OpenID Connect provider for other apps.
+type OIDCConfig struct {
+	// IssuerURL is the public base URL of this service, it is the iss claim of ID tokens
+	IssuerURL string `json:"issuer_url"`
+	// LoginURL is the page of the frontend that logs the user in and continues the authorization
+	LoginURL         string `json:"login_url"`
+	ClientCollection string `json:"client_collection"`
+	CodeCollection   string `json:"code_collection"`
+	CodeSeconds      int    `json:"code_seconds"`
+}
+
+// WebAuthnConfig configures the relying party for passkeys.
+type WebAuthnConfig struct {
+	RPID                 string   `json:"rp_id"`
+	RPDisplayName        string   `json:"rp_display_name"`
+	RPOrigins            []string `json:"rp_origins"`
+	CredentialCollection string   `json:"credential_collection"`
+	ChallengeCollection  string   `json:"challenge_collection"`
+}
+
+// PasswordHashingConfig holds the Argon2id parameters for new password hashes.
+type PasswordHashingConfig struct {
+	MemoryKiB   uint32 `json:"memory_kib"`
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+}
+
+// PasswordPolicyConfig configures the rules new passwords have to satisfy.
+type PasswordPolicyConfig struct {
+	MinLength            int  `json:"min_length"`
+	RequireUppercase     bool `json:"require_uppercase"`
+	RequireLowercase     bool `json:"require_lowercase"`
+	RequireDigit         bool `json:"require_digit"`
+	RequireSymbol        bool `json:"require_symbol"`
+	DisallowPersonalInfo bool `json:"disallow_personal_info"`
+	CheckBreached        bool `json:"check_breached"`
+	HistorySize          int  `json:"history_size"`
+}
+
+// ThrottlingConfig configures the brute-force protection of login and password reset.
+type ThrottlingConfig struct {
+	Collection           string `json:"collection"`
+	MaxAccountFailures   int    `json:"max_account_failures"`
+	MaxIPFailures        int    `json:"max_ip_failures"`
+	MaxPasswordResets    int    `json:"max_password_resets"`
+	BaseDelaySeconds     int    `json:"base_delay_seconds"`
+	MaxDelaySeconds      int    `json:"max_delay_seconds"`
+	LockMinutes          int    `json:"lock_minutes"`
+	FailureWindowMinutes int    `json:"failure_window_minutes"`
 }
 
 // Environment represents the environment (development, production, etc.).
@@ -58,6 +237,209 @@ func loadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	setDefaults(config)
 
 	return config, nil
 }
+
+// setDefaults fills in values that are missing from the config file
+func setDefaults(config *Config) {
+	if config.AccessTokenMinutes == 0 {
+		config.AccessTokenMinutes = 15
+	}
+	if config.ImpersonationMinutes == 0 {
+		config.ImpersonationMinutes = 15
+	}
+	if config.ReauthenticationMinutes == 0 {
+		config.ReauthenticationMinutes = 5
+	}
+	if config.RefreshTokenHours == 0 {
+		config.RefreshTokenHours = 720
+	}
+	if config.JWTIssuer == "" {
+		config.JWTIssuer = "go-auth-api"
+	}
+	if config.JWTAudience == "" {
+		config.JWTAudience = "go-auth-api"
+	}
+	if config.SessionCollection == "" {
+		config.SessionCollection = "sessions"
+	}
+	if config.RevocationCollection == "" {
+		config.RevocationCollection = "revocations"
+	}
+	if config.RevocationRefreshSeconds == 0 {
+		config.RevocationRefreshSeconds = 30
+	}
+	if config.JWTSigningAlgorithm == "" {
+		config.JWTSigningAlgorithm = "RS256"
+	}
+	if config.KeyCollection == "" {
+		config.KeyCollection = "signing_keys"
+	}
+	if config.JWTKeyRotationHours == 0 {
+		config.JWTKeyRotationHours = 720
+	}
+	if config.JWTKeyGraceHours == 0 {
+		config.JWTKeyGraceHours = 24
+	}
+	if config.AuditCollection == "" {
+		config.AuditCollection = "audit_log"
+	}
+	if config.RoleCollection == "" {
+		config.RoleCollection = "roles"
+	}
+	if config.Throttling.Collection == "" {
+		config.Throttling.Collection = "login_attempts"
+	}
+	if config.Throttling.MaxAccountFailures == 0 {
+		config.Throttling.MaxAccountFailures = 5
+	}
+	if config.Throttling.MaxIPFailures == 0 {
+		config.Throttling.MaxIPFailures = 50
+	}
+	if config.Throttling.MaxPasswordResets == 0 {
+		config.Throttling.MaxPasswordResets = 3
+	}
+	if config.Throttling.BaseDelaySeconds == 0 {
+		config.Throttling.BaseDelaySeconds = 1
+	}
+	if config.Throttling.MaxDelaySeconds == 0 {
+		config.Throttling.MaxDelaySeconds = 60
+	}
+	if config.Throttling.LockMinutes == 0 {
+		config.Throttling.LockMinutes = 15
+	}
+	if config.Throttling.FailureWindowMinutes == 0 {
+		config.Throttling.FailureWindowMinutes = 15
+	}
+	// An empty password is never allowed
+	if config.PasswordPolicy.MinLength == 0 {
+		config.PasswordPolicy.MinLength = 10
+	}
+	if config.WebAuthn.RPID == "" {
+		config.WebAuthn.RPID = "localhost"
+	}
+	if config.WebAuthn.RPDisplayName == "" {
+		config.WebAuthn.RPDisplayName = config.TOTPIssuer
+	}
+	if len(config.WebAuthn.RPOrigins) == 0 {
+		config.WebAuthn.RPOrigins = []string{"http://localhost:9090"}
+	}
+	if config.WebAuthn.CredentialCollection == "" {
+		config.WebAuthn.CredentialCollection = "webauthn_credentials"
+	}
+	if config.WebAuthn.ChallengeCollection == "" {
+		config.WebAuthn.ChallengeCollection = "webauthn_challenges"
+	}
+	if config.OIDC.IssuerURL == "" {
+		config.OIDC.IssuerURL = "http://localhost:9090"
+	}
+	if config.OIDC.LoginURL == "" {
+		config.OIDC.LoginURL = "http://localhost:3000/oidc/login"
+	}
+	if config.OIDC.ClientCollection == "" {
+		config.OIDC.ClientCollection = "oidc_clients"
+	}
+	if config.OIDC.CodeCollection == "" {
+		config.OIDC.CodeCollection = "oidc_codes"
+	}
+	if config.OIDC.CodeSeconds == 0 {
+		config.OIDC.CodeSeconds = 60
+	}
+	if config.Federation.IdentityCollection == "" {
+		config.Federation.IdentityCollection = "external_identities"
+	}
+	if config.Federation.StateCollection == "" {
+		config.Federation.StateCollection = "external_login_states"
+	}
+	if config.Federation.StateMinutes == 0 {
+		config.Federation.StateMinutes = 10
+	}
+	for i := range config.Federation.Providers {
+		if len(config.Federation.Providers[i].Scopes) == 0 {
+			config.Federation.Providers[i].Scopes = []string{"openid", "profile", "email"}
+		}
+		if config.Federation.Providers[i].DefaultRole == "" {
+			config.Federation.Providers[i].DefaultRole = "USER"
+		}
+	}
+	if config.LDAP.Name == "" {
+		config.LDAP.Name = "ldap"
+	}
+	if config.LDAP.TimeoutSeconds == 0 {
+		config.LDAP.TimeoutSeconds = 5
+	}
+	if config.LDAP.UserFilter == "" {
+		config.LDAP.UserFilter = "(uid={username})"
+	}
+	if config.LDAP.FirstNameAttribute == "" {
+		config.LDAP.FirstNameAttribute = "givenName"
+	}
+	if config.LDAP.LastNameAttribute == "" {
+		config.LDAP.LastNameAttribute = "sn"
+	}
+	if config.LDAP.EmailAttribute == "" {
+		config.LDAP.EmailAttribute = "mail"
+	}
+	if config.LDAP.GroupAttribute == "" {
+		config.LDAP.GroupAttribute = "memberOf"
+	}
+	if config.APIKeyCollection == "" {
+		config.APIKeyCollection = "api_keys"
+	}
+	if config.MagicLink.URL == "" {
+		config.MagicLink.URL = "http://localhost:3000/login/magic"
+	}
+	if config.MagicLink.Minutes == 0 {
+		config.MagicLink.Minutes = 10
+	}
+	if config.PasswordReset.URL == "" {
+		config.PasswordReset.URL = "http://localhost:3000/resetPassword"
+	}
+	if config.PasswordReset.Minutes == 0 {
+		config.PasswordReset.Minutes = 30
+	}
+	if config.PasswordReset.Collection == "" {
+		config.PasswordReset.Collection = "password_resets"
+	}
+	if config.Invitation.URL == "" {
+		config.Invitation.URL = "http://localhost:3000/invitation"
+	}
+	if config.Invitation.Hours == 0 {
+		config.Invitation.Hours = 72
+	}
+	if config.Invitation.RetentionDays == 0 {
+		config.Invitation.RetentionDays = 30
+	}
+	if config.Invitation.Collection == "" {
+		config.Invitation.Collection = "invitations"
+	}
+	if config.UserLifecycle.RetentionDays == 0 {
+		config.UserLifecycle.RetentionDays = 30
+	}
+	if config.UserLifecycle.PurgeIntervalMinutes == 0 {
+		config.UserLifecycle.PurgeIntervalMinutes = 60
+	}
+	if config.EmailChange.ConfirmURL == "" {
+		config.EmailChange.ConfirmURL = "http://localhost:3000/emailChange/confirm"
+	}
+	if config.EmailChange.CancelURL == "" {
+		config.EmailChange.CancelURL = "http://localhost:3000/emailChange/cancel"
+	}
+	if config.EmailChange.Hours == 0 {
+		config.EmailChange.Hours = 24
+	}
+	if config.EmailChange.Collection == "" {
+		config.EmailChange.Collection = "email_changes"
+	}
+	if config.PasswordHashing.MemoryKiB == 0 {
+		config.PasswordHashing.MemoryKiB = 64 * 1024
+	}
+	if config.PasswordHashing.Iterations == 0 {
+		config.PasswordHashing.Iterations = 3
+	}
+	if config.PasswordHashing.Parallelism == 0 {
+		config.PasswordHashing.Parallelism = 2
+	}
+}
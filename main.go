@@ -5,11 +5,16 @@ import (
 	"fmt"
 
 	"github.com/R3PTR/go-auth-api/absences"
+	"github.com/R3PTR/go-auth-api/audit"
 	"github.com/R3PTR/go-auth-api/auth"
 	"github.com/R3PTR/go-auth-api/config"
 	"github.com/R3PTR/go-auth-api/database"
 	"github.com/R3PTR/go-auth-api/emails"
+	"github.com/R3PTR/go-auth-api/oidc"
+	"github.com/R3PTR/go-auth-api/privacy"
+	"github.com/R3PTR/go-auth-api/roles"
 	"github.com/R3PTR/go-auth-api/sites"
+	"github.com/R3PTR/go-auth-api/throttling"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -30,27 +35,111 @@ func main() {
 	defer mongoClient.Close()
 	//
 	emailSender := emails.NewEmailSender("ems@te-autoteile.de", "localhost", 1025, "", "")
+	// Security audit log
+	auditDbService := audit.NewAuditDbService(mongoClient)
+	err = auditDbService.EnsureIndexes()
+	if err != nil {
+		fmt.Println("Error creating indexes:", err)
+		return
+	}
+	auditService := audit.NewAuditService(auditDbService)
+	auditController := audit.NewAuditController(auditService)
+	// Roles and their permissions
+	rolesDbService := roles.NewRolesDbService(mongoClient)
+	roleService := roles.NewRoleService(rolesDbService, auditService)
+	err = roleService.Start()
+	if err != nil {
+		fmt.Println("Error loading roles:", err)
+		return
+	}
+	roleController := roles.NewRoleController(roleService)
 	// AuthDbService
 	authDbService := auth.NewAuthDbService(mongoClient)
-	authService := auth.NewAuthService(mongoClient, config, authDbService, emailSender)
+	err = authDbService.EnsureIndexes()
+	if err != nil {
+		fmt.Println("Error creating indexes:", err)
+		return
+	}
+	// Revocation list for the stateless token verification
+	revocationList := auth.NewRevocationList(mongoClient, config)
+	err = revocationList.Start()
+	if err != nil {
+		fmt.Println("Error loading revocation list:", err)
+		return
+	}
+	// Signing keys, rotated in the background
+	keyManager, err := auth.NewKeyManager(mongoClient, config)
+	if err != nil {
+		fmt.Println("Error creating key manager:", err)
+		return
+	}
+	err = keyManager.Start()
+	if err != nil {
+		fmt.Println("Error loading signing keys:", err)
+		return
+	}
+	// Brute-force protection
+	throttlingDbService := throttling.NewThrottlingDbService(mongoClient)
+	throttlingService := throttling.NewThrottlingService(throttlingDbService, config)
+	throttlingController := throttling.NewThrottlingController(throttlingService)
+	// Passkeys
+	webAuthn, err := auth.NewWebAuthn(config)
+	if err != nil {
+		fmt.Println("Error configuring WebAuthn:", err)
+		return
+	}
+	// Directories that can authenticate users besides their local password
+	credentialBackends := []auth.CredentialBackend{}
+	if config.LDAP.Enabled {
+		credentialBackends = append(credentialBackends, auth.NewLDAPBackend(config.LDAP))
+	}
+	authService := auth.NewAuthService(mongoClient, config, authDbService, emailSender, revocationList, keyManager, throttlingService, auditService, roleService, webAuthn, credentialBackends)
 	authController := auth.NewAuthController(authService)
 
 	// AuthMiddleware
 	authMiddleware := auth.NewMiddleware(mongoClient, authDbService, authService)
 	// Create a new router
 
+	// OpenID Connect provider for other apps
+	oidcDbService := oidc.NewOIDCDbService(mongoClient)
+	err = oidcDbService.EnsureIndexes()
+	if err != nil {
+		fmt.Println("Error creating indexes:", err)
+		return
+	}
+	oidcService := oidc.NewOIDCService(oidcDbService, authService, keyManager, auditService, config)
+	oidcController := oidc.NewOIDCController(oidcService)
+
 	// Create SiteServices
 	siteDbService := sites.NewSitesDbService(mongoClient)
-	siteService := sites.NewSiteService(siteDbService)
+	siteService := sites.NewSiteService(siteDbService, auditService)
 	siteController := sites.NewSiteController(siteService)
 
 	// Create AbsencesServices
 	absencesDbService := absences.NewAbsencesDbService(mongoClient)
-	absencesService := absences.NewAbsencesService(absencesDbService)
+	absencesService := absences.NewAbsencesService(absencesDbService, auditService)
 	absencesController := absences.NewAbsencesController(absencesService)
+	// Purged users leave their absences behind for the statistics, but anonymized
+	authService.RegisterPurgeHook(absencesService.AnonymizeUserAbsences)
+	// The audit log keeps what happened to and by purged users, but not who they were
+	authService.RegisterPurgeHook(auditService.AnonymizeUserEntries)
+	err = authService.StartPurge()
+	if err != nil {
+		fmt.Println("Error purging deleted users:", err)
+		return
+	}
+
+	// Data subject requests
+	privacyService := privacy.NewPrivacyService(authService, absencesService, auditService)
+	privacyController := privacy.NewPrivacyController(privacyService)
 
 	router := gin.Default()
 
+	// Token types of the routes an admin can call while impersonating a user, never password or 2FA routes
+	userTokens := []string{"LoginToken", "ImpersonationToken"}
+	// Token types of the routes that scripts and service accounts can call besides humans
+	integrationTokens := []string{"LoginToken", "ImpersonationToken", "APIKey", "ServiceToken"}
+
 	// Cors Config
 	cors_config := cors.DefaultConfig()
 	cors_config.AllowOrigins = []string{"*"}
@@ -58,61 +147,183 @@ func main() {
 	cors_config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	cors_config.AllowCredentials = true
 	router.Use(cors.New(cors_config))
+	// Public keys for services that verify our tokens
+	router.GET("/.well-known/jwks.json", authController.JWKS)
+	router.GET("/.well-known/openid-configuration", oidcController.Discovery)
 	// Register the routes
 	authRouter := router.Group("/auth")
 	{
 		// GET Routes
-		authRouter.GET("/getOwnUser", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authController.GetOwnUser)
-		authRouter.GET("/getAllUsers", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER"}, []string{"LoginToken"}), authController.GetAllUsers)
+		authRouter.GET("/getOwnUser", authMiddleware.AuthMiddleware("", userTokens), authController.GetOwnUser)
+		authRouter.GET("/passwordPolicy", authController.GetPasswordPolicy)
+		authRouter.GET("/getAllUsers", authMiddleware.AuthMiddleware(roles.UsersRead, integrationTokens), authController.GetAllUsers)
+		authRouter.GET("/sessions", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.GetSessions)
+		authRouter.GET("/webauthn/credentials", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.GetPasskeys)
+		authRouter.GET("/external/providers", authController.GetExternalProviders)
+		authRouter.GET("/external/identities", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.GetExternalIdentities)
+		authRouter.GET("/login/external/:provider", authController.BeginExternalLogin)
+		authRouter.GET("/apiKeys", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.GetAPIKeys)
+		authRouter.GET("/users/:id/apiKeys", authMiddleware.AuthMiddleware(roles.APIKeysManage, []string{"LoginToken"}), authController.GetUserAPIKeys)
+		authRouter.GET("/serviceAccounts", authMiddleware.AuthMiddleware(roles.ServiceAccountsManage, []string{"LoginToken"}), authController.GetServiceAccounts)
+		authRouter.GET("/deletedUsers", authMiddleware.AuthMiddleware(roles.UsersDelete, []string{"LoginToken"}), authController.GetDeletedUsers)
+		authRouter.GET("/invitations", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.GetInvitations)
+		authRouter.GET("/users/:id/sessions", authMiddleware.AuthMiddleware(roles.SessionsManage, []string{"LoginToken"}), authController.GetUserSessions)
 		// POST Routes
 		authRouter.POST("/login", authController.Login)
-		authRouter.POST("/logout", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authController.Logout)
-		authRouter.POST("/createUser", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), authController.CreateUser)
-		authRouter.POST("/deleteOtherUser", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), authController.DeleteOtherUser)
-		authRouter.POST("/activateUser", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"ActivationToken"}), authController.ActivateUser)
-		authRouter.POST("/resetPassword", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"ResetToken"}), authController.ResetPassword)
+		authRouter.POST("/refresh", authController.Refresh)
+		authRouter.POST("/verify2FA", authMiddleware.AuthMiddleware("", []string{"TwoFactorToken"}), authController.VerifyTwoFactor)
+		authRouter.POST("/webauthn/login/begin", authController.BeginWebAuthnLogin)
+		authRouter.POST("/webauthn/login/finish", authController.FinishWebAuthnLogin)
+		authRouter.POST("/webauthn/verify2FA/begin", authMiddleware.AuthMiddleware("", []string{"TwoFactorToken"}), authController.BeginWebAuthnTwoFactor)
+		authRouter.POST("/webauthn/verify2FA/finish", authMiddleware.AuthMiddleware("", []string{"TwoFactorToken"}), authController.FinishWebAuthnTwoFactor)
+		authRouter.POST("/webauthn/register/begin", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.BeginWebAuthnRegistration)
+		authRouter.POST("/webauthn/register/finish", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.FinishWebAuthnRegistration)
+		authRouter.POST("/login/external/:provider/callback", authController.FinishExternalLogin)
+		authRouter.POST("/external/:provider/link/begin", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.BeginExternalLink)
+		authRouter.POST("/external/:provider/link/finish", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.FinishExternalLink)
+		authRouter.POST("/apiKeys", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.CreateAPIKey)
+		authRouter.POST("/users/:id/apiKeys", authMiddleware.AuthMiddleware(roles.APIKeysManage, []string{"LoginToken"}), authController.CreateUserAPIKey)
+		authRouter.POST("/token", authController.Token)
+		authRouter.POST("/serviceAccounts", authMiddleware.AuthMiddleware(roles.ServiceAccountsManage, []string{"LoginToken"}), authController.CreateServiceAccount)
+		authRouter.POST("/serviceAccounts/:id/disable", authMiddleware.AuthMiddleware(roles.ServiceAccountsManage, []string{"LoginToken"}), authController.DisableServiceAccount)
+		authRouter.POST("/serviceAccounts/:id/enable", authMiddleware.AuthMiddleware(roles.ServiceAccountsManage, []string{"LoginToken"}), authController.EnableServiceAccount)
+		authRouter.POST("/serviceAccounts/:id/rotateSecret", authMiddleware.AuthMiddleware(roles.ServiceAccountsManage, []string{"LoginToken"}), authController.RotateServiceAccountSecret)
+		authRouter.POST("/logout", authMiddleware.AuthMiddleware("", userTokens), authController.Logout)
+		authRouter.POST("/reauthenticate", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.Reauthenticate)
+		authRouter.POST("/reauthenticate/passkey/begin", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.BeginWebAuthnTwoFactor)
+		authRouter.POST("/createUser", authMiddleware.AuthMiddleware(roles.UsersWrite, integrationTokens), authController.CreateUser)
+		authRouter.POST("/importUsers", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.ImportUsers)
+		authRouter.POST("/impersonate", authMiddleware.AuthMiddleware(roles.UsersImpersonate, []string{"LoginToken"}), authController.Impersonate)
+		authRouter.POST("/impersonation/end", authMiddleware.AuthMiddleware("", []string{"ImpersonationToken"}), authController.EndImpersonation)
+		authRouter.POST("/users/:id/suspend", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.SuspendUser)
+		authRouter.POST("/users/:id/disable", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.DisableUser)
+		authRouter.POST("/users/:id/restore", authMiddleware.AuthMiddleware(roles.UsersDelete, []string{"LoginToken"}), authController.RestoreUser)
+		authRouter.POST("/deleteOwnUser", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.DeleteOwnUser)
+		authRouter.POST("/deleteOtherUser", authMiddleware.AuthMiddleware(roles.UsersDelete, []string{"LoginToken"}), authController.DeleteOtherUser)
+		authRouter.POST("/invitations/open", authController.OpenInvitation)
+		authRouter.POST("/invitations/accept", authController.AcceptInvitation)
+		authRouter.POST("/invitations/:id/resend", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.ResendInvitation)
+		authRouter.POST("/users/:id/invite", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.InviteUserAgain)
+		authRouter.POST("/invitations/:id/revoke", authMiddleware.AuthMiddleware(roles.UsersWrite, []string{"LoginToken"}), authController.RevokeInvitation)
+		authRouter.POST("/resetPassword", authController.ResetPassword)
+		authRouter.POST("/emailChange/confirm", authController.ConfirmEmailChange)
+		authRouter.POST("/emailChange/cancel", authController.CancelEmailChange)
 		authRouter.POST("/forgotPassword", authController.ForgotPassword)
-		authRouter.POST("/changePassword", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authMiddleware.PasswordMiddleware(), authController.ChangePassword)
-		authRouter.POST("/updateOwnUser", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authController.UpdateOwnUser)
-		authRouter.POST("/updateOtherUser", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), authController.UpdateOtherUser)
-		//authRouter.POST("/getTOTP", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authController.GetTOTP)
-		//authRouter.POST("/activateTOTP", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authController.ActivateTOTP)
-		//authRouter.POST("/deactivateTOTP", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authMiddleware.TOTPMiddleware(), authController.DeactivateTOTP)
-		//authRouter.POST("regenerateBackupCodes", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), authMiddleware.TOTPMiddleware(), authController.RegenerateBackupCodes)
+		authRouter.POST("/magicLink", authController.RequestMagicLink)
+		authRouter.POST("/magicLink/verify", authController.VerifyMagicLink)
+		authRouter.POST("/changePassword", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.ChangePassword)
+		authRouter.POST("/updateOwnUser", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.UpdateOwnUser)
+		authRouter.POST("/updateOtherUser", authMiddleware.AuthMiddleware(roles.UsersWrite, integrationTokens), authController.UpdateOtherUser)
+		authRouter.POST("/getTOTP", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.GetTOTP)
+		authRouter.POST("/activateTOTP", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.ActivateTOTP)
+		authRouter.POST("/deactivateTOTP", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.DeactivateTOTP)
+		authRouter.POST("/regenerateBackupCodes", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.RegenerateBackupCodes)
+		// DELETE Routes
+		authRouter.DELETE("/sessions/:id", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.RevokeSession)
+		authRouter.DELETE("/webauthn/credentials/:id", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authMiddleware.ReauthenticationMiddleware(), authController.DeletePasskey)
+		authRouter.DELETE("/external/identities/:id", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.UnlinkExternalIdentity)
+		authRouter.DELETE("/apiKeys/:id", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), authController.RevokeAPIKey)
+		authRouter.DELETE("/users/:id/apiKeys/:keyId", authMiddleware.AuthMiddleware(roles.APIKeysManage, []string{"LoginToken"}), authController.RevokeUserAPIKey)
+		authRouter.DELETE("/serviceAccounts/:id", authMiddleware.AuthMiddleware(roles.ServiceAccountsManage, []string{"LoginToken"}), authController.DeleteServiceAccount)
+		authRouter.DELETE("/users/:id/sessions", authMiddleware.AuthMiddleware(roles.SessionsManage, []string{"LoginToken"}), authController.RevokeAllUserSessions)
+		authRouter.DELETE("/users/:id/sessions/:sessionId", authMiddleware.AuthMiddleware(roles.SessionsManage, []string{"LoginToken"}), authController.RevokeUserSession)
 	}
 
 	// Sites Routes
 	siteRouter := router.Group("/sites")
 	{
 		// GET Routes
-		siteRouter.GET("/getSites", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), siteController.GetSites)
-		siteRouter.GET("/getWorkspaces", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), siteController.GetWorkspaces)
+		siteRouter.GET("/getSites", authMiddleware.AuthMiddleware(roles.SitesRead, integrationTokens), siteController.GetSites)
+		siteRouter.GET("/getWorkspaces", authMiddleware.AuthMiddleware(roles.SitesRead, integrationTokens), siteController.GetWorkspaces)
 		// POST Routes
-		siteRouter.POST("/createSite", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), siteController.CreateSite)
-		siteRouter.POST("/createWorkspace", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), siteController.CreateWorkspace)
+		siteRouter.POST("/createSite", authMiddleware.AuthMiddleware(roles.SitesWrite, integrationTokens), siteController.CreateSite)
+		siteRouter.POST("/createWorkspace", authMiddleware.AuthMiddleware(roles.SitesWrite, integrationTokens), siteController.CreateWorkspace)
 		// PUT Routes
-		siteRouter.PUT("/updateSite", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), siteController.UpdateSite)
-		siteRouter.PUT("/updateWorkspace", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), siteController.UpdateWorkspace)
+		siteRouter.PUT("/updateSite", authMiddleware.AuthMiddleware(roles.SitesWrite, integrationTokens), siteController.UpdateSite)
+		siteRouter.PUT("/updateWorkspace", authMiddleware.AuthMiddleware(roles.SitesWrite, integrationTokens), siteController.UpdateWorkspace)
 		// DELETE Routes
-		siteRouter.DELETE("/deleteSite/:id", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), siteController.DeleteSite)
-		siteRouter.DELETE("/deleteWorkspace/:id", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), siteController.DeleteWorkspace)
+		siteRouter.DELETE("/deleteSite/:id", authMiddleware.AuthMiddleware(roles.SitesWrite, integrationTokens), siteController.DeleteSite)
+		siteRouter.DELETE("/deleteWorkspace/:id", authMiddleware.AuthMiddleware(roles.SitesWrite, integrationTokens), siteController.DeleteWorkspace)
 	}
 	// Absences Routes
 	absencesRouter := router.Group("/absences")
 	{
 		// GET Routes
-		absencesRouter.GET("/getAbsences", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), absencesController.GetAllAbsences)
-		absencesRouter.GET("/getOwnAbsences", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), absencesController.GetAbsences)
+		absencesRouter.GET("/getAbsences", authMiddleware.AuthMiddleware(roles.AbsencesRead, integrationTokens), absencesController.GetAllAbsences)
+		absencesRouter.GET("/getOwnAbsences", authMiddleware.AuthMiddleware(roles.AbsencesRequest, userTokens), absencesController.GetAbsences)
+
+		// POST Routes
+		absencesRouter.POST("/createAbsence", authMiddleware.AuthMiddleware(roles.AbsencesRequest, userTokens), absencesController.CreateAbsence)
+
+		// PUT Routes
+		absencesRouter.PUT("/updateOwnAbsence", authMiddleware.AuthMiddleware(roles.AbsencesRequest, userTokens), absencesController.UpdateOwnAbsence)
+		absencesRouter.PUT("/updateAbsenceAsAdmin", authMiddleware.AuthMiddleware(roles.AbsencesApprove, integrationTokens), absencesController.UpdateAbsenceAsAdmin)
+
+		// DELETE Routes
+		absencesRouter.DELETE("/deleteAbsence/:id", authMiddleware.AuthMiddleware(roles.AbsencesDelete, userTokens), absencesController.DeleteAbsence)
+	}
+
+	// Privacy Routes
+	privacyRouter := router.Group("/privacy")
+	{
+		// GET Routes
+		privacyRouter.GET("/export", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), privacyController.ExportOwnData)
+		privacyRouter.GET("/users/:id/export", authMiddleware.AuthMiddleware(roles.PrivacyManage, []string{"LoginToken"}), privacyController.ExportUserData)
 
 		// POST Routes
-		absencesRouter.POST("/createAbsence", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), absencesController.CreateAbsence)
+		privacyRouter.POST("/users/:id/erase", authMiddleware.AuthMiddleware(roles.PrivacyManage, []string{"LoginToken"}), privacyController.EraseUser)
+	}
+
+	// Throttling Routes
+	throttlingRouter := router.Group("/throttling")
+	{
+		// GET Routes
+		throttlingRouter.GET("/getLocks", authMiddleware.AuthMiddleware(roles.ThrottlingManage, []string{"LoginToken"}), throttlingController.GetLocks)
+
+		// DELETE Routes
+		throttlingRouter.DELETE("/clearLock/:id", authMiddleware.AuthMiddleware(roles.ThrottlingManage, []string{"LoginToken"}), throttlingController.ClearLock)
+	}
+
+	// Roles Routes
+	rolesRouter := router.Group("/roles")
+	{
+		// GET Routes
+		rolesRouter.GET("/getRoles", authMiddleware.AuthMiddleware(roles.RolesManage, []string{"LoginToken"}), roleController.GetRoles)
+		rolesRouter.GET("/getPermissions", authMiddleware.AuthMiddleware(roles.RolesManage, []string{"LoginToken"}), roleController.GetPermissions)
+
+		// POST Routes
+		rolesRouter.POST("/createRole", authMiddleware.AuthMiddleware(roles.RolesManage, []string{"LoginToken"}), roleController.CreateRole)
 
 		// PUT Routes
-		absencesRouter.PUT("/updateOwnAbsence", authMiddleware.AuthMiddleware([]string{"ADMIN", "USER", "DRIVER"}, []string{"LoginToken"}), absencesController.UpdateOwnAbsence)
-		absencesRouter.PUT("/updateAbsenceAsAdmin", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), absencesController.UpdateAbsenceAsAdmin)
+		rolesRouter.PUT("/updateRole", authMiddleware.AuthMiddleware(roles.RolesManage, []string{"LoginToken"}), roleController.UpdateRole)
+
+		// DELETE Routes
+		rolesRouter.DELETE("/deleteRole/:name", authMiddleware.AuthMiddleware(roles.RolesManage, []string{"LoginToken"}), roleController.DeleteRole)
+	}
+
+	// Audit Routes
+	auditRouter := router.Group("/audit")
+	{
+		// GET Routes
+		auditRouter.GET("/getEntries", authMiddleware.AuthMiddleware(roles.AuditRead, integrationTokens), auditController.GetEntries)
+	}
+
+	// OIDC Routes
+	oidcRouter := router.Group("/oidc")
+	{
+		// GET Routes
+		oidcRouter.GET("/authorize", oidcController.StartAuthorization)
+		oidcRouter.GET("/userinfo", authMiddleware.AuthMiddleware("", []string{"OIDCAccessToken"}), oidcController.UserInfo)
+		oidcRouter.GET("/getClients", authMiddleware.AuthMiddleware(roles.OIDCClientsManage, []string{"LoginToken"}), oidcController.GetClients)
+
+		// POST Routes
+		oidcRouter.POST("/authorize", authMiddleware.AuthMiddleware("", []string{"LoginToken"}), oidcController.Authorize)
+		oidcRouter.POST("/token", oidcController.Token)
+		oidcRouter.POST("/userinfo", authMiddleware.AuthMiddleware("", []string{"OIDCAccessToken"}), oidcController.UserInfo)
+		oidcRouter.POST("/createClient", authMiddleware.AuthMiddleware(roles.OIDCClientsManage, []string{"LoginToken"}), oidcController.CreateClient)
 
 		// DELETE Routes
-		absencesRouter.DELETE("/deleteAbsence/:id", authMiddleware.AuthMiddleware([]string{"ADMIN"}, []string{"LoginToken"}), absencesController.DeleteAbsence)
+		oidcRouter.DELETE("/deleteClient/:id", authMiddleware.AuthMiddleware(roles.OIDCClientsManage, []string{"LoginToken"}), oidcController.DeleteClient)
 	}
 
 	router.Run(":9090")
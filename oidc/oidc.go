@@ -0,0 +1,379 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/auth"
+	"github.com/R3PTR/go-auth-api/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes clients can request, openid is required
+const (
+	ScopeOpenId  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+var supportedScopes = []string{ScopeOpenId, ScopeProfile, ScopeEmail}
+
+// Error is an OAuth 2.0 error, Code is one of the error codes of RFC 6749
+type Error struct {
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	return e.Description
+}
+
+// AuthorizeResult tells the frontend where to send the user after an authorization request
+type AuthorizeResult struct {
+	RedirectTo      string   `json:"redirect_to,omitempty"`
+	ConsentRequired bool     `json:"consent_required,omitempty"`
+	Client          string   `json:"client,omitempty"`
+	Scopes          []string `json:"scopes,omitempty"`
+}
+
+// OIDCService lets other apps log users in through the authorization code flow with PKCE.
+type OIDCService struct {
+	oidcDbService *OIDCDbService
+	authService   *auth.AuthService
+	keyManager    *auth.KeyManager
+	auditService  *audit.AuditService
+	config        *config.Config
+}
+
+func NewOIDCService(oidcDbService *OIDCDbService, authService *auth.AuthService, keyManager *auth.KeyManager, auditService *audit.AuditService, config *config.Config) *OIDCService {
+	return &OIDCService{oidcDbService: oidcDbService, authService: authService, keyManager: keyManager, auditService: auditService, config: config}
+}
+
+// Discovery returns the provider metadata served at /.well-known/openid-configuration
+func (o *OIDCService) Discovery() Discovery {
+	issuer := strings.TrimSuffix(o.config.OIDC.IssuerURL, "/")
+	return Discovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oidc/authorize",
+		TokenEndpoint:                     issuer + "/oidc/token",
+		UserinfoEndpoint:                  issuer + "/oidc/userinfo",
+		JwksURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  o.keyManager.Algorithms(),
+		ScopesSupported:                   supportedScopes,
+		ClaimsSupported:                   []string{"sub", "role", "name", "given_name", "family_name", "preferred_username", "email"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}
+}
+
+// GetClients returns all registered clients
+func (o *OIDCService) GetClients() ([]Client, error) {
+	return o.oidcDbService.GetClients()
+}
+
+// CreateClient registers a client. The secret of confidential clients is only returned here.
+func (o *OIDCService) CreateClient(createClientRequest CreateClientRequest, actor audit.Actor) (*Client, string, error) {
+	if len(createClientRequest.RedirectURIs) == 0 {
+		return nil, "", errors.New("at least one redirect URI is required")
+	}
+	for _, redirectURI := range createClientRequest.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return nil, "", errors.New("redirect URIs have to be absolute URLs without fragment")
+		}
+	}
+	clientId, err := generateClientId()
+	if err != nil {
+		return nil, "", err
+	}
+	timestamp := time.Now()
+	client := Client{
+		Id:           clientId,
+		Name:         createClientRequest.Name,
+		RedirectURIs: createClientRequest.RedirectURIs,
+		FirstParty:   createClientRequest.FirstParty,
+		Public:       createClientRequest.Public,
+		InsertedAt:   timestamp,
+		UpdatedAt:    timestamp,
+	}
+	secret := ""
+	if !client.Public {
+		secret, err = generateOpaqueToken()
+		if err != nil {
+			return nil, "", err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+	err = o.oidcDbService.CreateClient(client)
+	if err != nil {
+		return nil, "", err
+	}
+	o.auditService.Record(actor, audit.OIDCClientCreated, "oidc_client", client.Id, nil, client)
+	return &client, secret, nil
+}
+
+// DeleteClient deletes a client together with its pending authorization codes
+func (o *OIDCService) DeleteClient(clientId string, actor audit.Actor) error {
+	client, err := o.oidcDbService.GetClientById(clientId)
+	if err != nil {
+		return errors.New("Client not found")
+	}
+	err = o.oidcDbService.DeleteClient(clientId)
+	if err != nil {
+		return err
+	}
+	err = o.oidcDbService.DeleteCodesByClientId(clientId)
+	if err != nil {
+		return err
+	}
+	o.auditService.Record(actor, audit.OIDCClientDeleted, "oidc_client", clientId, *client, nil)
+	return nil
+}
+
+// getClientForRedirect returns the client if the redirect URI is registered for it.
+// Errors of this check are never sent to the redirect URI.
+func (o *OIDCService) getClientForRedirect(clientId, redirectURI string) (*Client, error) {
+	client, err := o.oidcDbService.GetClientById(clientId)
+	if err != nil {
+		return nil, errors.New("unknown client")
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return nil, errors.New("redirect_uri is not registered for the client")
+	}
+	return client, nil
+}
+
+// LoginRedirect checks the client of an authorization request and returns the
+// URL of the login page, which continues the request once the user is logged in.
+func (o *OIDCService) LoginRedirect(authorizeRequest AuthorizeRequest, rawQuery string) (string, error) {
+	_, err := o.getClientForRedirect(authorizeRequest.ClientId, authorizeRequest.RedirectURI)
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if strings.Contains(o.config.OIDC.LoginURL, "?") {
+		separator = "&"
+	}
+	return o.config.OIDC.LoginURL + separator + rawQuery, nil
+}
+
+// Authorize issues an authorization code for the logged in user. Third-party
+// clients need the consent of the user, first-party clients skip it.
+func (o *OIDCService) Authorize(authorizeRequest AuthorizeRequest, user *auth.User, actor audit.Actor) (*AuthorizeResult, error) {
+	client, err := o.getClientForRedirect(authorizeRequest.ClientId, authorizeRequest.RedirectURI)
+	if err != nil {
+		return nil, err
+	}
+	if authorizeRequest.ResponseType != "code" {
+		return errorRedirect(authorizeRequest, "unsupported_response_type", "only the code response type is supported"), nil
+	}
+	scopes := strings.Fields(authorizeRequest.Scope)
+	if !slices.Contains(scopes, ScopeOpenId) {
+		return errorRedirect(authorizeRequest, "invalid_scope", "the openid scope is required"), nil
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(supportedScopes, scope) {
+			return errorRedirect(authorizeRequest, "invalid_scope", "unsupported scope "+scope), nil
+		}
+	}
+	if authorizeRequest.CodeChallenge == "" || authorizeRequest.CodeChallengeMethod != "S256" {
+		return errorRedirect(authorizeRequest, "invalid_request", "a S256 code_challenge is required"), nil
+	}
+	if !client.FirstParty && !authorizeRequest.Consent {
+		return &AuthorizeResult{ConsentRequired: true, Client: client.Name, Scopes: scopes}, nil
+	}
+	code, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	err = o.oidcDbService.CreateCode(authorizationCode{
+		Id:                  hashToken(code),
+		ClientId:            client.Id,
+		UserId:              user.Id,
+		RedirectURI:         authorizeRequest.RedirectURI,
+		Scope:               strings.Join(scopes, " "),
+		Nonce:               authorizeRequest.Nonce,
+		CodeChallenge:       authorizeRequest.CodeChallenge,
+		CodeChallengeMethod: authorizeRequest.CodeChallengeMethod,
+		AuthTime:            time.Now(),
+		Expires:             time.Now().Add(time.Duration(o.config.OIDC.CodeSeconds) * time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.auditService.Record(actor, audit.OIDCAuthorized, "oidc_client", client.Id, nil, nil)
+	query := url.Values{"code": {code}}
+	if authorizeRequest.State != "" {
+		query.Set("state", authorizeRequest.State)
+	}
+	return &AuthorizeResult{RedirectTo: appendQuery(authorizeRequest.RedirectURI, query)}, nil
+}
+
+// Token exchanges an authorization code for an access token and an ID token
+func (o *OIDCService) Token(tokenRequest TokenRequest, actor audit.Actor) (*TokenResponse, error) {
+	if tokenRequest.GrantType != "authorization_code" {
+		return nil, &Error{Code: "unsupported_grant_type", Description: "only the authorization_code grant is supported"}
+	}
+	client, err := o.authenticateClient(tokenRequest.ClientId, tokenRequest.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	code, err := o.oidcDbService.UseCode(hashToken(tokenRequest.Code))
+	if err != nil {
+		return nil, &Error{Code: "invalid_grant", Description: "authorization code is invalid or expired"}
+	}
+	if code.ClientId != client.Id || code.RedirectURI != tokenRequest.RedirectURI {
+		return nil, &Error{Code: "invalid_grant", Description: "authorization code was issued to another client or redirect_uri"}
+	}
+	if !verifyCodeChallenge(code.CodeChallenge, tokenRequest.CodeVerifier) {
+		return nil, &Error{Code: "invalid_grant", Description: "code_verifier does not match the code_challenge"}
+	}
+	user, err := o.authService.AuthDbService.GetUserbyId(code.UserId)
+	if err != nil || user.State != auth.ACTIVE {
+		return nil, &Error{Code: "invalid_grant", Description: "user is not active"}
+	}
+	accessToken, expires, err := o.authService.IssueOIDCAccessToken(user, client.Id, code.Scope)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := o.issueIdToken(user, client, code, expires)
+	if err != nil {
+		return nil, err
+	}
+	actor.UserId = user.Id
+	actor.Username = user.Username
+	o.auditService.Record(actor, audit.OIDCTokenIssued, "oidc_client", client.Id, nil, nil)
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(time.Until(expires).Seconds()),
+		IdToken:     idToken,
+		Scope:       code.Scope,
+	}, nil
+}
+
+// UserInfo returns the claims about the user that the scopes of the access token allow
+func (o *OIDCService) UserInfo(claims *auth.TokenClaims) (map[string]interface{}, error) {
+	user, err := o.authService.AuthDbService.GetUserbyId(claims.Subject)
+	if err != nil {
+		return nil, errors.New("User not found")
+	}
+	userInfo := map[string]interface{}{"sub": user.Id, "role": user.Role}
+	scopes := strings.Fields(claims.Scope)
+	if slices.Contains(scopes, ScopeProfile) {
+		userInfo["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		userInfo["given_name"] = user.FirstName
+		userInfo["family_name"] = user.LastName
+		userInfo["preferred_username"] = user.Username
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		userInfo["email"] = user.Username
+	}
+	return userInfo, nil
+}
+
+// authenticateClient checks the client secret of confidential clients, public clients rely on PKCE
+func (o *OIDCService) authenticateClient(clientId, clientSecret string) (*Client, error) {
+	client, err := o.oidcDbService.GetClientById(clientId)
+	if err != nil {
+		return nil, &Error{Code: "invalid_client", Description: "client authentication failed"}
+	}
+	if client.Public {
+		return client, nil
+	}
+	if clientSecret == "" || subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(client.SecretHash)) != 1 {
+		return nil, &Error{Code: "invalid_client", Description: "client authentication failed"}
+	}
+	return client, nil
+}
+
+// issueIdToken signs an ID token with the same keys as our own tokens, clients verify it with the JWKS
+func (o *OIDCService) issueIdToken(user *auth.User, client *Client, code *authorizationCode, expires time.Time) (string, error) {
+	scopes := strings.Fields(code.Scope)
+	claims := IdTokenClaims{
+		Nonce:    code.Nonce,
+		AuthTime: code.AuthTime.Unix(),
+		Role:     user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    strings.TrimSuffix(o.config.OIDC.IssuerURL, "/"),
+			Subject:   user.Id,
+			Audience:  jwt.ClaimStrings{client.Id},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	if slices.Contains(scopes, ScopeProfile) {
+		claims.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims.GivenName = user.FirstName
+		claims.FamilyName = user.LastName
+		claims.PreferredUsername = user.Username
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		claims.Email = user.Username
+	}
+	return o.keyManager.Sign(claims)
+}
+
+// errorRedirect sends an error of a valid client back to its redirect URI
+func errorRedirect(authorizeRequest AuthorizeRequest, code, description string) *AuthorizeResult {
+	query := url.Values{"error": {code}, "error_description": {description}}
+	if authorizeRequest.State != "" {
+		query.Set("state", authorizeRequest.State)
+	}
+	return &AuthorizeResult{RedirectTo: appendQuery(authorizeRequest.RedirectURI, query)}
+}
+
+// appendQuery adds the query parameters to a URL that may already have some
+func appendQuery(rawURL string, query url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query.Encode()
+	}
+	return rawURL + "?" + query.Encode()
+}
+
+// verifyCodeChallenge checks the PKCE code verifier against the S256 challenge
+func verifyCodeChallenge(codeChallenge, codeVerifier string) bool {
+	if codeVerifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(codeChallenge)) == 1
+}
+
+// generateClientId returns a random client id
+func generateClientId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// generateOpaqueToken returns a random URL safe token
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the SHA-256 hash of a code or client secret as stored in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,147 @@
+package oidc
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type OIDCController struct {
+	oidcService *OIDCService
+}
+
+func NewOIDCController(oidcService *OIDCService) *OIDCController {
+	return &OIDCController{oidcService: oidcService}
+}
+
+// Discovery returns the OpenID Provider metadata.
+func (oc *OIDCController) Discovery(c *gin.Context) {
+	c.JSON(http.StatusOK, oc.oidcService.Discovery())
+}
+
+// StartAuthorization sends the browser of the user to the login page of the frontend.
+func (oc *OIDCController) StartAuthorization(c *gin.Context) {
+	var authorizeRequest AuthorizeRequest
+	if err := c.ShouldBindQuery(&authorizeRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	loginURL, err := oc.oidcService.LoginRedirect(authorizeRequest, c.Request.URL.RawQuery)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, loginURL)
+}
+
+// Authorize is called by the frontend once the user is logged in and returns where to send the browser.
+func (oc *OIDCController) Authorize(c *gin.Context) {
+	var authorizeRequest AuthorizeRequest
+	if err := c.ShouldBindJSON(&authorizeRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*auth.User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	result, err := oc.oidcService.Authorize(authorizeRequest, user, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Token exchanges an authorization code for tokens. Errors follow RFC 6749.
+func (oc *OIDCController) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	var tokenRequest TokenRequest
+	if err := c.ShouldBind(&tokenRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	if clientId, clientSecret, ok := c.Request.BasicAuth(); ok {
+		tokenRequest.ClientId = clientId
+		tokenRequest.ClientSecret = clientSecret
+	}
+	response, err := oc.oidcService.Token(tokenRequest, audit.ActorFromContext(c))
+	if err != nil {
+		var oauthError *Error
+		if !errors.As(err, &oauthError) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+			return
+		}
+		status := http.StatusBadRequest
+		if oauthError.Code == "invalid_client" {
+			status = http.StatusUnauthorized
+		}
+		c.JSON(status, gin.H{"error": oauthError.Code, "error_description": oauthError.Description})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// UserInfo returns the claims about the owner of an OIDC access token.
+func (oc *OIDCController) UserInfo(c *gin.Context) {
+	claims_unasserted, exists := c.Get("claims")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	claims, ok := claims_unasserted.(*auth.TokenClaims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userInfo, err := oc.oidcService.UserInfo(claims)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, userInfo)
+}
+
+// GetClients returns all registered clients.
+func (oc *OIDCController) GetClients(c *gin.Context) {
+	clients, err := oc.oidcService.GetClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+// CreateClient registers a client and returns its secret once.
+func (oc *OIDCController) CreateClient(c *gin.Context) {
+	var createClientRequest CreateClientRequest
+	if err := c.ShouldBindJSON(&createClientRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	client, secret, err := oc.oidcService.CreateClient(createClientRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Client created", "client": client, "client_secret": secret})
+}
+
+// DeleteClient deletes a client.
+func (oc *OIDCController) DeleteClient(c *gin.Context) {
+	err := oc.oidcService.DeleteClient(c.Param("id"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted"})
+}
@@ -0,0 +1,108 @@
+package oidc
+
+import (
+	"context"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OIDCDbService struct {
+	mongoClient *database.MongoDBClient
+}
+
+func NewOIDCDbService(mongoClient *database.MongoDBClient) *OIDCDbService {
+	return &OIDCDbService{mongoClient: mongoClient}
+}
+
+// getClientCollection returns the client collection.
+func (o *OIDCDbService) getClientCollection() *mongo.Collection {
+	return o.mongoClient.GetCollection(o.mongoClient.Config.UserDatabase, o.mongoClient.Config.OIDC.ClientCollection)
+}
+
+// getCodeCollection returns the authorization code collection.
+func (o *OIDCDbService) getCodeCollection() *mongo.Collection {
+	return o.mongoClient.GetCollection(o.mongoClient.Config.UserDatabase, o.mongoClient.Config.OIDC.CodeCollection)
+}
+
+// EnsureIndexes lets MongoDB remove expired authorization codes.
+func (o *OIDCDbService) EnsureIndexes() error {
+	_, err := o.getCodeCollection().Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"expires": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// GetClients returns all clients.
+func (o *OIDCDbService) GetClients() ([]Client, error) {
+	clients := []Client{}
+	cursor, err := o.getClientCollection().Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var client Client
+		err := cursor.Decode(&client)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, cursor.Err()
+}
+
+// GetClientById returns a client by its client id.
+func (o *OIDCDbService) GetClientById(id string) (*Client, error) {
+	var client Client
+	err := o.getClientCollection().FindOne(context.Background(), bson.M{"_id": id}).Decode(&client)
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// CreateClient creates a new client.
+func (o *OIDCDbService) CreateClient(client Client) error {
+	_, err := o.getClientCollection().InsertOne(context.Background(), client)
+	return err
+}
+
+// DeleteClient deletes a client.
+func (o *OIDCDbService) DeleteClient(id string) error {
+	result, err := o.getClientCollection().DeleteOne(context.Background(), bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// DeleteCodesByClientId deletes the pending authorization codes of a client.
+func (o *OIDCDbService) DeleteCodesByClientId(clientId string) error {
+	_, err := o.getCodeCollection().DeleteMany(context.Background(), bson.M{"clientId": clientId})
+	return err
+}
+
+// CreateCode stores an authorization code.
+func (o *OIDCDbService) CreateCode(code authorizationCode) error {
+	_, err := o.getCodeCollection().InsertOne(context.Background(), code)
+	return err
+}
+
+// UseCode deletes an unexpired authorization code and returns it, so every code works only once.
+func (o *OIDCDbService) UseCode(codeHash string) (*authorizationCode, error) {
+	var code authorizationCode
+	filter := bson.M{"_id": codeHash, "expires": bson.M{"$gt": time.Now()}}
+	err := o.getCodeCollection().FindOneAndDelete(context.Background(), filter).Decode(&code)
+	if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
@@ -0,0 +1,102 @@
+package oidc
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Client is an app that lets its users log in with their account of this service
+type Client struct {
+	Id string `bson:"_id" json:"clientId"`
+	// SecretHash is the SHA-256 hash of the client secret, public clients have none
+	SecretHash   string    `bson:"secretHash,omitempty" json:"-"`
+	Name         string    `bson:"name" json:"name"`
+	RedirectURIs []string  `bson:"redirectUris" json:"redirectUris"`
+	FirstParty   bool      `bson:"firstParty" json:"firstParty"`
+	Public       bool      `bson:"public" json:"public"`
+	InsertedAt   time.Time `bson:"insertedAt" json:"insertedAt"`
+	UpdatedAt    time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// authorizationCode is stored hashed and can be exchanged for tokens once
+type authorizationCode struct {
+	Id                  string    `bson:"_id"`
+	ClientId            string    `bson:"clientId"`
+	UserId              string    `bson:"userId"`
+	RedirectURI         string    `bson:"redirectUri"`
+	Scope               string    `bson:"scope"`
+	Nonce               string    `bson:"nonce,omitempty"`
+	CodeChallenge       string    `bson:"codeChallenge"`
+	CodeChallengeMethod string    `bson:"codeChallengeMethod"`
+	AuthTime            time.Time `bson:"authTime"`
+	Expires             time.Time `bson:"expires"`
+}
+
+// IdTokenClaims are the claims of the ID tokens issued to clients
+type IdTokenClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	AuthTime          int64  `json:"auth_time"`
+	Role              string `json:"role"`
+	Name              string `json:"name,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Discovery is the OpenID Provider metadata
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// TokenResponse is returned by the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IdToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientId            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	// Consent is set once the user agreed to share the scopes with a third-party client
+	Consent bool `json:"consent"`
+}
+
+type TokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	ClientId     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+	CodeVerifier string `form:"code_verifier"`
+}
+
+type CreateClientRequest struct {
+	Name         string   `json:"name" binding:"required"`
+	RedirectURIs []string `json:"redirectUris" binding:"required"`
+	FirstParty   bool     `json:"firstParty"`
+	Public       bool     `json:"public"`
+}
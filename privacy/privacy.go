@@ -0,0 +1,104 @@
+package privacy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/R3PTR/go-auth-api/absences"
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/auth"
+)
+
+// PrivacyService answers data subject requests: exports of the personal data of a
+// user and its erasure. The erasure itself is done by the purge of the AuthService.
+type PrivacyService struct {
+	authService     *auth.AuthService
+	absencesService *absences.AbsencesService
+	auditService    *audit.AuditService
+}
+
+func NewPrivacyService(authService *auth.AuthService, absencesService *absences.AbsencesService, auditService *audit.AuditService) *PrivacyService {
+	return &PrivacyService{authService: authService, absencesService: absencesService, auditService: auditService}
+}
+
+// Export collects the personal data of the user and records the export
+func (p *PrivacyService) Export(userId string, actor audit.Actor) (*Export, error) {
+	user, err := p.authService.ExportUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	userAbsences, err := p.absencesService.GetAbsencesByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := p.authService.GetSessions(userId, "")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := p.auditEntries(userId)
+	if err != nil {
+		return nil, err
+	}
+	if userAbsences == nil {
+		userAbsences = []absences.Absence{}
+	}
+	p.authService.RecordDataExport(userId, actor)
+	return &Export{User: user, Absences: userAbsences, Sessions: sessions, Audit: entries}, nil
+}
+
+// auditEntries returns the entries the user is actor or target of, newest first
+func (p *PrivacyService) auditEntries(userId string) ([]audit.Entry, error) {
+	asTarget, err := p.auditService.GetAllEntries(audit.Filter{TargetId: userId})
+	if err != nil {
+		return nil, err
+	}
+	asActor, err := p.auditService.GetAllEntries(audit.Filter{ActorId: userId})
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	entries := []audit.Entry{}
+	for _, entry := range append(asTarget, asActor...) {
+		if seen[entry.Id] {
+			continue
+		}
+		seen[entry.Id] = true
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Timestamp.After(entries[j].Timestamp) })
+	return entries, nil
+}
+
+// WriteZIP writes the export as ZIP with one JSON file per part
+func (p *PrivacyService) WriteZIP(w io.Writer, export *Export) error {
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"user.json", export.User},
+		{"absences.json", export.Absences},
+		{"sessions.json", export.Sessions},
+		{"audit.json", export.Audit},
+	}
+	for _, file := range files {
+		writer, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.content)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// EraseUser deletes a user and anonymizes the personal data right away
+func (p *PrivacyService) EraseUser(userId, reason string, actor audit.Actor) error {
+	return p.authService.EraseUser(userId, reason, actor)
+}
@@ -0,0 +1,71 @@
+package privacy
+
+import (
+	"net/http"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type PrivacyController struct {
+	privacyService *PrivacyService
+}
+
+func NewPrivacyController(privacyService *PrivacyService) *PrivacyController {
+	return &PrivacyController{privacyService: privacyService}
+}
+
+// ExportOwnData returns the personal data of the user
+func (pc *PrivacyController) ExportOwnData(c *gin.Context) {
+	user_unasserted, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	user, ok := user_unasserted.(*auth.User)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+	pc.export(c, user.Id)
+}
+
+// ExportUserData returns the personal data of another user, for requests that reach an admin
+func (pc *PrivacyController) ExportUserData(c *gin.Context) {
+	pc.export(c, c.Param("id"))
+}
+
+// export writes the personal data of the user as ZIP download, or as JSON with format=json
+func (pc *PrivacyController) export(c *gin.Context, userId string) {
+	export, err := pc.privacyService.Export(userId, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, export)
+		return
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", "attachment; filename=personal_data.zip")
+	err = pc.privacyService.WriteZIP(c.Writer, export)
+	if err != nil {
+		c.Error(err)
+	}
+}
+
+// EraseUser deletes another user and anonymizes the personal data right away
+func (pc *PrivacyController) EraseUser(c *gin.Context) {
+	var eraseUserRequest EraseUserRequest
+	if err := c.ShouldBindJSON(&eraseUserRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := pc.privacyService.EraseUser(c.Param("id"), eraseUserRequest.Reason, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User erased"})
+}
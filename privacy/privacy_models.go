@@ -0,0 +1,19 @@
+package privacy
+
+import (
+	"github.com/R3PTR/go-auth-api/absences"
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/R3PTR/go-auth-api/auth"
+)
+
+// Export is the personal data of a user, each field is a file of the ZIP
+type Export struct {
+	User     *auth.UserExport   `json:"user"`
+	Absences []absences.Absence `json:"absences"`
+	Sessions []auth.Session     `json:"sessions"`
+	Audit    []audit.Entry      `json:"audit"`
+}
+
+type EraseUserRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
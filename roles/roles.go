@@ -0,0 +1,301 @@
+package roles
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/audit"
+)
+
+// Permissions that routes can require
+const (
+	UsersRead             = "users.read"
+	UsersWrite            = "users.write"
+	UsersDelete           = "users.delete"
+	UsersImpersonate      = "users.impersonate"
+	PrivacyManage         = "privacy.manage"
+	SessionsManage        = "sessions.manage"
+	SitesRead             = "sites.read"
+	SitesWrite            = "sites.write"
+	AbsencesRequest       = "absences.request"
+	AbsencesRead          = "absences.read"
+	AbsencesApprove       = "absences.approve"
+	AbsencesDelete        = "absences.delete"
+	AuditRead             = "audit.read"
+	ThrottlingManage      = "throttling.manage"
+	RolesManage           = "roles.manage"
+	OIDCClientsManage     = "oidc_clients.manage"
+	APIKeysManage         = "apikeys.manage"
+	ServiceAccountsManage = "serviceaccounts.manage"
+	// allPermissions grants every permission, including ones added later
+	allPermissions = "*"
+)
+
+// Default roles
+const (
+	Admin  = "ADMIN"
+	User   = "USER"
+	Driver = "DRIVER"
+)
+
+// roleRefreshInterval is how long changes of other instances take to become visible
+const roleRefreshInterval = time.Minute
+
+// Permissions lists every permission a role can be granted
+var Permissions = []string{
+	UsersRead, UsersWrite, UsersDelete, UsersImpersonate, PrivacyManage, SessionsManage,
+	SitesRead, SitesWrite,
+	AbsencesRequest, AbsencesRead, AbsencesApprove, AbsencesDelete,
+	AuditRead, ThrottlingManage, RolesManage, OIDCClientsManage, APIKeysManage, ServiceAccountsManage,
+}
+
+// defaultRoles are created on startup if they don't exist. ADMIN always has every permission.
+var defaultRoles = []Role{
+	{Name: Admin, Description: "Full access", Permissions: []string{allPermissions}, System: true},
+	{Name: User, Description: "Office staff", Permissions: []string{UsersRead, SitesRead, AbsencesRequest}, System: true},
+	{Name: Driver, Description: "Drivers", Permissions: []string{SitesRead, AbsencesRequest}, System: true},
+}
+
+var roleNameRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,31}$`)
+
+// RoleService resolves permissions of roles from an in-memory copy of the role collection.
+// The copy is reloaded after every change and periodically for changes of other instances.
+type RoleService struct {
+	rolesDbService *RolesDbService
+	auditService   *audit.AuditService
+	mu             sync.RWMutex
+	permissions    map[string][]string
+	magicLinks     map[string]bool
+}
+
+func NewRoleService(rolesDbService *RolesDbService, auditService *audit.AuditService) *RoleService {
+	return &RoleService{rolesDbService: rolesDbService, auditService: auditService, permissions: map[string][]string{}, magicLinks: map[string]bool{}}
+}
+
+// Start seeds the default roles, loads all roles and keeps refreshing them in the background
+func (r *RoleService) Start() error {
+	timestamp := time.Now()
+	for _, role := range defaultRoles {
+		role.InsertedAt = timestamp
+		role.UpdatedAt = timestamp
+		err := r.rolesDbService.SeedRole(role)
+		if err != nil {
+			return err
+		}
+	}
+	err := r.Refresh()
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(roleRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := r.Refresh()
+			if err != nil {
+				fmt.Println("Error refreshing roles:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Refresh reloads the roles from the database
+func (r *RoleService) Refresh() error {
+	roles, err := r.rolesDbService.GetRoles()
+	if err != nil {
+		return err
+	}
+	permissions := map[string][]string{}
+	magicLinks := map[string]bool{}
+	for _, role := range roles {
+		permissions[role.Name] = role.Permissions
+		magicLinks[role.Name] = role.MagicLink
+	}
+	r.mu.Lock()
+	r.permissions = permissions
+	r.magicLinks = magicLinks
+	r.mu.Unlock()
+	return nil
+}
+
+// HasPermission reports whether the role grants the permission
+func (r *RoleService) HasPermission(role, permission string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	permissions, exists := r.permissions[role]
+	if !exists {
+		return false
+	}
+	return slices.Contains(permissions, allPermissions) || slices.Contains(permissions, permission)
+}
+
+// GrantsAll reports whether the role grants every one of the permissions. The wildcard
+// is only granted by roles that have it themselves.
+func (r *RoleService) GrantsAll(role string, permissions []string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	granted, exists := r.permissions[role]
+	if !exists {
+		return false
+	}
+	if slices.Contains(granted, allPermissions) {
+		return true
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(granted, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// Covers reports whether the role grants every permission of the other role, so
+// members of the role can hand the other role out without gaining permissions
+func (r *RoleService) Covers(role, other string) bool {
+	r.mu.RLock()
+	permissions, exists := r.permissions[other]
+	r.mu.RUnlock()
+	if !exists {
+		return false
+	}
+	return r.GrantsAll(role, permissions)
+}
+
+// AllowsMagicLink reports whether members of the role may log in with a magic link
+func (r *RoleService) AllowsMagicLink(role string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.magicLinks[role]
+}
+
+// RoleExists reports whether a role with the name exists
+func (r *RoleService) RoleExists(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, exists := r.permissions[name]
+	return exists
+}
+
+// GetRoles returns all roles
+func (r *RoleService) GetRoles() ([]Role, error) {
+	return r.rolesDbService.GetRoles()
+}
+
+// CreateRole creates a new role
+func (r *RoleService) CreateRole(createRoleRequest CreateRoleRequest, actor audit.Actor) error {
+	if !roleNameRegexp.MatchString(createRoleRequest.Name) {
+		return errors.New("role name has to consist of 2 to 32 uppercase letters, digits or underscores")
+	}
+	if r.RoleExists(createRoleRequest.Name) {
+		return errors.New("Role already exists")
+	}
+	err := validatePermissions(createRoleRequest.Permissions)
+	if err != nil {
+		return err
+	}
+	err = r.checkPermissionsHeld(createRoleRequest.Permissions, actor)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now()
+	role := Role{
+		Name:        createRoleRequest.Name,
+		Description: createRoleRequest.Description,
+		Permissions: createRoleRequest.Permissions,
+		MagicLink:   createRoleRequest.MagicLink,
+		InsertedAt:  timestamp,
+		UpdatedAt:   timestamp,
+	}
+	err = r.rolesDbService.CreateRole(role)
+	if err != nil {
+		return err
+	}
+	r.auditService.Record(actor, audit.RoleCreated, "role", role.Name, nil, role)
+	return r.Refresh()
+}
+
+// UpdateRole replaces the description and permissions of a role
+func (r *RoleService) UpdateRole(updateRoleRequest UpdateRoleRequest, actor audit.Actor) error {
+	if updateRoleRequest.Name == Admin {
+		return errors.New("the ADMIN role can't be changed")
+	}
+	before, err := r.rolesDbService.GetRoleByName(updateRoleRequest.Name)
+	if err != nil {
+		return errors.New("Role not found")
+	}
+	err = validatePermissions(updateRoleRequest.Permissions)
+	if err != nil {
+		return err
+	}
+	// Roles with permissions the actor doesn't have can't be changed, and no role can gain
+	// them. For the actor's own role this means it can only lose permissions.
+	err = r.checkPermissionsHeld(before.Permissions, actor)
+	if err != nil {
+		return err
+	}
+	err = r.checkPermissionsHeld(updateRoleRequest.Permissions, actor)
+	if err != nil {
+		return err
+	}
+	err = r.rolesDbService.UpdateRole(updateRoleRequest.Name, updateRoleRequest.Description, updateRoleRequest.Permissions, updateRoleRequest.MagicLink)
+	if err != nil {
+		return err
+	}
+	after := *before
+	after.Description = updateRoleRequest.Description
+	after.Permissions = updateRoleRequest.Permissions
+	after.MagicLink = updateRoleRequest.MagicLink
+	r.auditService.Record(actor, audit.RoleUpdated, "role", before.Name, *before, after)
+	return r.Refresh()
+}
+
+// checkPermissionsHeld rejects permissions the actor's role doesn't grant, so members of
+// roles.manage can't escalate by granting themselves more. Actors without a user are trusted.
+func (r *RoleService) checkPermissionsHeld(permissions []string, actor audit.Actor) error {
+	if actor.UserId == "" {
+		return nil
+	}
+	if !r.GrantsAll(actor.Role, permissions) {
+		return errors.New("you can't grant permissions you don't have")
+	}
+	return nil
+}
+
+// DeleteRole deletes a role that is neither a default role nor assigned to any user
+func (r *RoleService) DeleteRole(name string, actor audit.Actor) error {
+	role, err := r.rolesDbService.GetRoleByName(name)
+	if err != nil {
+		return errors.New("Role not found")
+	}
+	if role.System {
+		return errors.New("default roles can't be deleted")
+	}
+	count, err := r.rolesDbService.CountUsersWithRole(name)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("Role is still assigned to users")
+	}
+	err = r.rolesDbService.DeleteRole(name)
+	if err != nil {
+		return err
+	}
+	r.auditService.Record(actor, audit.RoleDeleted, "role", name, *role, nil)
+	return r.Refresh()
+}
+
+// validatePermissions checks that only known permissions are granted
+func validatePermissions(permissions []string) error {
+	for _, permission := range permissions {
+		if !slices.Contains(Permissions, permission) {
+			return errors.New("unknown permission: " + permission)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package roles
+
+import (
+	"net/http"
+
+	"github.com/R3PTR/go-auth-api/audit"
+	"github.com/gin-gonic/gin"
+)
+
+type RoleController struct {
+	roleService *RoleService
+}
+
+func NewRoleController(roleService *RoleService) *RoleController {
+	return &RoleController{roleService: roleService}
+}
+
+// GetRoles returns all roles.
+func (rc *RoleController) GetRoles(c *gin.Context) {
+	roles, err := rc.roleService.GetRoles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// GetPermissions returns all permissions a role can be granted.
+func (rc *RoleController) GetPermissions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"permissions": Permissions})
+}
+
+// CreateRole creates a new role.
+func (rc *RoleController) CreateRole(c *gin.Context) {
+	var createRoleRequest CreateRoleRequest
+	if err := c.ShouldBindJSON(&createRoleRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := rc.roleService.CreateRole(createRoleRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Role created"})
+}
+
+// UpdateRole updates the permissions of a role.
+func (rc *RoleController) UpdateRole(c *gin.Context) {
+	var updateRoleRequest UpdateRoleRequest
+	if err := c.ShouldBindJSON(&updateRoleRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := rc.roleService.UpdateRole(updateRoleRequest, audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
+}
+
+// DeleteRole deletes a role.
+func (rc *RoleController) DeleteRole(c *gin.Context) {
+	err := rc.roleService.DeleteRole(c.Param("name"), audit.ActorFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted"})
+}
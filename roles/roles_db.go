@@ -0,0 +1,89 @@
+package roles
+
+import (
+	"context"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type RolesDbService struct {
+	mongoClient *database.MongoDBClient
+}
+
+func NewRolesDbService(mongoClient *database.MongoDBClient) *RolesDbService {
+	return &RolesDbService{mongoClient: mongoClient}
+}
+
+// getRoleCollection returns the role collection.
+func (r *RolesDbService) getRoleCollection() *mongo.Collection {
+	return r.mongoClient.GetCollection(r.mongoClient.Config.UserDatabase, r.mongoClient.Config.RoleCollection)
+}
+
+// GetRoles returns all roles.
+func (r *RolesDbService) GetRoles() ([]Role, error) {
+	roles := []Role{}
+	cursor, err := r.getRoleCollection().Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var role Role
+		err := cursor.Decode(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, cursor.Err()
+}
+
+// GetRoleByName returns a role by name.
+func (r *RolesDbService) GetRoleByName(name string) (*Role, error) {
+	var role Role
+	err := r.getRoleCollection().FindOne(context.Background(), bson.M{"_id": name}).Decode(&role)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// SeedRole creates a role if it does not exist yet, existing roles are left untouched.
+func (r *RolesDbService) SeedRole(role Role) error {
+	_, err := r.getRoleCollection().UpdateOne(context.Background(), bson.M{"_id": role.Name}, bson.M{"$setOnInsert": role}, options.Update().SetUpsert(true))
+	return err
+}
+
+// CreateRole creates a new role.
+func (r *RolesDbService) CreateRole(role Role) error {
+	_, err := r.getRoleCollection().InsertOne(context.Background(), role)
+	return err
+}
+
+// UpdateRole sets the description, permissions and magic link setting of a role.
+func (r *RolesDbService) UpdateRole(name, description string, permissions []string, magicLink bool) error {
+	update := bson.M{"$set": bson.M{"description": description, "permissions": permissions, "magicLink": magicLink, "updatedAt": time.Now()}}
+	result, err := r.getRoleCollection().UpdateOne(context.Background(), bson.M{"_id": name}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// DeleteRole deletes a role.
+func (r *RolesDbService) DeleteRole(name string) error {
+	_, err := r.getRoleCollection().DeleteOne(context.Background(), bson.M{"_id": name})
+	return err
+}
+
+// CountUsersWithRole returns the number of users that have the role.
+func (r *RolesDbService) CountUsersWithRole(name string) (int64, error) {
+	return r.mongoClient.GetCollection(r.mongoClient.Config.UserDatabase, r.mongoClient.Config.UserCollection).CountDocuments(context.Background(), bson.M{"role": name})
+}
@@ -0,0 +1,31 @@
+package roles
+
+import (
+	"time"
+)
+
+// Role is a named set of permissions, users reference it by name in User.Role
+type Role struct {
+	Name        string   `bson:"_id" json:"name"`
+	Description string   `bson:"description" json:"description"`
+	Permissions []string `bson:"permissions" json:"permissions"`
+	System      bool     `bson:"system" json:"system"`
+	// MagicLink allows the members of the role to log in with a link sent by email
+	MagicLink  bool      `bson:"magicLink" json:"magicLink"`
+	InsertedAt time.Time `bson:"insertedAt" json:"insertedAt"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+type CreateRoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	MagicLink   bool     `json:"magicLink"`
+}
+
+type UpdateRoleRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	MagicLink   bool     `json:"magicLink"`
+}
@@ -1,11 +1,16 @@
 package sites
 
+import (
+	"github.com/R3PTR/go-auth-api/audit"
+)
+
 type SiteService struct {
 	sitesDbService *SitesDbService
+	auditService   *audit.AuditService
 }
 
-func NewSiteService(sitesDbService *SitesDbService) *SiteService {
-	return &SiteService{sitesDbService: sitesDbService}
+func NewSiteService(sitesDbService *SitesDbService, auditService *audit.AuditService) *SiteService {
+	return &SiteService{sitesDbService: sitesDbService, auditService: auditService}
 }
 
 // GetSites returns all sites.
@@ -29,31 +34,65 @@ func (s *SiteService) GetWorkspaceByName(name string) (Workspace, error) {
 }
 
 // CreateSite creates a new site.
-func (s *SiteService) CreateSite(site Site) error {
-	return s.sitesDbService.CreateSite(site)
+func (s *SiteService) CreateSite(site Site, actor audit.Actor) error {
+	siteId, err := s.sitesDbService.CreateSite(site)
+	if err != nil {
+		return err
+	}
+	s.auditService.Record(actor, audit.SiteCreated, "site", siteId, nil, site)
+	return nil
 }
 
 // CreateWorkspace creates a new workspace.
-func (s *SiteService) CreateWorkspace(workspace Workspace) error {
-	return s.sitesDbService.CreateWorkspace(workspace)
+func (s *SiteService) CreateWorkspace(workspace Workspace, actor audit.Actor) error {
+	workspaceId, err := s.sitesDbService.CreateWorkspace(workspace)
+	if err != nil {
+		return err
+	}
+	s.auditService.Record(actor, audit.WorkspaceCreated, "workspace", workspaceId, nil, workspace)
+	return nil
 }
 
 // DeleteSite deletes a site.
-func (s *SiteService) DeleteSite(siteId string) error {
-	return s.sitesDbService.DeleteSite(siteId)
+func (s *SiteService) DeleteSite(siteId string, actor audit.Actor) error {
+	before, _ := s.sitesDbService.GetSiteById(siteId)
+	err := s.sitesDbService.DeleteSite(siteId)
+	if err != nil {
+		return err
+	}
+	s.auditService.Record(actor, audit.SiteDeleted, "site", siteId, before, nil)
+	return nil
 }
 
 // DeleteWorkspace deletes a workspace.
-func (s *SiteService) DeleteWorkspace(workspaceId string) error {
-	return s.sitesDbService.DeleteWorkspace(workspaceId)
+func (s *SiteService) DeleteWorkspace(workspaceId string, actor audit.Actor) error {
+	before, _ := s.sitesDbService.GetWorkspaceById(workspaceId)
+	err := s.sitesDbService.DeleteWorkspace(workspaceId)
+	if err != nil {
+		return err
+	}
+	s.auditService.Record(actor, audit.WorkspaceDeleted, "workspace", workspaceId, before, nil)
+	return nil
 }
 
 // UpdateSite updates a site.
-func (s *SiteService) UpdateSite(site Site) error {
-	return s.sitesDbService.UpdateSite(site)
+func (s *SiteService) UpdateSite(site Site, actor audit.Actor) error {
+	before, _ := s.sitesDbService.GetSiteById(site.Id)
+	err := s.sitesDbService.UpdateSite(site)
+	if err != nil {
+		return err
+	}
+	s.auditService.Record(actor, audit.SiteUpdated, "site", site.Id, before, site)
+	return nil
 }
 
 // UpdateWorkspace updates a workspace.
-func (s *SiteService) UpdateWorkspace(workspace Workspace) error {
-	return s.sitesDbService.UpdateWorkspace(workspace)
+func (s *SiteService) UpdateWorkspace(workspace Workspace, actor audit.Actor) error {
+	before, _ := s.sitesDbService.GetWorkspaceById(workspace.Id)
+	err := s.sitesDbService.UpdateWorkspace(workspace)
+	if err != nil {
+		return err
+	}
+	s.auditService.Record(actor, audit.WorkspaceUpdated, "workspace", workspace.Id, before, workspace)
+	return nil
 }
@@ -3,6 +3,7 @@ package sites
 import (
 	"net/http"
 
+	"github.com/R3PTR/go-auth-api/audit"
 	"github.com/gin-gonic/gin"
 )
 
@@ -46,7 +47,7 @@ func (sc *SiteController) CreateSite(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Site already exists"})
 		return
 	}
-	if err := sc.siteService.CreateSite(site); err != nil {
+	if err := sc.siteService.CreateSite(site, audit.ActorFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -65,7 +66,7 @@ func (sc *SiteController) CreateWorkspace(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Workspace already exists"})
 		return
 	}
-	if err := sc.siteService.CreateWorkspace(workspace); err != nil {
+	if err := sc.siteService.CreateWorkspace(workspace, audit.ActorFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -79,7 +80,7 @@ func (sc *SiteController) DeleteSite(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid site id"})
 		return
 	}
-	if err := sc.siteService.DeleteSite(siteId); err != nil {
+	if err := sc.siteService.DeleteSite(siteId, audit.ActorFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -89,7 +90,7 @@ func (sc *SiteController) DeleteSite(c *gin.Context) {
 // DeleteWorkspace deletes a workspace.
 func (sc *SiteController) DeleteWorkspace(c *gin.Context) {
 	workspaceId := c.Param("id")
-	if err := sc.siteService.DeleteWorkspace(workspaceId); err != nil {
+	if err := sc.siteService.DeleteWorkspace(workspaceId, audit.ActorFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -107,7 +108,7 @@ func (sc *SiteController) UpdateSite(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid site id"})
 		return
 	}
-	if err := sc.siteService.UpdateSite(site); err != nil {
+	if err := sc.siteService.UpdateSite(site, audit.ActorFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -125,7 +126,7 @@ func (sc *SiteController) UpdateWorkspace(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace id"})
 		return
 	}
-	if err := sc.siteService.UpdateWorkspace(workspace); err != nil {
+	if err := sc.siteService.UpdateWorkspace(workspace, audit.ActorFromContext(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -7,6 +7,7 @@ import (
 	"github.com/R3PTR/go-auth-api/database"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type SitesDbService struct {
@@ -97,16 +98,30 @@ func (s *SitesDbService) GetWorkspaceById(workspaceId string) (Workspace, error)
 	return workspace, err
 }
 
-// CreateSite creates a new site.
-func (s *SitesDbService) CreateSite(site Site) error {
-	_, err := s.mongoClient.GetCollection(s.mongoClient.Config.SiteDatabase, s.mongoClient.Config.SiteCollection).InsertOne(context.Background(), site)
-	return err
+// CreateSite creates a new site and returns its id.
+func (s *SitesDbService) CreateSite(site Site) (string, error) {
+	result, err := s.mongoClient.GetCollection(s.mongoClient.Config.SiteDatabase, s.mongoClient.Config.SiteCollection).InsertOne(context.Background(), site)
+	if err != nil {
+		return "", err
+	}
+	return insertedId(result), nil
 }
 
-// CreateWorkspace creates a new workspace.
-func (s *SitesDbService) CreateWorkspace(workspace Workspace) error {
-	_, err := s.mongoClient.GetCollection(s.mongoClient.Config.SiteDatabase, s.mongoClient.Config.WorkspaceCollection).InsertOne(context.Background(), workspace)
-	return err
+// CreateWorkspace creates a new workspace and returns its id.
+func (s *SitesDbService) CreateWorkspace(workspace Workspace) (string, error) {
+	result, err := s.mongoClient.GetCollection(s.mongoClient.Config.SiteDatabase, s.mongoClient.Config.WorkspaceCollection).InsertOne(context.Background(), workspace)
+	if err != nil {
+		return "", err
+	}
+	return insertedId(result), nil
+}
+
+// insertedId returns the id of an inserted document as hex string.
+func insertedId(result *mongo.InsertOneResult) string {
+	if objectId, ok := result.InsertedID.(primitive.ObjectID); ok {
+		return objectId.Hex()
+	}
+	return ""
 }
 
 // DeleteSite deletes a site.
@@ -0,0 +1,157 @@
+package throttling
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/config"
+)
+
+// Scopes that are throttled independently
+const (
+	Login          = "login"
+	ForgotPassword = "forgotPassword"
+	TwoFactor      = "twoFactor"
+	MagicLink      = "magicLink"
+	EmailChange    = "emailChange"
+	// ClientCredentials is only throttled by IP, client ids aren't secret
+	ClientCredentials = "clientCredentials"
+)
+
+const (
+	account = "account"
+	ip      = "ip"
+)
+
+type ThrottlingService struct {
+	throttlingDbService *ThrottlingDbService
+	policies            map[string]policy
+}
+
+func NewThrottlingService(throttlingDbService *ThrottlingDbService, config *config.Config) *ThrottlingService {
+	t := config.Throttling
+	login := policy{
+		maxAccountFailures: t.MaxAccountFailures,
+		maxIPFailures:      t.MaxIPFailures,
+		baseDelay:          time.Second * time.Duration(t.BaseDelaySeconds),
+		maxDelay:           time.Second * time.Duration(t.MaxDelaySeconds),
+		lockDuration:       time.Minute * time.Duration(t.LockMinutes),
+		window:             time.Minute * time.Duration(t.FailureWindowMinutes),
+	}
+	// Every reset request counts, so only a few are allowed per window
+	forgotPassword := login
+	forgotPassword.maxAccountFailures = t.MaxPasswordResets
+	forgotPassword.baseDelay = time.Minute
+	return &ThrottlingService{
+		throttlingDbService: throttlingDbService,
+		policies:            map[string]policy{Login: login, ForgotPassword: forgotPassword, TwoFactor: login, MagicLink: forgotPassword, EmailChange: forgotPassword, ClientCredentials: login},
+	}
+}
+
+// key is the id of the attempts of an account or IP. Usernames match in any letter case,
+// so their case mustn't give an attacker fresh attempts.
+func key(scope, kind, value string) string {
+	return scope + ":" + kind + ":" + strings.ToLower(value)
+}
+
+// Check returns a ThrottledError if the account or the client IP has to wait before the next attempt.
+// An empty account name only checks the client IP.
+func (t *ThrottlingService) Check(scope, accountName, clientIP string) error {
+	now := time.Now()
+	keys := []string{key(scope, ip, clientIP)}
+	if accountName != "" {
+		keys = append(keys, key(scope, account, accountName))
+	}
+	for _, k := range keys {
+		attempts, err := t.throttlingDbService.GetAttemptsByKey(k)
+		if err != nil {
+			return err
+		}
+		if attempts.LockedUntil.After(now) {
+			return &ThrottledError{Locked: true, RetryAfter: attempts.LockedUntil}
+		}
+		if attempts.NextAttemptAt.After(now) {
+			return &ThrottledError{RetryAfter: attempts.NextAttemptAt}
+		}
+	}
+	return nil
+}
+
+// RegisterFailure counts a failed attempt of the account and the client IP.
+// It reports whether the account got locked by this attempt. An empty account
+// name only counts for the client IP.
+func (t *ThrottlingService) RegisterFailure(scope, accountName, clientIP string) (bool, error) {
+	p, ok := t.policies[scope]
+	if !ok {
+		return false, errors.New("unknown throttling scope")
+	}
+	accountLocked := false
+	if accountName != "" {
+		var err error
+		accountLocked, err = t.registerFailure(p, scope, account, accountName, p.maxAccountFailures)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err := t.registerFailure(p, scope, ip, clientIP, p.maxIPFailures)
+	if err != nil {
+		return false, err
+	}
+	return accountLocked, nil
+}
+
+func (t *ThrottlingService) registerFailure(p policy, scope, kind, value string, maxFailures int) (bool, error) {
+	attempts, err := t.throttlingDbService.GetAttemptsByKey(key(scope, kind, value))
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	// Failures older than the window and expired locks are forgotten
+	if now.Sub(attempts.LastFailure) > p.window && !attempts.LockedUntil.After(now) {
+		attempts.Failures = 0
+		attempts.LockedUntil = time.Time{}
+	}
+	attempts.Scope = scope
+	attempts.Kind = kind
+	attempts.Value = value
+	attempts.Failures++
+	attempts.LastFailure = now
+	// The delay doubles with every failure
+	delay := p.baseDelay
+	for i := 1; i < attempts.Failures && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	attempts.NextAttemptAt = now.Add(delay)
+	locked := false
+	if attempts.Failures >= maxFailures && !attempts.LockedUntil.After(now) {
+		attempts.LockedUntil = now.Add(p.lockDuration)
+		locked = true
+	}
+	return locked, t.throttlingDbService.SaveAttempts(attempts)
+}
+
+// RegisterSuccess resets the failures of the account after a successful attempt
+func (t *ThrottlingService) RegisterSuccess(scope, accountName string) error {
+	return t.throttlingDbService.DeleteAttemptsByKey(key(scope, account, accountName))
+}
+
+// GetLocks returns all locked or delayed accounts and IPs
+func (t *ThrottlingService) GetLocks() ([]Attempts, error) {
+	return t.throttlingDbService.GetLocks()
+}
+
+// ClearLock removes the failures and the lock of an account or IP
+func (t *ThrottlingService) ClearLock(id string) error {
+	deleted, err := t.throttlingDbService.DeleteAttemptsById(id)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errors.New("lock not found")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package throttling
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ThrottlingController struct {
+	throttlingService *ThrottlingService
+}
+
+func NewThrottlingController(throttlingService *ThrottlingService) *ThrottlingController {
+	return &ThrottlingController{throttlingService: throttlingService}
+}
+
+// GetLocks returns all locked or delayed accounts and IPs.
+func (tc *ThrottlingController) GetLocks(c *gin.Context) {
+	locks, err := tc.throttlingService.GetLocks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"locks": locks})
+}
+
+// ClearLock removes the lock of an account or IP.
+func (tc *ThrottlingController) ClearLock(c *gin.Context) {
+	err := tc.throttlingService.ClearLock(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lock cleared"})
+}
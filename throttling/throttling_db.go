@@ -0,0 +1,82 @@
+package throttling
+
+import (
+	"context"
+	"time"
+
+	"github.com/R3PTR/go-auth-api/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ThrottlingDbService struct {
+	mongoClient *database.MongoDBClient
+}
+
+func NewThrottlingDbService(mongoClient *database.MongoDBClient) *ThrottlingDbService {
+	return &ThrottlingDbService{mongoClient: mongoClient}
+}
+
+// getAttemptsCollection returns the attempts collection.
+func (t *ThrottlingDbService) getAttemptsCollection() *mongo.Collection {
+	return t.mongoClient.GetCollection(t.mongoClient.Config.UserDatabase, t.mongoClient.Config.Throttling.Collection)
+}
+
+// GetAttemptsByKey returns the attempts of a key, or empty attempts if there are none.
+func (t *ThrottlingDbService) GetAttemptsByKey(key string) (Attempts, error) {
+	var attempts Attempts
+	err := t.getAttemptsCollection().FindOne(context.Background(), bson.M{"key": key}).Decode(&attempts)
+	if err == mongo.ErrNoDocuments {
+		return Attempts{Key: key}, nil
+	}
+	return attempts, err
+}
+
+// SaveAttempts inserts or replaces the attempts of a key.
+func (t *ThrottlingDbService) SaveAttempts(attempts Attempts) error {
+	attempts.Id = ""
+	_, err := t.getAttemptsCollection().ReplaceOne(context.Background(), bson.M{"key": attempts.Key}, attempts, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteAttemptsByKey deletes the attempts of a key.
+func (t *ThrottlingDbService) DeleteAttemptsByKey(key string) error {
+	_, err := t.getAttemptsCollection().DeleteOne(context.Background(), bson.M{"key": key})
+	return err
+}
+
+// GetLocks returns all attempts that are currently locked or delayed.
+func (t *ThrottlingDbService) GetLocks() ([]Attempts, error) {
+	attempts := []Attempts{}
+	now := time.Now()
+	filter := bson.M{"$or": []bson.M{{"lockedUntil": bson.M{"$gt": now}}, {"nextAttemptAt": bson.M{"$gt": now}}}}
+	cursor, err := t.getAttemptsCollection().Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		var attempt Attempts
+		err := cursor.Decode(&attempt)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, cursor.Err()
+}
+
+// DeleteAttemptsById deletes attempts by id, which clears their lock.
+func (t *ThrottlingDbService) DeleteAttemptsById(id string) (int64, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return 0, err
+	}
+	result, err := t.getAttemptsCollection().DeleteOne(context.Background(), bson.M{"_id": objectId})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,42 @@
+package throttling
+
+import (
+	"fmt"
+	"time"
+)
+
+// Attempts counts the failed attempts of one account or client IP in one scope
+type Attempts struct {
+	Id            string    `bson:"_id,omitempty" json:"id"`
+	Key           string    `bson:"key" json:"key"`
+	Scope         string    `bson:"scope" json:"scope"`
+	Kind          string    `bson:"kind" json:"kind"`
+	Value         string    `bson:"value" json:"value"`
+	Failures      int       `bson:"failures" json:"failures"`
+	LastFailure   time.Time `bson:"lastFailure" json:"lastFailure"`
+	NextAttemptAt time.Time `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LockedUntil   time.Time `bson:"lockedUntil,omitempty" json:"lockedUntil,omitempty"`
+}
+
+// policy holds the limits of a scope
+type policy struct {
+	maxAccountFailures int
+	maxIPFailures      int
+	baseDelay          time.Duration
+	maxDelay           time.Duration
+	lockDuration       time.Duration
+	window             time.Duration
+}
+
+// ThrottledError is returned while an account or IP has to wait or is locked
+type ThrottledError struct {
+	Locked     bool
+	RetryAfter time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed attempts, locked until %s", e.RetryAfter.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("too many failed attempts, try again after %s", e.RetryAfter.Format(time.RFC3339))
+}